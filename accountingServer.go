@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+)
+
+// Access-Acceptを返したSTAの情報。Accounting-RequestとN12で認証したSUPIを紐付けるために使う。
+// キーはauthenticatedStaKey()で生成する「NASアドレス/Calling-Station-Id」の文字列。
+// remoteIPはAccess-Requestの送信元IPで、CoA/Disconnect-Requestの送信先として使う。
+type authenticatedSta struct {
+	supi             string
+	nasAddress       string
+	remoteIP         string
+	nasIdentifier    string
+	callingStationId string
+	acceptedAt       time.Time
+}
+
+// Accounting-Requestで通知されたセッション1件分の情報。Acct-Session-Idをキーとしてグローバル変数acctSessionTableで管理する。
+type accountingSession struct {
+	acctSessionId    string
+	supi             string
+	userName         string
+	nasAddress       string
+	nasIdentifier    string
+	callingStationId string
+	calledStationId  string
+	framedIPAddress  string
+	status           string
+	startTime        time.Time
+	lastUpdate       time.Time
+	sessionTime      uint32
+	inputOctets      uint64
+	outputOctets     uint64
+	terminateCause   string
+}
+
+// Access-Acceptを返したSTAを管理するグローバル変数。値はauthenticatedSta型。
+var authenticatedStaTable sync.Map
+
+// Accountingセッションを管理するグローバル変数。キーはAcct-Session-Id(string)、値はaccountingSession型。
+var acctSessionTable sync.Map
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+var accountingEnabled bool
+var accountingListenAddr string
+
+// accountingSessionTTLは、認証済みSTAとAccountingセッションの保持時間(秒)。
+// 最後のAccounting-Request(Interim-Update含む)から、またはAccounting-Requestのない認証済みSTAはAccess-Acceptからこの時間を過ぎたものを削除する。
+// Stopを取りこぼした場合や、Accountingを送らないNASの場合に記録が残り続けないようにするためのもの。
+var accountingSessionTTL time.Duration
+
+// authenticatedStaTable/acctSessionTableで使うNASアドレスは、NAS-IP-Addressがあればそれを、なければ送信元IPを使う。
+func nasAddressOf(r *radius.Request) string {
+	if nasIP := rfc2865.NASIPAddress_Get(r.Packet); nasIP != nil {
+		return nasIP.String()
+	}
+	return remoteAddrToIP(r.RemoteAddr).String()
+}
+
+func authenticatedStaKey(nasAddress, callingStationId string) string {
+	return nasAddress + "/" + callingStationId
+}
+
+// Access-Acceptの送信に成功した時に呼び出し、認証済みSTAとしてSUPIを記録する。
+func authenticatedStaStore(r *radius.Request, supi string) {
+	sta := authenticatedSta{
+		supi:             supi,
+		nasAddress:       nasAddressOf(r),
+		remoteIP:         remoteAddrToIP(r.RemoteAddr).String(),
+		nasIdentifier:    rfc2865.NASIdentifier_GetString(r.Packet),
+		callingStationId: rfc2865.CallingStationID_GetString(r.Packet),
+		acceptedAt:       time.Now(),
+	}
+	key := authenticatedStaKey(sta.nasAddress, sta.callingStationId)
+	authenticatedStaTable.Store(key, sta)
+	log.Printf("[Accounting] authenticated STA STORE / key: %v / SUPI: %v\n", key, supi)
+}
+
+// Accounting Server(既定ではUDP 1813)のハンドラ。
+// Request Authenticatorの検証は、radius.PacketServerがSecretSource(Radiusクライアントごとの共有秘密鍵)を用いて実施済み。
+// ここではNAS-Identifierを含めたクライアント判定を行ったうえでAcct-Status-Typeごとにセッションを更新し、Accounting-Responseを返す。
+func accountingHandler(w radius.ResponseWriter, r *radius.Request) {
+	log.Printf("[Accounting] %v (ID: 0x%X) received from %v\n", r.Packet.Code, r.Packet.Identifier, r.RemoteAddr)
+	nasId := rfc2865.NASIdentifier_GetString(r.Packet)
+	if _, clientOK := requestClientLookup(r, nasId); !clientOK {
+		log.Printf("[Accounting] Client not Allowed : %v (NAS-Identifier: %q). silently discarded.\n", r.RemoteAddr, nasId)
+		return
+	}
+	switch r.Packet.Code {
+	case radius.CodeAccountingRequest:
+	case radius.CodeStatusServer:
+		statusServerHandle(w, r, radius.CodeAccountingResponse)
+		return
+	default:
+		log.Printf("[Accounting] %v is not supported on accounting port. silently discarded.\n", r.Packet.Code)
+		return
+	}
+	statusType, statusTypeErr := rfc2866.AcctStatusType_Lookup(r.Packet)
+	if statusTypeErr != nil {
+		log.Printf("[Accounting] Acct-Status-Type not found. silently discarded. / %v\n", statusTypeErr)
+		return
+	}
+	nasAddress := nasAddressOf(r)
+	switch statusType {
+	case rfc2866.AcctStatusType_Value_Start, rfc2866.AcctStatusType_Value_InterimUpdate, rfc2866.AcctStatusType_Value_Stop:
+		acctSessionId, sessionIdErr := rfc2866.AcctSessionID_LookupString(r.Packet)
+		if sessionIdErr != nil {
+			log.Printf("[Accounting] Acct-Session-Id not found. silently discarded. / %v\n", sessionIdErr)
+			return
+		}
+		acctSessionUpdate(r, statusType, acctSessionId, nasAddress)
+	case rfc2866.AcctStatusType_Value_AccountingOn, rfc2866.AcctStatusType_Value_AccountingOff:
+		// NASの起動/停止通知。該当NASの既存セッションは全て終了したものとして削除する。
+		log.Printf("[Accounting] %v from NAS %v (NAS-Identifier: %q)\n", statusType, nasAddress, nasId)
+		acctSessionClearByNAS(nasAddress)
+	default:
+		log.Printf("[Accounting] Acct-Status-Type %v is not supported. only Accounting-Response is returned.\n", statusType)
+	}
+	// Accounting-ResponseにはProxy-Stateのみ載せ替える。
+	response := r.Response(radius.CodeAccountingResponse)
+	if attr33, attr33Exist := multiAttrGet(r.Packet, 33); attr33Exist {
+		for i := 0; i < len(attr33); i++ {
+			response.Attributes.Add(33, attr33[i])
+		}
+	}
+	if writingErr := w.Write(response); writingErr != nil {
+		log.Printf("[Accounting] Failed to send Accounting-Response / %v\n", writingErr)
+	} else {
+		log.Printf("[Accounting] %v (ID: 0x%X) send to %v\n", response.Code, response.Identifier, r.RemoteAddr)
+	}
+}
+
+// Start/Interim-Update/Stopの内容でacctSessionTableを更新する。Stopを受信したセッションはログ出力後に削除する(認証済みSTAの記録も同様)。
+// SUPIは、Access-Accept送信時に記録したauthenticatedStaTableから「NASアドレス/Calling-Station-Id」で引き当てる。
+func acctSessionUpdate(r *radius.Request, statusType rfc2866.AcctStatusType, acctSessionId, nasAddress string) {
+	now := time.Now()
+	var session accountingSession
+	value, ok := acctSessionTable.Load(acctSessionId)
+	if ok {
+		session = value.(accountingSession)
+	} else {
+		session = accountingSession{
+			acctSessionId: acctSessionId,
+			startTime:     now,
+		}
+	}
+	session.status = statusType.String()
+	session.lastUpdate = now
+	session.userName = rfc2865.UserName_GetString(r.Packet)
+	session.nasAddress = nasAddress
+	session.nasIdentifier = rfc2865.NASIdentifier_GetString(r.Packet)
+	session.callingStationId = rfc2865.CallingStationID_GetString(r.Packet)
+	session.calledStationId = rfc2865.CalledStationID_GetString(r.Packet)
+	if framedIP := rfc2865.FramedIPAddress_Get(r.Packet); framedIP != nil {
+		session.framedIPAddress = framedIP.String()
+	}
+	session.sessionTime = uint32(rfc2866.AcctSessionTime_Get(r.Packet))
+	session.inputOctets = uint64(rfc2869.AcctInputGigawords_Get(r.Packet))<<32 | uint64(rfc2866.AcctInputOctets_Get(r.Packet))
+	session.outputOctets = uint64(rfc2869.AcctOutputGigawords_Get(r.Packet))<<32 | uint64(rfc2866.AcctOutputOctets_Get(r.Packet))
+	if session.supi == "" {
+		staValue, staOK := authenticatedStaTable.Load(authenticatedStaKey(nasAddress, session.callingStationId))
+		if staOK {
+			session.supi = staValue.(authenticatedSta).supi
+		} else {
+			log.Printf("[Accounting] authenticated STA not found for %v / %v\n", nasAddress, session.callingStationId)
+		}
+	}
+	if statusType == rfc2866.AcctStatusType_Value_Stop {
+		session.terminateCause = rfc2866.AcctTerminateCause_Get(r.Packet).String()
+		acctSessionTable.Delete(acctSessionId)
+		log.Printf("[Accounting] session DELETE / %v\n", session)
+		// 同じSTAの他のセッションが残っていなければ、認証済みSTAの記録も削除する。
+		if len(acctSessionIdsByStation(nasAddress, session.callingStationId)) == 0 {
+			staKey := authenticatedStaKey(nasAddress, session.callingStationId)
+			if _, deleted := authenticatedStaTable.LoadAndDelete(staKey); deleted {
+				log.Printf("[Accounting] authenticated STA DELETE / key: %v\n", staKey)
+			}
+		}
+	} else {
+		acctSessionTable.Store(acctSessionId, session)
+		log.Printf("[Accounting] session STORE / %v\n", session)
+	}
+}
+
+// 対象NASアドレスに紐づくセッションとSTA認証記録を全て削除する（Accounting-On/Off受信時）。
+func acctSessionClearByNAS(nasAddress string) {
+	acctSessionTable.Range(func(key, value any) bool {
+		if value.(accountingSession).nasAddress == nasAddress {
+			acctSessionTable.Delete(key)
+			log.Printf("[Accounting] session DELETE (NAS reset) / Acct-Session-Id: %v\n", key)
+		}
+		return true
+	})
+	authenticatedStaTable.Range(func(key, value any) bool {
+		if value.(authenticatedSta).nasAddress == nasAddress {
+			authenticatedStaTable.Delete(key)
+		}
+		return true
+	})
+}
+
+// 最後の更新からaccountingSessionTTLを過ぎたAccountingセッションと、
+// Accountingセッションが無いままAccess-AcceptからaccountingSessionTTLを過ぎた認証済みSTAを定期的に削除する。main()からgoroutineで起動する。
+func accountingSessionSweeper() {
+	ticker := time.NewTicker(accountingSessionTTL / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		acctSessionTable.Range(func(key, value any) bool {
+			if session := value.(accountingSession); now.Sub(session.lastUpdate) > accountingSessionTTL {
+				acctSessionTable.Delete(key)
+				log.Printf("[Accounting] session DELETE (expired) / %v\n", session)
+			}
+			return true
+		})
+		authenticatedStaTable.Range(func(key, value any) bool {
+			sta := value.(authenticatedSta)
+			if now.Sub(sta.acceptedAt) > accountingSessionTTL && len(acctSessionIdsByStation(sta.nasAddress, sta.callingStationId)) == 0 {
+				authenticatedStaTable.Delete(key)
+				log.Printf("[Accounting] authenticated STA DELETE (expired) / key: %v / SUPI: %v\n", key, sta.supi)
+			}
+			return true
+		})
+	}
+}
+
+// 対象のNASアドレス/Calling-Station-Idに該当するAccountingセッションのAcct-Session-Idを全て返す。
+func acctSessionIdsByStation(nasAddress, callingStationId string) []string {
+	var ids []string
+	acctSessionTable.Range(func(key, value any) bool {
+		if s := value.(accountingSession); s.nasAddress == nasAddress && s.callingStationId == callingStationId {
+			ids = append(ids, s.acctSessionId)
+		}
+		return true
+	})
+	return ids
+}
+
+func (s accountingSession) String() string {
+	return fmt.Sprintf("Acct-Session-Id: %v, Status: %v, SUPI: %v, User-Name: %v, NAS: %v(%v), Calling-Station-Id: %v, Framed-IP: %v, Session-Time: %v, In: %v, Out: %v, Terminate-Cause: %v",
+		s.acctSessionId, s.status, s.supi, s.userName, s.nasAddress, s.nasIdentifier, s.callingStationId, s.framedIPAddress, s.sessionTime, s.inputOctets, s.outputOctets, s.terminateCause)
+}
+
+// Accounting Serverを生成する。SecretSourceは認証側と同じRadiusクライアント一覧を使う。
+func newAccountingServer() *radius.PacketServer {
+	listenAddr := accountingListenAddr
+	if listenAddr == "" {
+		listenAddr = ":1813"
+	}
+	if _, _, splitErr := net.SplitHostPort(listenAddr); splitErr != nil {
+		log.Printf("[Accounting] invalid listen address %v, fallback to :1813\n", listenAddr)
+		listenAddr = ":1813"
+	}
+	return &radius.PacketServer{
+		Addr:         listenAddr,
+		Handler:      radius.HandlerFunc(accountingHandler),
+		SecretSource: clientTableSecretSource{},
+	}
+}
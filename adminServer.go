@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// adminTokenが空でなければ、全てのリクエストに"Authorization: Bearer [adminToken]"を要求する。
+// adminTokenが空の場合は、ループバックアドレス以外で待ち受けることはできない(adminListenValidateで弾く)。
+var adminListenAddr string
+var adminToken string
+
+// 管理用HTTPサーバの各段階の制限時間。
+// 管理コマンド(CoA/Disconnect)は対象セッションごとにdynAuthTimeoutまで応答を待つため、書き込みの制限時間は長めにとる。
+const (
+	adminReadHeaderTimeout = 5 * time.Second
+	adminReadTimeout       = 10 * time.Second
+	adminWriteTimeout      = 60 * time.Second
+	adminIdleTimeout       = 60 * time.Second
+)
+
+// 管理用HTTPサーバのmux。各機能のハンドラはadminServerStart()で登録する。
+var adminMux = http.NewServeMux()
+
+// adminListenとadminTokenの組み合わせをチェックする。
+// トークンなしで待ち受けられるのはループバックアドレス(127.0.0.1、::1、localhost)のみとする。
+func adminListenValidate(listen string, token string) error {
+	host, _, splitErr := net.SplitHostPort(listen)
+	if splitErr != nil {
+		return errors.New("invalid admin listen address")
+	}
+	if token != "" {
+		if len(token) < 16 {
+			return errors.New("adminToken must be at least 16 characters")
+		}
+		return nil
+	}
+	if !isLoopbackHost(host) {
+		return errors.New("adminListen on a non-loopback address requires adminToken : " + listen)
+	}
+	return nil
+}
+
+// ホストがループバックアドレス(127.0.0.1等、::1、localhost)かどうかを判定する。空文字列(全アドレスで待ち受け)はループバックではない。
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminTokenが設定されていれば、Authorizationヘッダのbearerトークンを照合してからhandlerに渡す。
+func adminAuthorize(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				log.Printf("[Admin] unauthorized request from %v : %v %v\n", r.RemoteAddr, r.Method, r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="rad5gcgw-admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// 管理用HTTPサーバを起動する。運用者がcurl等で操作することを想定している。
+// adminTokenを設定した場合は、Authorizationヘッダでトークンを渡す。
+// 例: curl -X POST -H "Authorization: Bearer [adminToken]" "http://127.0.0.1:8801/dynauth/disconnect?supi=imsi-001010000000001"
+func adminServerStart() error {
+	adminMux.HandleFunc("/dynauth/disconnect", adminDisconnectHandler)
+	adminMux.HandleFunc("/dynauth/coa", adminCoAHandler)
+	adminMux.HandleFunc("/stats/message-authenticator", adminMsgAuthStatsHandler)
+	adminMux.HandleFunc("/stats/sbi", adminSbiStatsHandler)
+	adminMux.HandleFunc("/stats/eap-sessions", adminEapSessionStatsHandler)
+	adminMux.HandleFunc("/stats/cluster", adminClusterStatsHandler)
+	log.Printf("[Admin] admin server start on %v (token: %v)\n", adminListenAddr, adminToken != "")
+	server := &http.Server{
+		Addr:              adminListenAddr,
+		Handler:           adminAuthorize(adminMux),
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+		ReadTimeout:       adminReadTimeout,
+		WriteTimeout:      adminWriteTimeout,
+		IdleTimeout:       adminIdleTimeout,
+	}
+	return server.ListenAndServe()
+}
+
+// 管理コマンドの応答を返す。結果は1行1セッションの文字列リストとしてJSONで返す。
+func adminWriteResults(w http.ResponseWriter, results []dynAuthResult, sendErr error) {
+	var body struct {
+		Results []string `json:"results"`
+		Error   string   `json:"error,omitempty"`
+	}
+	for _, result := range results {
+		body.Results = append(body.Results, result.String())
+	}
+	w.Header().Set("content-type", "application/json")
+	if sendErr != nil {
+		body.Error = sendErr.Error()
+		w.WriteHeader(http.StatusNotFound)
+	}
+	if encodeErr := json.NewEncoder(w).Encode(body); encodeErr != nil {
+		log.Printf("[Admin] response encoding error / %v\n", encodeErr)
+	}
+}
+
+// POST /dynauth/disconnect?supi=xxx
+func adminDisconnectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	supi := r.URL.Query().Get("supi")
+	if supi == "" {
+		http.Error(w, "supi is required", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[Admin] Disconnect-Request requested for %v from %v\n", supi, r.RemoteAddr)
+	results, sendErr := dynAuthDisconnect(r.Context(), supi)
+	adminWriteResults(w, results, sendErr)
+}
+
+// POST /dynauth/coa?supi=xxx&sessionTimeout=秒&filterId=xxx
+// sessionTimeout(Session-Timeout)とfilterId(Filter-Id)のうち、少なくとも1つを指定する。
+func adminCoAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	supi := query.Get("supi")
+	if supi == "" {
+		http.Error(w, "supi is required", http.StatusBadRequest)
+		return
+	}
+	attrPacket := &radius.Packet{}
+	if sessionTimeoutStr := query.Get("sessionTimeout"); sessionTimeoutStr != "" {
+		sessionTimeout, atoiErr := strconv.Atoi(sessionTimeoutStr)
+		if atoiErr != nil || sessionTimeout < 0 {
+			http.Error(w, "invalid sessionTimeout", http.StatusBadRequest)
+			return
+		}
+		rfc2865.SessionTimeout_Add(attrPacket, rfc2865.SessionTimeout(sessionTimeout))
+	}
+	if filterId := query.Get("filterId"); filterId != "" {
+		if filterIdErr := rfc2865.FilterID_AddString(attrPacket, filterId); filterIdErr != nil {
+			http.Error(w, "invalid filterId", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(attrPacket.Attributes) == 0 {
+		http.Error(w, "sessionTimeout or filterId is required", http.StatusBadRequest)
+		return
+	}
+	log.Printf("[Admin] CoA-Request requested for %v from %v\n", supi, r.RemoteAddr)
+	results, sendErr := dynAuthCoA(r.Context(), supi, attrPacket.Attributes)
+	adminWriteResults(w, results, sendErr)
+}
+
+// GET /stats/message-authenticator
+// Message-Authenticatorの検証(BlastRADIUS対策)で破棄したパケット数を、理由ごとに返す。
+func adminMsgAuthStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body := struct {
+		Missing  uint64 `json:"missing"`
+		NotFirst uint64 `json:"notFirst"`
+		Invalid  uint64 `json:"invalid"`
+	}{
+		Missing:  msgAuthDiscardCounters.missing.Load(),
+		NotFirst: msgAuthDiscardCounters.notFirst.Load(),
+		Invalid:  msgAuthDiscardCounters.invalid.Load(),
+	}
+	w.Header().Set("content-type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(body); encodeErr != nil {
+		log.Printf("[Admin] response encoding error / %v\n", encodeErr)
+	}
+}
+
+// GET /stats/sbi
+// N12(SBI)の接続の使い回し状況とプロトコル別のRequest数を返す。
+func adminSbiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body := struct {
+		HttpVersion   string `json:"httpVersion"`
+		NewConns      uint64 `json:"newConns"`
+		ReusedConns   uint64 `json:"reusedConns"`
+		IdleConns     uint64 `json:"idleConns"`
+		Http1Requests uint64 `json:"http1Requests"`
+		Http2Requests uint64 `json:"http2Requests"`
+	}{
+		HttpVersion:   sbiHttpVersion,
+		NewConns:      sbiConnStats.newConns.Load(),
+		ReusedConns:   sbiConnStats.reusedConns.Load(),
+		IdleConns:     sbiConnStats.idleConns.Load(),
+		Http1Requests: sbiConnStats.http1Requests.Load(),
+		Http2Requests: sbiConnStats.http2Requests.Load(),
+	}
+	w.Header().Set("content-type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(body); encodeErr != nil {
+		log.Printf("[Admin] response encoding error / %v\n", encodeErr)
+	}
+}
+
+// GET /stats/eap-sessions
+// EAP認証セッションテーブルの保持数と、TTLで破棄したセッション数・上限到達で受け付けなかった新規認証数を返す。
+// あわせて、認証を中断したセッションのAUSF認証コンテキストの解放(DELETE)の成否数を返す。
+func adminEapSessionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body := struct {
+		Active        int     `json:"active"`
+		MaxEntries    int     `json:"maxEntries"`
+		TTL           float64 `json:"ttl"`
+		Stored        uint64  `json:"stored"`
+		Expired       uint64  `json:"expired"`
+		RejectedFull  uint64  `json:"rejectedFull"`
+		Released      uint64  `json:"ausfContextReleased"`
+		ReleaseFailed uint64  `json:"ausfContextReleaseFailed"`
+	}{
+		Active:        eapSessions.Len(),
+		MaxEntries:    eapSessionMaxEntries,
+		TTL:           eapSessionTTL.Seconds(),
+		Stored:        eapSessionStats.stored.Load(),
+		Expired:       eapSessionStats.expired.Load(),
+		RejectedFull:  eapSessionStats.rejectedFull.Load(),
+		Released:      authContextReleaseStats.released.Load(),
+		ReleaseFailed: authContextReleaseStats.releaseFailed.Load(),
+	}
+	w.Header().Set("content-type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(body); encodeErr != nil {
+		log.Printf("[Admin] response encoding error / %v\n", encodeErr)
+	}
+}
+
+// GET /stats/cluster
+// このノードのbootId、ピアごとの接続状態・ピアのbootIdと複製したイベント数、ピアから受信したメッセージ数と送信元ごとの最後のbootId/seqを返す。
+func adminClusterStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type peerStats struct {
+		Address       string `json:"address"`
+		Connected     bool   `json:"connected"`
+		LastError     string `json:"lastError,omitempty"`
+		PeerBootId    string `json:"peerBootId,omitempty"`
+		SentMessages  uint64 `json:"sentMessages"`
+		SentEvents    uint64 `json:"sentEvents"`
+		DroppedEvents uint64 `json:"droppedEvents"`
+	}
+	type receivedFrom struct {
+		Node   string `json:"node"`
+		BootId string `json:"bootId"`
+		Seq    uint64 `json:"seq"`
+	}
+	body := struct {
+		Node             string         `json:"node"`
+		BootId           string         `json:"bootId,omitempty"`
+		Peers            []peerStats    `json:"peers"`
+		ReceivedFrom     []receivedFrom `json:"receivedFrom"`
+		ReceivedMessages uint64         `json:"receivedMessages"`
+		ReceivedEvents   uint64         `json:"receivedEvents"`
+		RejectedMessages uint64         `json:"rejectedMessages"`
+	}{
+		Node:         clusterNodeName,
+		Peers:        []peerStats{},
+		ReceivedFrom: []receivedFrom{},
+	}
+	node := clusterLocalNode
+	if node == nil {
+		node = &clusterNode{}
+	}
+	body.BootId = node.bootId
+	body.ReceivedMessages = node.receivedMessages.Load()
+	body.ReceivedEvents = node.receivedEvents.Load()
+	body.RejectedMessages = node.rejectedMessages.Load()
+	node.receivedMu.Lock()
+	for name, state := range node.received {
+		body.ReceivedFrom = append(body.ReceivedFrom, receivedFrom{Node: name, BootId: state.bootId, Seq: state.seq})
+	}
+	node.receivedMu.Unlock()
+	for _, peer := range node.peers {
+		peer.mu.Lock()
+		stats := peerStats{Address: peer.address, Connected: peer.connected, LastError: peer.lastError, PeerBootId: peer.peerBootId}
+		peer.mu.Unlock()
+		stats.SentMessages = peer.sentMessages.Load()
+		stats.SentEvents = peer.sentEvents.Load()
+		stats.DroppedEvents = peer.droppedEvents.Load()
+		body.Peers = append(body.Peers, stats)
+	}
+	w.Header().Set("content-type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(body); encodeErr != nil {
+		log.Printf("[Admin] response encoding error / %v\n", encodeErr)
+	}
+}
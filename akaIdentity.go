@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"layeh.com/radius"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// akaIdentityRequestは、仮名・高速再認証・匿名のIdentityを受け取った際に最初に要求するIdentityの種類("any"/"fullauth"/"permanent")。
+// akaIdentityMaxRoundsは、1つの認証セッションで送るEAP-Request/AKA-Identityの上限回数(1～3)。
+var akaIdentityRequest string
+var akaIdentityMaxRounds int
+
+const (
+	akaIdentityRequestAny       = "any"
+	akaIdentityRequestFullauth  = "fullauth"
+	akaIdentityRequestPermanent = "permanent"
+)
+
+// EAP-Request/AKA-Identityで使うIdentity要求のAttribute Type(RFC 4187 10.2～10.4)。
+const (
+	atPermanentIdReq uint8 = 10
+	atAnyIdReq       uint8 = 13
+	atFullauthIdReq  uint8 = 17
+)
+
+// EAP-Response/Identityが匿名("anonymous@realm"または"@realm")だった場合に、eapIdentiySet.identityPrefixに入れる値。
+const identityPrefixAnonymous = "anonymous"
+
+// Identity要求をこれ以上送れない(上限回数に達した、またはAT_PERMANENT_ID_REQを送り済み)ことを示すエラー。
+var errAkaIdentityRoundsExhausted = errors.New("no more identity request allowed")
+
+// ユーザ名が匿名Identityかどうかを判定する。
+func isAnonymousUsername(username string) bool {
+	return username == "" || strings.EqualFold(username, "anonymous")
+}
+
+// AUSFへそのまま渡せる永続Identity(IMSIまたはSUCI)かどうかを判定する。
+// EAP-AKAの永続Identity("0")は、EAP-Response/IdentityではEAP-AKA'へ誘導するためにAT_PERMANENT_ID_REQを送るが、
+// AKA'-IdentityのAT_IDENTITYで返ってきた場合はIMSIが分かっているため永続Identityとして扱う。
+func isPermanentIdentity(identityPrefix string) bool {
+	switch identityPrefix {
+	case "0", "6", identityPrefixSuci:
+		return true
+	}
+	return false
+}
+
+// 設定値akaIdentityRequestを、最初に送るIdentity要求のAttribute Typeに変換する。
+func akaIdentityRequestAttr(request string) (uint8, error) {
+	switch request {
+	case akaIdentityRequestAny:
+		return atAnyIdReq, nil
+	case "", akaIdentityRequestFullauth:
+		return atFullauthIdReq, nil
+	case akaIdentityRequestPermanent:
+		return atPermanentIdReq, nil
+	}
+	return 0, errors.New("invalid akaIdentityRequest (any, fullauth or permanent) : " + request)
+}
+
+// 次に送るIdentity要求のAttribute Typeを決定する。
+// lastReqは直前に送ったIdentity要求(まだ送っていなければ0)、roundsはこのセッションで送ったIdentity要求の回数。
+// RFC 4187 4.1.6に従い、要求はAT_ANY_ID_REQ→AT_FULLAUTH_ID_REQ→AT_PERMANENT_ID_REQの順にのみ進め、同じ要求は繰り返さない。
+// EAP-AKAの永続Identity("0")は、EAP-AKA'で答え直させるためにAT_PERMANENT_ID_REQから始める。
+func akaIdentityNextRequest(identityPrefix string, lastReq uint8, rounds int) (uint8, error) {
+	if rounds >= akaIdentityMaxRounds {
+		return 0, fmt.Errorf("%w (%v rounds)", errAkaIdentityRoundsExhausted, rounds)
+	}
+	switch lastReq {
+	case 0:
+		if identityPrefix == "0" {
+			return atPermanentIdReq, nil
+		}
+		return akaIdentityRequestAttr(akaIdentityRequest)
+	case atAnyIdReq:
+		return atFullauthIdReq, nil
+	case atFullauthIdReq:
+		return atPermanentIdReq, nil
+	}
+	return 0, fmt.Errorf("%w (%v already sent)", errAkaIdentityRoundsExhausted, akaIdentityAttrName(lastReq))
+}
+
+// ログ出力用のAttribute名。
+func akaIdentityAttrName(attrType uint8) string {
+	switch attrType {
+	case atAnyIdReq:
+		return "AT_ANY_ID_REQ"
+	case atFullauthIdReq:
+		return "AT_FULLAUTH_ID_REQ"
+	case atPermanentIdReq:
+		return "AT_PERMANENT_ID_REQ"
+	}
+	return fmt.Sprintf("attribute %v", attrType)
+}
+
+// 引数attrTypeのIdentity要求を載せたEAP-Request/AKA'-Identityを生成する(RFC 5448 / RFC 4187 9.2)。
+// Code(1)・Identifier・Length(12)・Type(50)・Subtype(5)・Reserved(2byte)・Attribute(Type・Length(1)・Reserved(2byte))の順に並ぶ。
+func eapAkaIdentityRequest(eapId uint8, attrType uint8) []byte {
+	return []byte{0x01, eapId, 0x00, 0x0c, 0x32, 0x05, 0x00, 0x00, attrType, 0x01, 0x00, 0x00}
+}
+
+// EAP-Request/AKA'-IdentityをAccess-Challengeに載せて返す。EAP-IDはAUSFを介さないためgenerateEAPIdで生成する。
+func akaIdentityChallenge(r *radius.Request, attrType uint8) (*radius.Packet, uint8) {
+	challenge := r.Response(radius.CodeAccessChallenge)
+	eapId := generateEAPId()
+	eapMessageAdd(challenge, eapAkaIdentityRequest(eapId, attrType))
+	return challenge, eapId
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAkaIdentityNextRequest(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        string
+		maxRounds      int
+		identityPrefix string
+		lastReq        uint8
+		rounds         int
+		want           uint8
+		wantExhausted  bool
+		wantErr        bool
+	}{
+		{name: "any first", request: akaIdentityRequestAny, maxRounds: 3, identityPrefix: "2", want: atAnyIdReq},
+		{name: "fullauth first", request: akaIdentityRequestFullauth, maxRounds: 3, identityPrefix: "2", want: atFullauthIdReq},
+		{name: "permanent first", request: akaIdentityRequestPermanent, maxRounds: 3, identityPrefix: identityPrefixAnonymous, want: atPermanentIdReq},
+		{name: "any then fullauth", request: akaIdentityRequestAny, maxRounds: 3, identityPrefix: "7", lastReq: atAnyIdReq, rounds: 1, want: atFullauthIdReq},
+		{name: "fullauth then permanent", request: akaIdentityRequestAny, maxRounds: 3, identityPrefix: "2", lastReq: atFullauthIdReq, rounds: 2, want: atPermanentIdReq},
+		// AT_PERMANENT_ID_REQの後は、上限回数に達していなくても要求しない。
+		{name: "after permanent", request: akaIdentityRequestFullauth, maxRounds: 3, identityPrefix: "2", lastReq: atPermanentIdReq, rounds: 2, wantExhausted: true},
+		{name: "round cap", request: akaIdentityRequestAny, maxRounds: 1, identityPrefix: "2", lastReq: atAnyIdReq, rounds: 1, wantExhausted: true},
+		{name: "round cap reached at permanent", request: akaIdentityRequestAny, maxRounds: 3, identityPrefix: "2", lastReq: atPermanentIdReq, rounds: 3, wantExhausted: true},
+		// EAP-AKAの永続Identity("0")は、設定によらずAT_PERMANENT_ID_REQでEAP-AKA'へ誘導する。
+		{name: "EAP-AKA permanent identity", request: akaIdentityRequestAny, maxRounds: 3, identityPrefix: "0", want: atPermanentIdReq},
+		{name: "EAP-AKA pseudonym", request: akaIdentityRequestAny, maxRounds: 3, identityPrefix: "2", want: atAnyIdReq},
+		{name: "invalid request setting", request: "off", maxRounds: 3, identityPrefix: "2", wantErr: true},
+		{name: "no round allowed", request: akaIdentityRequestAny, maxRounds: 0, identityPrefix: "2", wantExhausted: true},
+	}
+	savedRequest, savedMaxRounds := akaIdentityRequest, akaIdentityMaxRounds
+	t.Cleanup(func() { akaIdentityRequest, akaIdentityMaxRounds = savedRequest, savedMaxRounds })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			akaIdentityRequest, akaIdentityMaxRounds = tt.request, tt.maxRounds
+			got, err := akaIdentityNextRequest(tt.identityPrefix, tt.lastReq, tt.rounds)
+			if (err != nil) != (tt.wantErr || tt.wantExhausted) || errors.Is(err, errAkaIdentityRoundsExhausted) != tt.wantExhausted {
+				t.Fatalf("akaIdentityNextRequest error = %v, want exhausted %v / error %v", err, tt.wantExhausted, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("akaIdentityNextRequest = %v, want %v", akaIdentityAttrName(got), akaIdentityAttrName(tt.want))
+			}
+		})
+	}
+}
+
+func TestEapAkaIdentityRequest(t *testing.T) {
+	eap := eapAkaIdentityRequest(9, atFullauthIdReq)
+	// Lengthフィールドがパケット長と一致し、Subtype 5(AKA-Identity)にAttributeが1つだけ載る。
+	if int(eap[2])<<8|int(eap[3]) != len(eap) || eap[1] != 9 || eap[4] != 50 || eap[5] != 5 || eap[8] != atFullauthIdReq || int(eap[9])*4 != len(eap)-8 {
+		t.Errorf("eapAkaIdentityRequest = % X", eap)
+	}
+}
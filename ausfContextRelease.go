@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する（ausfContextReleaseRetryIntervalの単位は秒）
+// ausfContextReleaseEnabledがtrueなら、認証を中断したセッションのAUSFの認証コンテキストをDELETEで解放する。
+// 解放に失敗した場合はausfContextReleaseRetries回まで、ausfContextReleaseRetryIntervalから倍々に間隔を空けて再送する。
+var ausfContextReleaseEnabled bool
+var ausfContextReleaseRetries int
+var ausfContextReleaseRetryInterval time.Duration
+
+// 認証コンテキストの解放状況。GET /stats/eap-sessions で確認できる。
+// releasedは解放できた(または既にAUSF側で削除済みだった)数、releaseFailedは再送しても解放できなかった数。
+type authContextReleaseCounters struct {
+	released      atomic.Uint64
+	releaseFailed atomic.Uint64
+}
+
+var authContextReleaseStats authContextReleaseCounters
+
+// AUSFから返るlink("[API root]/nausf-auth/v1/ue-authentications/{authCtxId}/eap-session")からauthCtxIdを取り出すための書式。
+var authCtxIdPattern = regexp.MustCompile(`/ue-authentications/([^/?#]+)`)
+
+// linkからauthCtxIdを取り出す。見つからなければ空文字列を返す。
+func authCtxIdOf(link string) string {
+	if matched := authCtxIdPattern.FindStringSubmatch(link); matched != nil {
+		return matched[1]
+	}
+	return ""
+}
+
+// 認証を中断したセッション(TTL切れ、ローカル要因でのAccess-Reject・破棄等)の認証コンテキストを、
+// TS 29.509のDELETE(EAPセッションのリソース "ue-authentications/{authCtxId}/eap-session")で解放する。
+// 送信先は引数link(n12LinkResolveで書き換え済みのもの)で、ハンドラの応答を遅らせないようgoroutineで呼び出すことを想定している。
+// 204/200なら解放、404なら既にAUSF側で削除済みとして扱う。送信失敗と5xx/429は再送し、それ以外の4xxは再送しない。
+func authContextRelease(link string, reason string) {
+	if !ausfContextReleaseEnabled {
+		return
+	}
+	authCtxId := authCtxIdOf(link)
+	interval := ausfContextReleaseRetryInterval
+	for attempt := 0; attempt <= ausfContextReleaseRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(interval)
+			interval *= 2
+		}
+		stCode, deleteErr := authContextDelete(link)
+		switch {
+		case deleteErr != nil:
+			log.Printf("[authContextRelease] authCtxId: %v / attempt %v failed / %v\n", authCtxId, attempt+1, deleteErr)
+			continue
+		case stCode == http.StatusNoContent || stCode == http.StatusOK || stCode == http.StatusNotFound:
+			authContextReleaseStats.released.Add(1)
+			log.Printf("[authContextRelease] authCtxId: %v / released (status %v, reason: %v)\n", authCtxId, stCode, reason)
+			return
+		case stCode >= 500 || stCode == http.StatusTooManyRequests:
+			log.Printf("[authContextRelease] authCtxId: %v / attempt %v failed / status %v\n", authCtxId, attempt+1, stCode)
+			continue
+		}
+		authContextReleaseStats.releaseFailed.Add(1)
+		log.Printf("[authContextRelease] authCtxId: %v / release rejected by AUSF (status %v, reason: %v)\n", authCtxId, stCode, reason)
+		return
+	}
+	authContextReleaseStats.releaseFailed.Add(1)
+	log.Printf("[authContextRelease] authCtxId: %v / release failed after %v attempts (reason: %v) : %v\n", authCtxId, ausfContextReleaseRetries+1, reason, link)
+}
+
+// 引数linkへDELETEを1回送信し、ステータスコードを返す。
+func authContextDelete(link string) (int, error) {
+	ctx, cancel := sbiRequestContext()
+	defer cancel()
+	deleteReq, reqErr := http.NewRequestWithContext(ctx, http.MethodDelete, link, nil)
+	if reqErr != nil {
+		return 0, reqErr
+	}
+	deleteReq.Header.Add("accept", "application/problem+json")
+	res, sendErr := n12RequestSend(sbiClient, deleteReq)
+	if sendErr != nil {
+		return 0, sendErr
+	}
+	defer res.Body.Close()
+	sbiResponseCount(res)
+	io.Copy(io.Discard, res.Body)
+	return res.StatusCode, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthContextRelease(t *testing.T) {
+	tests := []struct {
+		name         string
+		enabled      bool
+		statuses     []int
+		wantAttempts int
+		wantReleased bool
+	}{
+		{name: "no content", enabled: true, statuses: []int{204}, wantAttempts: 1, wantReleased: true},
+		{name: "ok", enabled: true, statuses: []int{200}, wantAttempts: 1, wantReleased: true},
+		// AUSF側で削除済みなら、解放できたものとして扱う。
+		{name: "not found", enabled: true, statuses: []int{404}, wantAttempts: 1, wantReleased: true},
+		{name: "retry on 5xx", enabled: true, statuses: []int{503, 204}, wantAttempts: 2, wantReleased: true},
+		{name: "retry on 429", enabled: true, statuses: []int{429, 500, 204}, wantAttempts: 3, wantReleased: true},
+		{name: "no retry on 4xx", enabled: true, statuses: []int{400}, wantAttempts: 1},
+		{name: "retries exhausted", enabled: true, statuses: []int{500, 500, 500, 204}, wantAttempts: 3},
+		{name: "disabled", statuses: []int{204}},
+	}
+	savedEnabled, savedRetries, savedInterval := ausfContextReleaseEnabled, ausfContextReleaseRetries, ausfContextReleaseRetryInterval
+	t.Cleanup(func() {
+		ausfContextReleaseEnabled, ausfContextReleaseRetries, ausfContextReleaseRetryInterval = savedEnabled, savedRetries, savedInterval
+	})
+	ausfContextReleaseRetries = 2
+	ausfContextReleaseRetryInterval = time.Millisecond
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				attempt := int(attempts.Add(1))
+				if req.Method != http.MethodDelete || req.URL.Path != "/nausf-auth/v1/ue-authentications/ctx-1/eap-session" {
+					t.Errorf("%v %v", req.Method, req.URL.Path)
+				}
+				w.WriteHeader(tt.statuses[min(attempt, len(tt.statuses))-1])
+			}))
+			defer server.Close()
+			sbiClientSetupForTest(t, server)
+			ausfContextReleaseEnabled = tt.enabled
+			releasedBefore, failedBefore := authContextReleaseStats.released.Load(), authContextReleaseStats.releaseFailed.Load()
+
+			authContextRelease(server.URL+"/nausf-auth/v1/ue-authentications/ctx-1/eap-session", "test")
+			if got := int(attempts.Load()); got != tt.wantAttempts {
+				t.Errorf("attempts = %v, want %v", got, tt.wantAttempts)
+			}
+			released := authContextReleaseStats.released.Load() - releasedBefore
+			failed := authContextReleaseStats.releaseFailed.Load() - failedBefore
+			switch {
+			case !tt.enabled && (released != 0 || failed != 0):
+				t.Errorf("released/failed = %v/%v while disabled", released, failed)
+			case tt.enabled && tt.wantReleased && (released != 1 || failed != 0):
+				t.Errorf("released/failed = %v/%v, want 1/0", released, failed)
+			case tt.enabled && !tt.wantReleased && (released != 0 || failed != 1):
+				t.Errorf("released/failed = %v/%v, want 0/1", released, failed)
+			}
+		})
+	}
+}
+
+func TestAuthCtxIdOf(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		{link: "https://ausf.example.net/nausf-auth/v1/ue-authentications/ctx-1/eap-session", want: "ctx-1"},
+		{link: "http://192.0.2.1:8080/nausf-auth/v1/ue-authentications/ctx-2", want: "ctx-2"},
+		{link: "http://192.0.2.1:8080/nausf-auth/v1/ue-authentications/ctx-3?x=1", want: "ctx-3"},
+		{link: "http://192.0.2.1:8080/other"},
+	}
+	for _, tt := range tests {
+		if got := authCtxIdOf(tt.link); got != tt.want {
+			t.Errorf("authCtxIdOf(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AUSFインスタンス1台分の状態。同じアドレスが複数のプール(ルート)に含まれていても、ヘルスチェック結果は共有する。
+// schemeは"http"または"https"で、同じアドレスは最初に登録した時のschemeを使う。
+type ausfEndpoint struct {
+	scheme  string
+	address string
+	healthy atomic.Bool
+}
+
+// N12のAPI root("[scheme]://[ホスト]:[ポート番号]")を返す。
+func (e *ausfEndpoint) apiRoot() string {
+	return e.scheme + "://" + e.address
+}
+
+// 設定ファイルに記載された、またはNRFで発見した全AUSFインスタンス。キーはアドレス("[ホスト]:[ポート番号]")。
+// NRFでの発見により実行中にも追加されるため、muで排他する。
+var ausfEndpoints = struct {
+	mu    sync.Mutex
+	table map[string]*ausfEndpoint
+}{table: map[string]*ausfEndpoint{}}
+
+// アドレスに対応するAUSFインスタンスを返す。未登録なら正常状態として登録する。
+func ausfEndpointGet(scheme, address string) *ausfEndpoint {
+	ausfEndpoints.mu.Lock()
+	defer ausfEndpoints.mu.Unlock()
+	endpoint, ok := ausfEndpoints.table[address]
+	if ok && endpoint.scheme != scheme {
+		log.Printf("[AUSF pool] %v is already registered with scheme %v, %v is ignored\n", address, endpoint.scheme, scheme)
+	}
+	if !ok {
+		endpoint = &ausfEndpoint{scheme: scheme, address: address}
+		endpoint.healthy.Store(true)
+		ausfEndpoints.table[address] = endpoint
+	}
+	return endpoint
+}
+
+// 登録済みの全AUSFインスタンスを返す（ヘルスチェック等で走査するためのスナップショット）。
+func ausfEndpointList() []*ausfEndpoint {
+	ausfEndpoints.mu.Lock()
+	defer ausfEndpoints.mu.Unlock()
+	var list []*ausfEndpoint
+	for _, endpoint := range ausfEndpoints.table {
+		list = append(list, endpoint)
+	}
+	return list
+}
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する（単位は秒）
+var ausfHealthCheckInterval time.Duration
+
+// AUSFプールのメンバー。weightは重み付きラウンドロビンの重みで、currentWeightはausfPool.muで保護する選択用の内部値。
+type ausfPoolMember struct {
+	endpoint      *ausfEndpoint
+	weight        int
+	currentWeight int
+}
+
+// ルートごとのAUSFプール。新規認証(authReqFirst)の送信先を、正常なメンバーから重み付きラウンドロビンで選択する。
+type ausfPool struct {
+	mu      sync.Mutex
+	members []*ausfPoolMember
+}
+
+// ログ出力用。"アドレス(重み)"を並べて表記する。nil(NRFでの発見)なら"NRF discovery"とする。
+func (p *ausfPool) String() string {
+	if p == nil {
+		return "NRF discovery"
+	}
+	var members []string
+	for _, m := range p.members {
+		members = append(members, fmt.Sprintf("%v(%v)", m.endpoint.apiRoot(), m.weight))
+	}
+	return "[" + strings.Join(members, " ") + "]"
+}
+
+// 設定ファイルのausfPool(またはausfAddress単体)からAUSFプールを生成する。アドレスはausfEndpointsに登録する。
+// 引数schemeは、メンバーごとのschemeを省略した場合に使うscheme。
+func newAusfPool(confs []ausfPoolMemberConfig, scheme string) (*ausfPool, error) {
+	pool := &ausfPool{}
+	for i, c := range confs {
+		if addrErr := ausfAddressValidate(c.Address); addrErr != nil {
+			return nil, fmt.Errorf("ausfPool[%v]: %w", i, addrErr)
+		}
+		if schemeErr := sbiSchemeValidate(c.Scheme); schemeErr != nil {
+			return nil, fmt.Errorf("ausfPool[%v]: %w", i, schemeErr)
+		}
+		if c.Weight < 0 {
+			return nil, fmt.Errorf("ausfPool[%v]: invalid weight %v", i, c.Weight)
+		}
+		weight := c.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		pool.members = append(pool.members, &ausfPoolMember{endpoint: ausfEndpointGet(sbiSchemeOf(c.Scheme, scheme), c.Address), weight: weight})
+	}
+	if len(pool.members) == 0 {
+		return nil, fmt.Errorf("ausfPool: no AUSF address")
+	}
+	return pool, nil
+}
+
+// 新規認証の送信先候補を、試行する順番に並べて返す。
+// 先頭は正常なメンバーから重み付きラウンドロビン(smooth weighted round-robin)で選んだもので、以降は残りの正常なメンバー、最後に異常なメンバーを並べる。
+// 送信に失敗したら次の候補へフェイルオーバーする。全メンバーが異常の場合でも、復旧している可能性があるので全て試行する。
+func (p *ausfPool) candidates() []*ausfEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var selected *ausfPoolMember
+	total := 0
+	for _, m := range p.members {
+		if !m.endpoint.healthy.Load() {
+			continue
+		}
+		m.currentWeight += m.weight
+		total += m.weight
+		if selected == nil || m.currentWeight > selected.currentWeight {
+			selected = m
+		}
+	}
+	var healthy, unhealthy []*ausfEndpoint
+	if selected != nil {
+		selected.currentWeight -= total
+		healthy = append(healthy, selected.endpoint)
+	}
+	for _, m := range p.members {
+		switch {
+		case m == selected:
+		case m.endpoint.healthy.Load():
+			healthy = append(healthy, m.endpoint)
+		default:
+			unhealthy = append(unhealthy, m.endpoint)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// 送信結果をAUSFインスタンスの状態に反映する。状態が変わった場合のみログ出力する。
+func (e *ausfEndpoint) setHealthy(healthy bool, reason string) {
+	if e.healthy.Swap(healthy) != healthy {
+		if healthy {
+			log.Printf("[AUSF pool] %v is UP (%v)\n", e.address, reason)
+		} else {
+			log.Printf("[AUSF pool] %v is DOWN (%v)\n", e.address, reason)
+		}
+	}
+}
+
+// URLのホスト部分からAUSFインスタンスを特定し、送信失敗として記録する。設定ファイルにないアドレスなら何もしない。
+func ausfEndpointMarkFailed(host string, reason string) {
+	ausfEndpoints.mu.Lock()
+	endpoint, ok := ausfEndpoints.table[host]
+	ausfEndpoints.mu.Unlock()
+	if ok {
+		endpoint.setHealthy(false, reason)
+	}
+}
+
+// アドレスに対応するAUSFインスタンスのschemeを返す。未登録ならausfScheme。
+func ausfEndpointSchemeOf(address string) string {
+	ausfEndpoints.mu.Lock()
+	defer ausfEndpoints.mu.Unlock()
+	if endpoint, ok := ausfEndpoints.table[address]; ok {
+		return endpoint.scheme
+	}
+	return sbiSchemeOf(ausfScheme)
+}
+
+// 正常なAUSFインスタンスが1台でもあればtrueを返す（Status-ServerのAUSFチェック用）。
+// NRFでの発見のみを使う構成で、まだ1台も発見していない場合は異常とはみなさずtrueを返す。
+func ausfPoolAnyHealthy() bool {
+	endpoints := ausfEndpointList()
+	if len(endpoints) == 0 {
+		return true
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.healthy.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// 全AUSFインスタンスに対して、ausfHealthCheckIntervalごとにTCP接続でヘルスチェックを行う。main()からgoroutineで起動する。
+func ausfHealthChecker() {
+	ticker := time.NewTicker(ausfHealthCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, endpoint := range ausfEndpointList() {
+			go func(e *ausfEndpoint) {
+				conn, dialErr := net.DialTimeout("tcp", e.address, time.Second)
+				if dialErr != nil {
+					e.setHealthy(false, "health check: "+dialErr.Error())
+					return
+				}
+				conn.Close()
+				e.setHealthy(true, "health check")
+			}(endpoint)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ルーティング先のAUSFが見つからない（かつausfRouteRejectNoMatch = true）場合のエラー。ハンドラはAccess-Rejectを返す。
+var errAusfRouteNotFound = errors.New("no AUSF route matched")
+
+// IMSIプレフィックスの範囲。fromとtoは同じ桁数で、IMSIの先頭len(from)桁がfrom以上to以下なら該当とする。
+// 単一のプレフィックスはfrom == toとして扱う。
+type imsiPrefixRange struct {
+	from string
+	to   string
+}
+
+// AUSFルーティングテーブルの1エントリ。realm/plmn/imsiPrefixesのうち設定されている条件を全て満たす場合に該当する。
+// poolは送信先AUSFのプール(ausfPool.go参照)。servingNetworkNameが空なら、従来通りEAP-IdentityのRealmから生成する。
+// poolがnilのルートは、NRF(nrfClient.go参照)でmcc/mnc/routingIndicatorを条件にAUSFを発見して送信先とする。
+type ausfRoute struct {
+	name               string
+	realm              string
+	plmn               string
+	imsiPrefixes       []imsiPrefixRange
+	pool               *ausfPool
+	servingNetworkName string
+	mcc                string
+	mnc                string
+	routingIndicator   string
+}
+
+// 設定ファイルから読み出したAUSFルーティングテーブル。configure()で生成し、以後は読み出し専用で使う。
+var ausfRouteTable []ausfRoute
+
+// どのルートにも該当しない場合に使う既定ルートのAUSFプール。設定ファイルのausfPool(未設定ならausfAddress)から生成する。
+var ausfDefaultPool *ausfPool
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+var ausfRouteRejectNoMatch bool
+
+// 設定ファイルのausfRoutes(ausfRouteConfig型のスライス)からAUSFルーティングテーブルを生成する。
+func buildAusfRouteTable(conf rad5gcConfig) ([]ausfRoute, error) {
+	var table []ausfRoute
+	for i, c := range conf.ConfAusfRoutes {
+		if c.Realm == "" && c.Plmn == "" && len(c.ImsiPrefixes) == 0 {
+			return nil, fmt.Errorf("ausfRoutes[%v]: realm, plmn or imsiPrefixes is required", i)
+		}
+		if schemeErr := sbiSchemeValidate(c.Scheme); schemeErr != nil {
+			return nil, fmt.Errorf("ausfRoutes[%v]: %w", i, schemeErr)
+		}
+		pool, poolErr := ausfPoolOrDiscovery(c.AUSFaddress, c.AUSFpool, sbiSchemeOf(c.Scheme, conf.ConfAusfScheme), conf.ConfNrfApiRoot)
+		if poolErr != nil {
+			return nil, fmt.Errorf("ausfRoutes[%v]: %w", i, poolErr)
+		}
+		if c.RoutingIndicator != "" && (len(c.RoutingIndicator) > 4 || !isDigits(c.RoutingIndicator)) {
+			return nil, fmt.Errorf("ausfRoutes[%v]: invalid routingIndicator : %v", i, c.RoutingIndicator)
+		}
+		plmn, plmnErr := parsePlmn(c.Plmn)
+		if plmnErr != nil {
+			return nil, fmt.Errorf("ausfRoutes[%v]: %w", i, plmnErr)
+		}
+		var prefixes []imsiPrefixRange
+		for _, p := range c.ImsiPrefixes {
+			prefix, prefixErr := parseImsiPrefixRange(p)
+			if prefixErr != nil {
+				return nil, fmt.Errorf("ausfRoutes[%v]: %w", i, prefixErr)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		if c.ServingNetworkName != "" && !strings.HasPrefix(c.ServingNetworkName, "5G:") {
+			return nil, fmt.Errorf("ausfRoutes[%v]: servingNetworkName must start with \"5G:\"", i)
+		}
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("route%v", i)
+		}
+		table = append(table, ausfRoute{
+			name:               name,
+			realm:              strings.ToLower(strings.TrimPrefix(c.Realm, "@")),
+			plmn:               plmn,
+			imsiPrefixes:       prefixes,
+			pool:               pool,
+			servingNetworkName: c.ServingNetworkName,
+			mcc:                plmnMcc(plmn),
+			mnc:                plmnMnc(plmn),
+			routingIndicator:   c.RoutingIndicator,
+		})
+	}
+	return table, nil
+}
+
+// ausfPoolが設定されていればそれを、なければausfAddress単体(重み1)をプールの設定として返す。
+func ausfPoolConfigOf(address string, poolConfs []ausfPoolMemberConfig) []ausfPoolMemberConfig {
+	if len(poolConfs) > 0 {
+		return poolConfs
+	}
+	return []ausfPoolMemberConfig{{Address: address, Weight: 1}}
+}
+
+// ausfPool/ausfAddressが共に未設定で、NRFが設定されている場合はnil(NRFでの発見)を返す。それ以外はnewAusfPoolでプールを生成する。
+func ausfPoolOrDiscovery(address string, poolConfs []ausfPoolMemberConfig, scheme string, nrfApiRootConf string) (*ausfPool, error) {
+	if address == "" && len(poolConfs) == 0 && nrfApiRootConf != "" {
+		return nil, nil
+	}
+	return newAusfPool(ausfPoolConfigOf(address, poolConfs), scheme)
+}
+
+// AUSFアドレス("[IPアドレス]:[ポート番号]")の書式をチェックする。
+func ausfAddressValidate(addr string) error {
+	host, port, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil {
+		return errors.New("invalid AUSF address or Port number")
+	}
+	portNum, atoiErr := strconv.Atoi(port)
+	if net.ParseIP(host) == nil || atoiErr != nil || portNum > 65535 || portNum < 0 {
+		return errors.New("invalid AUSF address or Port number")
+	}
+	return nil
+}
+
+// PLMN("MCC-MNC"形式。例: "001-01")をIMSI先頭と比較するための数字列(MCC+MNC)に変換する。空文字列はそのまま返す。
+func parsePlmn(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	mcc, mnc, sepFound := strings.Cut(s, "-")
+	if !sepFound || len(mcc) != 3 || len(mnc) < 2 || len(mnc) > 3 || !isDigits(mcc+mnc) {
+		return "", errors.New("invalid plmn (MCC-MNC) : " + s)
+	}
+	return mcc + mnc, nil
+}
+
+// IMSIプレフィックス("0010100")またはプレフィックスの範囲("0010100-0010199")を変換する。
+func parseImsiPrefixRange(s string) (imsiPrefixRange, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+	if from == "" || len(from) != len(to) || len(from) > 15 || !isDigits(from+to) || from > to {
+		return imsiPrefixRange{}, errors.New("invalid imsiPrefixes : " + s)
+	}
+	return imsiPrefixRange{from: from, to: to}, nil
+}
+
+// parsePlmnで変換したPLMN(MCC+MNC)から、NRFへの問い合わせに使うMCC/MNCを取り出す。
+func plmnMcc(plmn string) string {
+	if len(plmn) < 3 {
+		return ""
+	}
+	return plmn[:3]
+}
+
+func plmnMnc(plmn string) string {
+	if len(plmn) < 3 {
+		return ""
+	}
+	return plmn[3:]
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (p imsiPrefixRange) contains(imsi string) bool {
+	if len(imsi) < len(p.from) {
+		return false
+	}
+	head := imsi[:len(p.from)]
+	return p.from <= head && head <= p.to
+}
+
+// IMSIとRealm、Routing Indicatorがこのエントリの条件を満たすかどうかを判定する。
+// routingIndicatorはSUCIの場合のみ渡され、ルートにroutingIndicatorがあれば一致を条件とする。
+func (route ausfRoute) match(imsi, realm, routingIndicator string) bool {
+	if route.realm != "" && route.realm != realm {
+		return false
+	}
+	if route.routingIndicator != "" && routingIndicator != "" && route.routingIndicator != routingIndicator {
+		return false
+	}
+	if route.plmn != "" && !strings.HasPrefix(imsi, route.plmn) {
+		return false
+	}
+	if len(route.imsiPrefixes) > 0 {
+		for _, p := range route.imsiPrefixes {
+			if p.contains(imsi) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// EAP-Identityから取り出したIMSIとNetwork Name("@wlan.～.3gppnetwork.org")から、送信先AUSFとServingNetworkNameを決定する。
+// SUCIの場合、imsiはPLMN(秘匿時)またはIMSI(null-scheme)で、routingIndicatorはSUCIのRouting Indicator。
+// decorated NAI("homerealm!user@visited")の場合、Realmの照合にはhomeRealmを使う。
+// ルーティングテーブルを先頭から照合し、最初に該当したエントリを使う。
+// 該当なしの場合はausfDefaultPool(既定ルート)を使うが、ausfRouteRejectNoMatch = true ならerrAusfRouteNotFoundを返す。
+func ausfRouteSelect(id eapIdentiySet) (ausfRoute, error) {
+	imsi, networkName, routingIndicator := id.imsi, id.networkName, id.routingIndicator
+	realm := strings.ToLower(strings.TrimPrefix(networkName, "@"))
+	if id.homeRealm != "" {
+		realm = strings.ToLower(id.homeRealm)
+	}
+	selected := ausfRoute{name: "default", pool: ausfDefaultPool, routingIndicator: nrfRoutingIndicator}
+	found := false
+	for _, route := range ausfRouteTable {
+		if route.match(imsi, realm, routingIndicator) {
+			selected = route
+			found = true
+			break
+		}
+	}
+	if !found && ausfRouteRejectNoMatch {
+		log.Printf("[AUSF route] no route matched for IMSI %v / realm %v\n", imsi, realm)
+		return selected, errAusfRouteNotFound
+	}
+	if selected.servingNetworkName == "" {
+		// decorated NAIで"@"以降のRealmが3GPPのRealmでなければ、homeRealmから生成する。
+		nwName, nwNameErr := toNWNameForN12(networkName)
+		if nwNameErr != nil && id.homeRealm != "" {
+			nwName, nwNameErr = toNWNameForN12("@" + id.homeRealm)
+		}
+		if nwNameErr != nil {
+			return selected, nwNameErr
+		}
+		selected.servingNetworkName = nwName
+	}
+	if selected.pool == nil {
+		// NRFでの発見時にRouting Indicatorの条件がなければ、SUCIのRouting Indicatorで問い合わせる。
+		if selected.routingIndicator == "" {
+			selected.routingIndicator = routingIndicator
+		}
+		// NRFでの発見時にPLMNの条件がなければ、Realm("mncXXX.mccYYY.3gppnetwork.org")のPLMNで問い合わせる。
+		if selected.mcc == "" {
+			selected.mcc, selected.mnc, _ = plmnFromRealm(realm)
+		}
+		log.Printf("[AUSF route] IMSI %v / realm %v -> %v (AUSF: NRF discovery %v, ServingNetworkName: %v)\n", imsi, realm, selected.name, nrfDiscoveryKey(selected.mcc, selected.mnc, selected.routingIndicator), selected.servingNetworkName)
+		return selected, nil
+	}
+	log.Printf("[AUSF route] IMSI %v / realm %v -> %v (AUSF pool: %v, ServingNetworkName: %v)\n", imsi, realm, selected.name, selected.pool, selected.servingNetworkName)
+	return selected, nil
+}
+
+// 新規認証(authReqFirst)の送信先候補を、試行する順番に返す。
+// プールを持つルートはプールから、持たないルートはNRFの検索結果から選ぶ。
+func (route ausfRoute) ausfCandidates(supi string) ([]*ausfEndpoint, error) {
+	if route.pool != nil {
+		return route.pool.candidates(), nil
+	}
+	return nrfAusfCandidates(route.mcc, route.mnc, route.routingIndicator, supi)
+}
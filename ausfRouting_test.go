@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestAusfRouteSelect(t *testing.T) {
+	routes, buildErr := buildAusfRouteTable(rad5gcConfig{ConfAusfRoutes: []ausfRouteConfig{
+		{Name: "home-realm", Realm: "wlan.mnc001.mcc001.3gppnetwork.org", AUSFaddress: "192.0.2.21:80"},
+		{Name: "plmn-3digit", Plmn: "310-260", AUSFaddress: "192.0.2.22:80"},
+		{Name: "partner", Realm: "partner.example.net", AUSFaddress: "192.0.2.23:80", ServingNetworkName: "5G:mnc099.mcc999.3gppnetwork.org"},
+	}})
+	if buildErr != nil {
+		t.Fatal(buildErr)
+	}
+	savedTable, savedDefault, savedReject := ausfRouteTable, ausfDefaultPool, ausfRouteRejectNoMatch
+	t.Cleanup(func() {
+		ausfRouteTable, ausfDefaultPool, ausfRouteRejectNoMatch = savedTable, savedDefault, savedReject
+	})
+	ausfRouteTable = routes
+	ausfDefaultPool, _ = newAusfPool([]ausfPoolMemberConfig{{Address: "192.0.2.20:80"}}, sbiSchemeHttp)
+	ausfRouteRejectNoMatch = false
+
+	tests := []struct {
+		name       string
+		identity   string
+		wantRoute  string
+		wantNwName string
+		wantErr    bool
+	}{
+		{name: "realm", identity: "0001010123456789@wlan.mnc001.mcc001.3gppnetwork.org",
+			wantRoute: "home-realm", wantNwName: "5G:mnc001.mcc001.3gppnetwork.org"},
+		// decorated NAIは"!"より前のhomeRealmで照合し、ServingNetworkNameもhomeRealmから生成する。
+		{name: "decorated", identity: "wlan.mnc001.mcc001.3gppnetwork.org!0001010123456789@visited.example.net",
+			wantRoute: "home-realm", wantNwName: "5G:mnc001.mcc001.3gppnetwork.org"},
+		{name: "3-digit MNC PLMN", identity: "0310260123456789@wlan.mnc260.mcc310.3gppnetwork.org",
+			wantRoute: "plmn-3digit", wantNwName: "5G:mnc260.mcc310.3gppnetwork.org"},
+		{name: "non-3GPP realm with servingNetworkName", identity: "0999990123456789@partner.example.net",
+			wantRoute: "partner", wantNwName: "5G:mnc099.mcc999.3gppnetwork.org"},
+		{name: "default route", identity: "0001020123456789@wlan.mnc002.mcc001.3gppnetwork.org",
+			wantRoute: "default", wantNwName: "5G:mnc002.mcc001.3gppnetwork.org"},
+		{name: "non-3GPP realm without servingNetworkName", identity: "0001020123456789@other.example.net", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, parseErr := eapIdentityParse(tt.identity)
+			if parseErr != nil {
+				t.Fatal(parseErr)
+			}
+			route, err := ausfRouteSelect(id)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got route %v", route.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if route.name != tt.wantRoute || route.servingNetworkName != tt.wantNwName {
+				t.Errorf("route = %v (%v), want %v (%v)", route.name, route.servingNetworkName, tt.wantRoute, tt.wantNwName)
+			}
+		})
+	}
+}
@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// clusterListenは、他のRad-5GC GW(ピア)からセッションの複製を受け付けるHTTPサーバの待ち受けアドレス。空文字列なら複製は行わない。
+// clusterNodeNameはこのノードの名前で、ピア間で重複しないこと。clusterPeersは複製先のピアの待ち受けアドレス("[ホスト]:[ポート番号]")。
+// clusterSecretはピア間で共有する秘密鍵で、HMAC-SHA256による複製メッセージの認証に使う。
+// clusterTlsがtrueなら、ピア間の通信をclusterTlsCertFile/clusterTlsKeyFile/clusterTlsCaFileによるmutual TLSで暗号化する。
+// 証明書とCAはN12(sbiTls～)とは別に用意し、ピアの証明書はclusterTlsPeerNamesのいずれかの名前(SANのDNS名またはIPアドレス)を持つものだけを受け入れる。
+// clusterTlsがfalseの平文の複製は、clusterListenとclusterPeersが全てループバックアドレスの場合のみ許可する。
+var clusterListenAddr string
+var clusterNodeName string
+var clusterPeerAddrs []string
+var clusterSecret string
+var clusterTls bool
+var clusterTlsCertFile string
+var clusterTlsKeyFile string
+var clusterTlsCaFile string
+var clusterTlsPeerNames []string
+
+// 複製メッセージのパスと、認証用のヘッダ。
+const (
+	clusterEventsPath       = "/cluster/v1/events"
+	clusterTimestampHeader  = "X-Rad5gcgw-Timestamp"
+	clusterSignatureHeader  = "X-Rad5gcgw-Signature"
+	clusterMaxClockSkew     = 30 * time.Second
+	clusterHeartbeat        = 10 * time.Second
+	clusterRetryMaxInterval = 30 * time.Second
+	clusterQueueLength      = 4096
+	clusterBatchMaxEvents   = 256
+)
+
+// 複製メッセージのbodyの上限(byte)。1メッセージのイベントはclusterBatchMaxEvents個までなので、1イベントあたり4KiBまで収まる。
+// ピアからの複製を受け付けるHTTPサーバのタイムアウト。
+const (
+	clusterMaxBodyBytes      = 1 << 20
+	clusterReadHeaderTimeout = 5 * time.Second
+	clusterReadTimeout       = 10 * time.Second
+	clusterWriteTimeout      = 10 * time.Second
+	clusterIdleTimeout       = 60 * time.Second
+)
+
+// ピアへ送る複製メッセージ(POST /cluster/v1/events のbody)。
+// seqはbootIdごとに単調増加し、受信側はそれ以下のseqのメッセージ(再送・リプレイ)を適用しない。
+// eventsは追記型ログ(sessionStore.go)と同じ形式で、snapshotがtrueならこのノードが所有する全セッションを送っている。
+// 全セッションはclusterBatchMaxEvents個ずつに分けて送り、snapshotPartは0からの通し番号、snapshotLastは最後の1通であることを示す。
+type clusterMessage struct {
+	Node         string            `json:"node"`
+	BootId       string            `json:"bootId"`
+	Seq          uint64            `json:"seq"`
+	Snapshot     bool              `json:"snapshot,omitempty"`
+	SnapshotPart int               `json:"snapshotPart,omitempty"`
+	SnapshotLast bool              `json:"snapshotLast,omitempty"`
+	Events       []sessionLogEntry `json:"events"`
+}
+
+// 複製メッセージへの応答。送信側は受信側のbootIdが変わったら、全セッションを送り直す。
+type clusterAck struct {
+	Node   string `json:"node"`
+	BootId string `json:"bootId"`
+}
+
+// 複製先のピア1台分の送信状態。
+// queueはまだ送っていないイベントで、溢れた場合や送信に失敗した場合はneedSnapshotを立てて全セッションを送り直す。
+type clusterPeer struct {
+	node         *clusterNode
+	address      string
+	queue        chan sessionLogEntry
+	needSnapshot atomic.Bool
+	seq          uint64
+
+	mu         sync.Mutex
+	connected  bool
+	lastError  string
+	peerBootId string
+
+	sentMessages  atomic.Uint64
+	sentEvents    atomic.Uint64
+	droppedEvents atomic.Uint64
+}
+
+// 受信側で、送信元ノードごとに最後に適用したbootIdとseqを保持する。
+type clusterReceiveState struct {
+	bootId string
+	seq    uint64
+}
+
+// 受信途中の全セッション(snapshot)。nextは次に受け取るsnapshotPart、keysはここまでに受け取ったセッションのキー。
+type clusterSnapshotProgress struct {
+	bootId string
+	next   int
+	keys   map[string]struct{}
+}
+
+// クラスタを構成するノード(このプロセス)1台分の状態。
+// bootIdは起動ごとの識別子で、ピアはこれが変わったことで再起動を検知し、全セッションを送り直す。
+// certStoreがnilでなければ、ピア間の通信をmutual TLS(https)で行い、ピアの証明書はpeerNamesのいずれかの名前を持つものだけを受け入れる。
+// localはピアから受信したイベントを適用するローカルの格納先で、peersへは複製しない。
+type clusterNode struct {
+	name      string
+	bootId    string
+	secret    string
+	certStore *sbiTlsCertStore
+	peerNames []string
+	local     sessionStore
+	peers     []*clusterPeer
+	client    *http.Client
+
+	receivedMu sync.Mutex
+	received   map[string]clusterReceiveState
+	snapshots  map[string]*clusterSnapshotProgress
+
+	// 受信した複製メッセージの数。GET /stats/cluster で確認できる。
+	receivedMessages atomic.Uint64
+	receivedEvents   atomic.Uint64
+	rejectedMessages atomic.Uint64
+}
+
+// このプロセスのノード。clusterListenが設定されていれば、configure()でnewClusterNodeにより生成する。
+var clusterLocalNode *clusterNode
+
+// ピアへの複製を行うsessionStore。ローカルの格納先(local)に書き込んだ上で、各ピアの送信キューにイベントを積む。
+// ピアから受信したイベントはlocalにだけ適用し、さらに他のピアへは転送しない(全ノードが互いにclusterPeersを設定する前提)。
+//
+// 各セッションは、登録した(直近のAccess-Challengeを送った)ノードが所有する(eapSession.owner)。
+// 全セッションの送信(snapshot)では所有するセッションだけを送り、受信側はsnapshotにない送信元所有のセッションを削除する。
+// TTL切れの際にAUSFの認証コンテキストを解放するのも所有するノードだけで、他のノードはローカルの格納先から削除するのみとする。
+//
+// 複製は非同期のため、同じStateのセッションを両方のノードで取り出せる時間帯(二重消費の窓)がある。
+// eapSessionLoad/eapSessionConsume(eapIdManagement.go)の処理中の印と削除はローカルの格納先に対するもので、ピアへはDELETEイベントが届くまで反映されない。
+// その間にNASの再送やフェイルオーバーで同じStateのAccess-Requestが両方のノードに届くと、両ノードがそれぞれセッションを取り出し、
+// 同じ認証コンテキストへN12のPUTを送る。AUSFが2回目のPUTを拒否すれば、そのノードはAccess-Rejectを返すため、
+// NASはどちらの応答を先に受け取るかで結果が変わりうる。窓の長さは複製の遅延(通常はピアとの往復時間程度、送信失敗時は再送間隔)である。
+type replicatedSessionStore struct {
+	local sessionStore
+	peers []*clusterPeer
+}
+
+func newReplicatedSessionStore(local sessionStore, peers []*clusterPeer) *replicatedSessionStore {
+	return &replicatedSessionStore{local: local, peers: peers}
+}
+
+func (rs *replicatedSessionStore) Store(key string, session eapSession) (bool, error) {
+	loaded, storeErr := rs.local.Store(key, session)
+	rs.publish(sessionLogEntry{Op: sessionLogOpStore, Key: key, Session: session.record()})
+	return loaded, storeErr
+}
+
+func (rs *replicatedSessionStore) Load(key string) (eapSession, bool) {
+	return rs.local.Load(key)
+}
+
+func (rs *replicatedSessionStore) Delete(key string) (bool, error) {
+	deleted, deleteErr := rs.local.Delete(key)
+	if deleted {
+		rs.publish(sessionLogEntry{Op: sessionLogOpDelete, Key: key})
+	}
+	return deleted, deleteErr
+}
+
+func (rs *replicatedSessionStore) Range(f func(key string, session eapSession) bool) {
+	rs.local.Range(f)
+}
+
+func (rs *replicatedSessionStore) Len() int {
+	return rs.local.Len()
+}
+
+func (rs *replicatedSessionStore) Close() error {
+	return rs.local.Close()
+}
+
+// 各ピアの送信キューにイベントを積む。ハンドラを待たせないよう、キューが溢れたら捨てて全セッションの送り直しに切り替える。
+func (rs *replicatedSessionStore) publish(entry sessionLogEntry) {
+	for _, peer := range rs.peers {
+		select {
+		case peer.queue <- entry:
+		default:
+			peer.droppedEvents.Add(1)
+			peer.needSnapshot.Store(true)
+		}
+	}
+}
+
+// ノードを生成する。複製先のピアはpeerAddrsから生成し、起動直後は相手の状態が分からないため、全セッションの送信から始める。
+// certStoreにnilを渡すと、ピア間の通信は平文のhttpとなる。
+func newClusterNode(name string, secret string, local sessionStore, peerAddrs []string, certStore *sbiTlsCertStore, peerNames []string) *clusterNode {
+	node := &clusterNode{
+		name:      name,
+		bootId:    clusterBootIdGenerate(),
+		secret:    secret,
+		certStore: certStore,
+		peerNames: peerNames,
+		local:     local,
+		client:    newClusterClient(certStore, peerNames),
+		received:  make(map[string]clusterReceiveState),
+		snapshots: make(map[string]*clusterSnapshotProgress),
+	}
+	for _, addr := range peerAddrs {
+		peer := &clusterPeer{node: node, address: addr, queue: make(chan sessionLogEntry, clusterQueueLength)}
+		peer.needSnapshot.Store(true)
+		node.peers = append(node.peers, peer)
+	}
+	return node
+}
+
+// 起動ごとの識別子を生成する。
+func clusterBootIdGenerate() string {
+	id := make([]byte, 8)
+	if _, randErr := rand.Read(id); randErr != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// 複製メッセージの署名。HMAC-SHA256(clusterSecret, タイムスタンプ + "\n" + body)のHex文字列。
+func (node *clusterNode) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(node.secret))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// セッションをこのノードが所有しているかどうかを判定する。所有者のないセッション(クラスタ構成前に登録したもの)はこのノードのものとする。
+func (node *clusterNode) owns(session eapSession) bool {
+	return session.owner == "" || session.owner == node.name
+}
+
+// ピアの証明書が、namesのいずれかの名前(SANのDNS名またはIPアドレス)を持つことを確認する(tls.Config.VerifyConnection用)。
+// CAによる証明書の検証は、この前にTLSハンドシェイクで済んでいる。
+func clusterPeerNameVerify(names []string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("no peer certificate")
+		}
+		leaf := state.PeerCertificates[0]
+		for _, name := range names {
+			if leaf.VerifyHostname(name) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("peer certificate %q matches none of clusterTlsPeerNames", leaf.Subject.CommonName)
+	}
+}
+
+// ピア間通信のHTTPクライアントを生成する。N12(sbiClient)とは別にする。
+// certStoreがnilでなければ、接続のたびにcertStoreからtls.Configを生成してハンドシェイクする。
+// ピアごとにアドレスが異なるため、サーバ証明書はピアのアドレスのホスト部分で検証し、さらにpeerNamesとの一致を確認する。
+func newClusterClient(certStore *sbiTlsCertStore, peerNames []string) *http.Client {
+	if certStore == nil {
+		return &http.Client{Timeout: 5 * time.Second}
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, _, splitErr := net.SplitHostPort(address)
+			if splitErr != nil {
+				return nil, splitErr
+			}
+			config, configErr := certStore.configForServerName(host)
+			if configErr != nil {
+				return nil, configErr
+			}
+			config.VerifyConnection = clusterPeerNameVerify(peerNames)
+			conn, dialErr := dialer.DialContext(ctx, network, address)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			tlsConn := tls.Client(conn, config)
+			if handshakeErr := tlsConn.HandshakeContext(ctx); handshakeErr != nil {
+				conn.Close()
+				return nil, fmt.Errorf("TLS handshake with %v failed / %w", address, handshakeErr)
+			}
+			return tlsConn, nil
+		},
+	}
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+// ピア間通信のサーバ側で、TLSハンドシェイクごとに最新の証明書とCAを使ったtls.Configを返す(tls.Config.GetConfigForClient用)。
+func (node *clusterNode) serverTlsConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	config, configErr := node.certStore.configForClusterPeer(hello)
+	if configErr != nil {
+		return nil, configErr
+	}
+	config.VerifyConnection = clusterPeerNameVerify(node.peerNames)
+	return config, nil
+}
+
+// ピア間通信のscheme。
+func (node *clusterNode) scheme() string {
+	if node.certStore != nil {
+		return sbiSchemeHttps
+	}
+	return sbiSchemeHttp
+}
+
+// 複製メッセージを1回送信し、ピアの応答を返す。
+func (peer *clusterPeer) send(message clusterMessage) (clusterAck, error) {
+	var ack clusterAck
+	body, marshalErr := json.Marshal(message)
+	if marshalErr != nil {
+		return ack, marshalErr
+	}
+	req, reqErr := http.NewRequest(http.MethodPost, peer.node.scheme()+"://"+peer.address+clusterEventsPath, bytes.NewReader(body))
+	if reqErr != nil {
+		return ack, reqErr
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set(clusterTimestampHeader, timestamp)
+	req.Header.Set(clusterSignatureHeader, peer.node.sign(timestamp, body))
+	res, sendErr := peer.node.client.Do(req)
+	if sendErr != nil {
+		return ack, sendErr
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		resBody, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return ack, fmt.Errorf("status %v / %s", res.StatusCode, bytes.TrimSpace(resBody))
+	}
+	if decodeErr := json.NewDecoder(res.Body).Decode(&ack); decodeErr != nil {
+		return ack, decodeErr
+	}
+	return ack, nil
+}
+
+// ピアとの接続状態を記録する。状態が変わったときだけログに出す。
+func (peer *clusterPeer) setConnected(connected bool, reason string) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.connected != connected {
+		if connected {
+			log.Printf("[Cluster] peer %v connected (%v)\n", peer.address, reason)
+		} else {
+			log.Printf("[Cluster] peer %v disconnected / %v\n", peer.address, reason)
+		}
+	}
+	peer.connected = connected
+	if !connected {
+		peer.lastError = reason
+	}
+}
+
+// ピアへの送信ループ。main()からピアごとにgoroutineで起動する。
+// needSnapshotが立っていれば所有する全セッションを、そうでなければキューのイベントをまとめて送る。
+// キューが空でもclusterHeartbeatごとに空のメッセージを送り、ピアの再起動(bootIdの変化)を検知する。
+// 送信に失敗したら、未送信のイベントを捨てて全セッションの送り直しに切り替え、間隔を倍々に空けて再送する。
+// 再送までの間に削除されたセッションは、送り直した全セッションに含まれないため、ピア側でも削除される。
+// ctxが終了したら戻る。
+func (peer *clusterPeer) run(ctx context.Context) {
+	heartbeat := time.NewTicker(clusterHeartbeat)
+	defer heartbeat.Stop()
+	retryInterval := time.Second
+	for ctx.Err() == nil {
+		var ack clusterAck
+		var sendErr error
+		if peer.needSnapshot.Swap(false) {
+			ack, sendErr = peer.sendSnapshot()
+		} else {
+			message := clusterMessage{Node: peer.node.name, BootId: peer.node.bootId}
+			select {
+			case entry := <-peer.queue:
+				message.Events = append(message.Events, entry)
+			case <-heartbeat.C:
+			case <-ctx.Done():
+				return
+			}
+			for queued := true; queued && len(message.Events) < clusterBatchMaxEvents; {
+				select {
+				case entry := <-peer.queue:
+					message.Events = append(message.Events, entry)
+				default:
+					queued = false
+				}
+			}
+			ack, sendErr = peer.sendMessage(message)
+		}
+		if sendErr != nil {
+			peer.setConnected(false, sendErr.Error())
+			peer.needSnapshot.Store(true)
+			select {
+			case <-time.After(retryInterval):
+			case <-ctx.Done():
+				return
+			}
+			retryInterval = min(retryInterval*2, clusterRetryMaxInterval)
+			continue
+		}
+		retryInterval = time.Second
+		peer.setConnected(true, "node "+ack.Node)
+		peer.mu.Lock()
+		restarted := peer.peerBootId != "" && ack.BootId != peer.peerBootId
+		peer.peerBootId = ack.BootId
+		peer.mu.Unlock()
+		if restarted {
+			log.Printf("[Cluster] peer %v (%v) restarted, resending all sessions\n", peer.address, ack.Node)
+			peer.needSnapshot.Store(true)
+		}
+	}
+}
+
+// seqを進めて複製メッセージを1通送り、送信数を数える。
+func (peer *clusterPeer) sendMessage(message clusterMessage) (clusterAck, error) {
+	peer.seq++
+	message.Seq = peer.seq
+	ack, sendErr := peer.send(message)
+	if sendErr != nil {
+		return ack, sendErr
+	}
+	peer.sentMessages.Add(1)
+	peer.sentEvents.Add(uint64(len(message.Events)))
+	return ack, nil
+}
+
+// 送信キューを捨ててから、このノードが所有する全セッションをclusterBatchMaxEvents個ずつに分けて送る。
+// 途中で失敗した場合は、呼び出し元が最初から送り直す。
+func (peer *clusterPeer) sendSnapshot() (clusterAck, error) {
+	peer.drain()
+	var events []sessionLogEntry
+	peer.node.local.Range(func(key string, session eapSession) bool {
+		if peer.node.owns(session) {
+			events = append(events, sessionLogEntry{Op: sessionLogOpStore, Key: key, Session: session.record()})
+		}
+		return true
+	})
+	var ack clusterAck
+	for part := 0; part == 0 || part*clusterBatchMaxEvents < len(events); part++ {
+		end := min((part+1)*clusterBatchMaxEvents, len(events))
+		message := clusterMessage{Node: peer.node.name, BootId: peer.node.bootId, Snapshot: true, SnapshotPart: part,
+			SnapshotLast: end == len(events), Events: events[part*clusterBatchMaxEvents : end]}
+		var sendErr error
+		if ack, sendErr = peer.sendMessage(message); sendErr != nil {
+			return ack, sendErr
+		}
+	}
+	log.Printf("[Cluster] snapshot of %v sessions sent to %v (%v)\n", len(events), peer.address, ack.Node)
+	return ack, nil
+}
+
+// 送信キューに溜まったイベントを捨てる。全セッションを送り直す直前に呼び出す。
+func (peer *clusterPeer) drain() {
+	for {
+		select {
+		case <-peer.queue:
+		default:
+			return
+		}
+	}
+}
+
+// 同じbootIdで既に受け取ったseq以下の複製メッセージ(再送・リプレイ)であることを示すエラー。
+var errClusterStaleMessage = errors.New("stale message")
+
+// 複製メッセージのヘッダのうち、bodyを読まずに確認できるもの(署名の書式、タイムスタンプがclusterMaxClockSkew以内であること)を検証する。
+func clusterHeaderVerify(timestamp string, signature string) error {
+	if decoded, decodeErr := hex.DecodeString(signature); decodeErr != nil || len(decoded) != sha256.Size {
+		return errors.New("signature missing or malformed")
+	}
+	unixTime, parseErr := strconv.ParseInt(timestamp, 10, 64)
+	if parseErr != nil {
+		return errors.New("invalid timestamp")
+	}
+	if skew := time.Since(time.Unix(unixTime, 0)); skew > clusterMaxClockSkew || skew < -clusterMaxClockSkew {
+		return fmt.Errorf("timestamp out of range (%v)", skew)
+	}
+	return nil
+}
+
+// 受信した複製メッセージを検証する。ヘッダ(clusterHeaderVerify)・署名・送信元ノードを確認し、
+// 同じbootIdで既に受け取ったseq以下のメッセージはerrClusterStaleMessageを返す。
+func (node *clusterNode) messageVerify(timestamp string, signature string, body []byte) (clusterMessage, error) {
+	var message clusterMessage
+	if headerErr := clusterHeaderVerify(timestamp, signature); headerErr != nil {
+		return message, headerErr
+	}
+	if !hmac.Equal([]byte(signature), []byte(node.sign(timestamp, body))) {
+		return message, errors.New("invalid signature")
+	}
+	if decodeErr := json.Unmarshal(body, &message); decodeErr != nil {
+		return message, decodeErr
+	}
+	if message.Node == "" || message.Node == node.name {
+		return message, fmt.Errorf("invalid node name %q", message.Node)
+	}
+	node.receivedMu.Lock()
+	defer node.receivedMu.Unlock()
+	last := node.received[message.Node]
+	if last.bootId == message.BootId && message.Seq <= last.seq {
+		return message, errClusterStaleMessage
+	}
+	node.received[message.Node] = clusterReceiveState{bootId: message.BootId, seq: message.Seq}
+	return message, nil
+}
+
+// POST /cluster/v1/events
+// ピアから受信したセッションのイベントを、ローカルの格納先にだけ適用する(他のピアへは転送しない)。
+// 署名ヘッダのないメッセージや、clusterMaxBodyBytesを超えるメッセージは、bodyを読む前に拒否する。
+func (node *clusterNode) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	timestamp, signature := r.Header.Get(clusterTimestampHeader), r.Header.Get(clusterSignatureHeader)
+	if headerErr := clusterHeaderVerify(timestamp, signature); headerErr != nil {
+		node.rejectedMessages.Add(1)
+		log.Printf("[Cluster] message from %v rejected / %v\n", r.RemoteAddr, headerErr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.ContentLength > clusterMaxBodyBytes {
+		node.rejectedMessages.Add(1)
+		log.Printf("[Cluster] message from %v rejected / body too large (%v bytes)\n", r.RemoteAddr, r.ContentLength)
+		http.Error(w, "request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, readErr := io.ReadAll(http.MaxBytesReader(w, r.Body, clusterMaxBodyBytes))
+	if readErr != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(readErr, &maxBytesErr) {
+			node.rejectedMessages.Add(1)
+			log.Printf("[Cluster] message from %v rejected / body exceeds %v bytes\n", r.RemoteAddr, clusterMaxBodyBytes)
+			http.Error(w, "request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	message, verifyErr := node.messageVerify(timestamp, signature, body)
+	if verifyErr != nil && !errors.Is(verifyErr, errClusterStaleMessage) {
+		node.rejectedMessages.Add(1)
+		log.Printf("[Cluster] message from %v rejected / %v\n", r.RemoteAddr, verifyErr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if verifyErr == nil {
+		node.apply(message)
+	}
+	w.Header().Set("content-type", "application/json")
+	if encodeErr := json.NewEncoder(w).Encode(clusterAck{Node: node.name, BootId: node.bootId}); encodeErr != nil {
+		log.Printf("[Cluster] response encoding error / %v\n", encodeErr)
+	}
+}
+
+// 複製メッセージのイベントを、ローカルの格納先に適用する。登録されるセッションの所有者は送信元ノードとする。
+// 全セッション(snapshot)を最後まで受け取ったら、送信元が所有するセッションのうちsnapshotになかったものを削除する。
+func (node *clusterNode) apply(message clusterMessage) {
+	for _, entry := range message.Events {
+		switch {
+		case entry.Op == sessionLogOpStore && entry.Session != nil:
+			session := entry.Session.session()
+			session.owner = message.Node
+			if _, storeErr := node.local.Store(entry.Key, session); storeErr != nil {
+				log.Printf("[Cluster] STORE / key: %v / persisting failed / %v\n", entry.Key, storeErr)
+			}
+		case entry.Op == sessionLogOpDelete:
+			if _, deleteErr := node.local.Delete(entry.Key); deleteErr != nil {
+				log.Printf("[Cluster] DELETE / key: %v / persisting failed / %v\n", entry.Key, deleteErr)
+			}
+		}
+	}
+	node.receivedMessages.Add(1)
+	node.receivedEvents.Add(uint64(len(message.Events)))
+	if !message.Snapshot {
+		return
+	}
+	snapshotKeys, completed := node.snapshotCollect(message)
+	if !completed {
+		return
+	}
+	var staleKeys []string
+	node.local.Range(func(key string, session eapSession) bool {
+		if _, inSnapshot := snapshotKeys[key]; session.owner == message.Node && !inSnapshot {
+			staleKeys = append(staleKeys, key)
+		}
+		return true
+	})
+	for _, key := range staleKeys {
+		if _, deleteErr := node.local.Delete(key); deleteErr != nil {
+			log.Printf("[Cluster] DELETE / key: %v / persisting failed / %v\n", key, deleteErr)
+		}
+	}
+	log.Printf("[Cluster] snapshot of %v sessions received from %v (%v stale sessions removed)\n", len(snapshotKeys), message.Node, len(staleKeys))
+}
+
+// 分割して届く全セッション(snapshot)のキーを送信元ノードごとに集める。最後の1通を受け取ったら、集めたキーとtrueを返す。
+// 途中のsnapshotPartが抜けた場合や、途中で送信元が再起動した場合は、次のsnapshotPart 0まで集めない。
+func (node *clusterNode) snapshotCollect(message clusterMessage) (map[string]struct{}, bool) {
+	node.receivedMu.Lock()
+	defer node.receivedMu.Unlock()
+	progress := node.snapshots[message.Node]
+	if message.SnapshotPart == 0 {
+		progress = &clusterSnapshotProgress{bootId: message.BootId, keys: make(map[string]struct{})}
+		node.snapshots[message.Node] = progress
+	}
+	if progress == nil || progress.bootId != message.BootId || progress.next != message.SnapshotPart {
+		delete(node.snapshots, message.Node)
+		log.Printf("[Cluster] snapshot part %v from %v out of order, ignored until next snapshot\n", message.SnapshotPart, message.Node)
+		return nil, false
+	}
+	for _, entry := range message.Events {
+		if entry.Op == sessionLogOpStore && entry.Session != nil {
+			progress.keys[entry.Key] = struct{}{}
+		}
+	}
+	progress.next++
+	if !message.SnapshotLast {
+		return nil, false
+	}
+	delete(node.snapshots, message.Node)
+	return progress.keys, true
+}
+
+// clusterListenを設定した場合の、クラスタ関連の設定をチェックする。
+func clusterConfigValidate(conf rad5gcConfig) error {
+	if _, _, listenErr := net.SplitHostPort(conf.ConfClusterListen); listenErr != nil {
+		return errors.New("invalid cluster listen address : " + conf.ConfClusterListen)
+	}
+	if conf.ConfClusterNodeName == "" {
+		return errors.New("clusterListen requires clusterNodeName")
+	}
+	if len(conf.ConfClusterSecret) < 16 {
+		return errors.New("clusterSecret must be at least 16 characters")
+	}
+	for _, peer := range conf.ConfClusterPeers {
+		if _, _, peerErr := net.SplitHostPort(peer); peerErr != nil {
+			return errors.New("invalid cluster peer address : " + peer)
+		}
+	}
+	if !conf.ConfClusterTls {
+		// 平文の複製は、1台のホストで複数のプロセスを動かす場合のように、ループバックアドレスのノード間でのみ許可する。
+		for _, addr := range append([]string{conf.ConfClusterListen}, conf.ConfClusterPeers...) {
+			if host, _, _ := net.SplitHostPort(addr); !isLoopbackHost(host) {
+				return errors.New("clusterTls is required unless clusterListen and clusterPeers are loopback addresses : " + addr)
+			}
+		}
+		return nil
+	}
+	if conf.ConfClusterTlsCertFile == "" || conf.ConfClusterTlsKeyFile == "" || conf.ConfClusterTlsCaFile == "" {
+		return errors.New("clusterTls requires clusterTlsCertFile, clusterTlsKeyFile and clusterTlsCaFile")
+	}
+	if _, keyPairErr := tls.LoadX509KeyPair(conf.ConfClusterTlsCertFile, conf.ConfClusterTlsKeyFile); keyPairErr != nil {
+		return fmt.Errorf("invalid cluster TLS certificate or key / %w", keyPairErr)
+	}
+	if _, caStatErr := os.Stat(conf.ConfClusterTlsCaFile); caStatErr != nil {
+		return fmt.Errorf("invalid cluster TLS CA file / %w", caStatErr)
+	}
+	if len(conf.ConfClusterTlsPeerNames) == 0 {
+		return errors.New("clusterTls requires clusterTlsPeerNames")
+	}
+	return nil
+}
+
+// ピアからの複製を受け付けるHTTPハンドラ。
+func (node *clusterNode) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(clusterEventsPath, node.eventsHandler)
+	return mux
+}
+
+// ピアから複製を受け付けるHTTPサーバを起動する。clusterTlsがtrueならhttps(mutual TLS)で待ち受ける。
+func clusterServerStart() error {
+	node := clusterLocalNode
+	log.Printf("[Cluster] cluster server start on %v (node: %v, peers: %v, scheme: %v)\n", clusterListenAddr, node.name, clusterPeerAddrs, node.scheme())
+	server := &http.Server{
+		Addr:              clusterListenAddr,
+		Handler:           node.handler(),
+		ReadHeaderTimeout: clusterReadHeaderTimeout,
+		ReadTimeout:       clusterReadTimeout,
+		WriteTimeout:      clusterWriteTimeout,
+		IdleTimeout:       clusterIdleTimeout,
+	}
+	if node.certStore == nil {
+		log.Println("[Cluster] clusterTls is disabled, replication messages are sent in plaintext over loopback")
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = &tls.Config{GetConfigForClient: node.serverTlsConfig}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,781 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const clusterSecretForTest = "cluster-secret-for-test"
+
+// クラスタのピア間通信(mutual TLS)用に、CAと、そのCAで署名した127.0.0.1の証明書(サーバ・クライアント兼用)を生成し、
+// sbiTlsCertStoreとして読み込む。
+func clusterCertStoreForTest(t *testing.T) *sbiTlsCertStore {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rad5gcgw test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "rad5gcgw test node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	nodeDer, err := x509.CreateCertificate(rand.Reader, nodeTemplate, caCert, &nodeKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeKeyDer, err := x509.MarshalECPrivateKey(nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &sbiTlsCertStore{
+		certFile: filepath.Join(dir, "node.crt"),
+		keyFile:  filepath.Join(dir, "node.key"),
+		caFile:   filepath.Join(dir, "ca.crt"),
+	}
+	for file, block := range map[string]*pem.Block{
+		cs.certFile: {Type: "CERTIFICATE", Bytes: nodeDer},
+		cs.keyFile:  {Type: "EC PRIVATE KEY", Bytes: nodeKeyDer},
+		cs.caFile:   {Type: "CERTIFICATE", Bytes: caDer},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cs.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
+
+// 署名済みの複製メッセージ(タイムスタンプ、署名、body)を生成する。
+func clusterSignedForTest(t *testing.T, sender *clusterNode, message clusterMessage, at time.Time) (string, string, []byte) {
+	t.Helper()
+	body, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return timestamp, sender.sign(timestamp, body), body
+}
+
+// condが成り立つまで待つ。
+func clusterWaitForTest(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterMessageVerify(t *testing.T) {
+	receiver := newClusterNode("gw-b", clusterSecretForTest, newMemorySessionStore(), nil, nil, nil)
+	sender := newClusterNode("gw-a", clusterSecretForTest, newMemorySessionStore(), nil, nil, nil)
+	intruder := newClusterNode("gw-a", "another-cluster-secret", newMemorySessionStore(), nil, nil, nil)
+	now := time.Now()
+	// 受信側はbootIdごとにseqを記録するため、順に検証する。
+	steps := []struct {
+		name      string
+		sender    *clusterNode
+		message   clusterMessage
+		at        time.Time
+		tamper    bool
+		wantErr   bool
+		wantStale bool
+	}{
+		{name: "first message", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-1", Seq: 1}, at: now},
+		{name: "replayed seq", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-1", Seq: 1}, at: now, wantErr: true, wantStale: true},
+		{name: "next seq", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-1", Seq: 2}, at: now},
+		{name: "older seq", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-1", Seq: 1}, at: now, wantErr: true, wantStale: true},
+		// 送信元が再起動するとbootIdが変わり、seqは1からやり直す。
+		{name: "sender restarted", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-2", Seq: 1}, at: now},
+		{name: "replayed seq after restart", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-2", Seq: 1}, at: now, wantErr: true, wantStale: true},
+		{name: "other node", sender: sender, message: clusterMessage{Node: "gw-c", BootId: "boot-1", Seq: 1}, at: now},
+		{name: "tampered body", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-2", Seq: 3}, at: now, tamper: true, wantErr: true},
+		{name: "wrong secret", sender: intruder, message: clusterMessage{Node: "gw-a", BootId: "boot-2", Seq: 4}, at: now, wantErr: true},
+		{name: "old timestamp", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-2", Seq: 5}, at: now.Add(-2 * clusterMaxClockSkew), wantErr: true},
+		{name: "future timestamp", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-2", Seq: 6}, at: now.Add(2 * clusterMaxClockSkew), wantErr: true},
+		{name: "own node name", sender: sender, message: clusterMessage{Node: "gw-b", BootId: "boot-1", Seq: 1}, at: now, wantErr: true},
+		{name: "empty node name", sender: sender, message: clusterMessage{BootId: "boot-1", Seq: 1}, at: now, wantErr: true},
+		// 拒否したメッセージのseqは記録しない。
+		{name: "seq after rejected messages", sender: sender, message: clusterMessage{Node: "gw-a", BootId: "boot-2", Seq: 3}, at: now},
+	}
+	for _, step := range steps {
+		timestamp, signature, body := clusterSignedForTest(t, step.sender, step.message, step.at)
+		if step.tamper {
+			body = bytes.Replace(body, []byte(`"seq":3`), []byte(`"seq":30`), 1)
+		}
+		message, err := receiver.messageVerify(timestamp, signature, body)
+		switch {
+		case !step.wantErr && err != nil:
+			t.Errorf("%v: unexpected error %v", step.name, err)
+		case step.wantErr && err == nil:
+			t.Errorf("%v: expected error, got %+v", step.name, message)
+		case step.wantErr && errors.Is(err, errClusterStaleMessage) != step.wantStale:
+			t.Errorf("%v: error = %v, stale = %v", step.name, err, step.wantStale)
+		}
+	}
+}
+
+func TestClusterApplyEvents(t *testing.T) {
+	node := newClusterNode("gw-b", clusterSecretForTest, newMemorySessionStore(), nil, nil, nil)
+	node.local.Store("state-old", eapSession{eapId: 1, uri: "https://ausf.example/old", owner: "gw-a"})
+	node.local.Store("state-deleted", eapSession{eapId: 2, uri: "https://ausf.example/deleted", owner: "gw-a"})
+	lastActivity := time.Now().Truncate(time.Second)
+	node.apply(clusterMessage{Node: "gw-a", BootId: "boot-1", Seq: 1, Events: []sessionLogEntry{
+		{Op: sessionLogOpStore, Key: "state-old", Session: eapSession{eapId: 3, uri: "https://ausf.example/updated", lastActivity: lastActivity}.record()},
+		// 登録されるセッションの所有者は、レコードの内容によらず送信元ノードとする。
+		{Op: sessionLogOpStore, Key: "state-new", Session: eapSession{eapId: 4, uri: "https://ausf.example/new", nasAddress: "192.0.2.1", callingStationId: "02-00-00-00-00-01", owner: "gw-c"}.record()},
+		{Op: sessionLogOpDelete, Key: "state-deleted"},
+		// sessionのないstoreは適用しない。
+		{Op: sessionLogOpStore, Key: "state-empty"},
+	}})
+	if got, ok := node.local.Load("state-old"); !ok || got.eapId != 3 || got.uri != "https://ausf.example/updated" || !got.lastActivity.Equal(lastActivity) || got.owner != "gw-a" {
+		t.Errorf("state-old = %+v (%v), want updated session", got, ok)
+	}
+	if got, ok := node.local.Load("state-new"); !ok || got.eapId != 4 || got.nasAddress != "192.0.2.1" || got.callingStationId != "02-00-00-00-00-01" || got.owner != "gw-a" {
+		t.Errorf("state-new = %+v (%v), want new session owned by gw-a", got, ok)
+	}
+	if _, ok := node.local.Load("state-deleted"); ok {
+		t.Error("state-deleted still exists")
+	}
+	if _, ok := node.local.Load("state-empty"); ok {
+		t.Error("state-empty stored without session")
+	}
+	if node.local.Len() != 2 || node.receivedMessages.Load() != 1 || node.receivedEvents.Load() != 4 {
+		t.Errorf("len = %v, received messages = %v, events = %v, want 2, 1, 4", node.local.Len(), node.receivedMessages.Load(), node.receivedEvents.Load())
+	}
+}
+
+// snapshotは送信元が所有するセッションについて正となり、最後の1通を受け取った時点で、snapshotになかったものを削除する。
+func TestClusterApplySnapshot(t *testing.T) {
+	snapshotEvent := func(key string) sessionLogEntry {
+		return sessionLogEntry{Op: sessionLogOpStore, Key: key, Session: eapSession{eapId: 1, uri: "https://ausf.example/" + key}.record()}
+	}
+	tests := []struct {
+		name        string
+		parts       []clusterMessage
+		wantRemains map[string]bool
+	}{
+		{name: "complete snapshot", parts: []clusterMessage{
+			{BootId: "boot-1", Snapshot: true, SnapshotPart: 0, Events: []sessionLogEntry{snapshotEvent("state-a1")}},
+			{BootId: "boot-1", Snapshot: true, SnapshotPart: 1, SnapshotLast: true, Events: []sessionLogEntry{snapshotEvent("state-a2")}},
+		}, wantRemains: map[string]bool{"state-a1": true, "state-a2": true, "state-a-stale": false, "state-c": true, "state-local": true}},
+		{name: "empty snapshot", parts: []clusterMessage{
+			{BootId: "boot-1", Snapshot: true, SnapshotLast: true},
+		}, wantRemains: map[string]bool{"state-a-stale": false, "state-c": true, "state-local": true}},
+		{name: "last part not received", parts: []clusterMessage{
+			{BootId: "boot-1", Snapshot: true, SnapshotPart: 0, Events: []sessionLogEntry{snapshotEvent("state-a1")}},
+		}, wantRemains: map[string]bool{"state-a1": true, "state-a-stale": true}},
+		{name: "part missing", parts: []clusterMessage{
+			{BootId: "boot-1", Snapshot: true, SnapshotPart: 0, Events: []sessionLogEntry{snapshotEvent("state-a1")}},
+			{BootId: "boot-1", Snapshot: true, SnapshotPart: 2, SnapshotLast: true, Events: []sessionLogEntry{snapshotEvent("state-a2")}},
+		}, wantRemains: map[string]bool{"state-a1": true, "state-a2": true, "state-a-stale": true}},
+		{name: "sender restarted during snapshot", parts: []clusterMessage{
+			{BootId: "boot-1", Snapshot: true, SnapshotPart: 0, Events: []sessionLogEntry{snapshotEvent("state-a1")}},
+			{BootId: "boot-2", Snapshot: true, SnapshotPart: 1, SnapshotLast: true, Events: []sessionLogEntry{snapshotEvent("state-a2")}},
+		}, wantRemains: map[string]bool{"state-a1": true, "state-a2": true, "state-a-stale": true}},
+		// 最初から送り直したsnapshotは、前回の途中までの分を引き継がない。
+		{name: "snapshot resent from first part", parts: []clusterMessage{
+			{BootId: "boot-1", Snapshot: true, SnapshotPart: 0, Events: []sessionLogEntry{snapshotEvent("state-a1")}},
+			{BootId: "boot-1", Snapshot: true, SnapshotPart: 0, SnapshotLast: true, Events: []sessionLogEntry{snapshotEvent("state-a2")}},
+		}, wantRemains: map[string]bool{"state-a1": false, "state-a2": true, "state-a-stale": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newClusterNode("gw-b", clusterSecretForTest, newMemorySessionStore(), nil, nil, nil)
+			node.local.Store("state-a-stale", eapSession{eapId: 1, owner: "gw-a"})
+			node.local.Store("state-c", eapSession{eapId: 1, owner: "gw-c"})
+			node.local.Store("state-local", eapSession{eapId: 1})
+			for i, part := range tt.parts {
+				part.Node = "gw-a"
+				part.Seq = uint64(i + 1)
+				node.apply(part)
+			}
+			for key, want := range tt.wantRemains {
+				if _, ok := node.local.Load(key); ok != want {
+					t.Errorf("%v remains = %v, want %v", key, ok, want)
+				}
+			}
+		})
+	}
+}
+
+// ピアへ送るsnapshotは、このノードが所有するセッションだけをclusterBatchMaxEvents個ずつに分けたものとなる。
+func TestClusterSendSnapshot(t *testing.T) {
+	receiver := newClusterNode("gw-b", clusterSecretForTest, newMemorySessionStore(), nil, nil, nil)
+	receiver.local.Store("state-a-stale", eapSession{eapId: 1, owner: "gw-a"})
+	var messages []clusterMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var message clusterMessage
+		json.Unmarshal(body, &message)
+		messages = append(messages, message)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		receiver.eventsHandler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	sender := newClusterNode("gw-a", clusterSecretForTest, newMemorySessionStore(), []string{server.Listener.Addr().String()}, nil, nil)
+	owned := clusterBatchMaxEvents
+	for i := range owned {
+		sender.local.Store(fmt.Sprintf("state-a%v", i), eapSession{eapId: 1, owner: "gw-a"})
+	}
+	// 所有者のないセッションはこのノードのものとして送り、他のノードが所有するセッションは送らない。
+	sender.local.Store("state-unowned", eapSession{eapId: 1})
+	sender.local.Store("state-c", eapSession{eapId: 1, owner: "gw-c"})
+
+	if _, err := sender.peers[0].sendSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("messages = %v, want 2", len(messages))
+	}
+	if messages[0].SnapshotLast || messages[0].SnapshotPart != 0 || !messages[1].SnapshotLast || messages[1].SnapshotPart != 1 || messages[1].Seq != 2 {
+		t.Errorf("parts = (%v, %v, seq %v), (%v, %v, seq %v)", messages[0].SnapshotPart, messages[0].SnapshotLast, messages[0].Seq,
+			messages[1].SnapshotPart, messages[1].SnapshotLast, messages[1].Seq)
+	}
+	if events := len(messages[0].Events) + len(messages[1].Events); events != owned+1 {
+		t.Errorf("events = %v, want %v", events, owned+1)
+	}
+	if _, ok := receiver.local.Load("state-c"); ok {
+		t.Error("session owned by gw-c sent")
+	}
+	if _, ok := receiver.local.Load("state-a-stale"); ok || receiver.local.Len() != owned+1 {
+		t.Errorf("stale session remains (%v) / len = %v, want %v", ok, receiver.local.Len(), owned+1)
+	}
+}
+
+func TestClusterHeaderVerify(t *testing.T) {
+	now := time.Now()
+	signature := strings.Repeat("0a", 32)
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		wantErr   bool
+	}{
+		{name: "valid", timestamp: strconv.FormatInt(now.Unix(), 10), signature: signature},
+		{name: "no signature", timestamp: strconv.FormatInt(now.Unix(), 10), wantErr: true},
+		{name: "short signature", timestamp: strconv.FormatInt(now.Unix(), 10), signature: "00", wantErr: true},
+		{name: "not hex", timestamp: strconv.FormatInt(now.Unix(), 10), signature: strings.Repeat("zz", 32), wantErr: true},
+		{name: "no timestamp", signature: signature, wantErr: true},
+		{name: "old timestamp", timestamp: strconv.FormatInt(now.Add(-2*clusterMaxClockSkew).Unix(), 10), signature: signature, wantErr: true},
+		{name: "future timestamp", timestamp: strconv.FormatInt(now.Add(2*clusterMaxClockSkew).Unix(), 10), signature: signature, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := clusterHeaderVerify(tt.timestamp, tt.signature); (err != nil) != tt.wantErr {
+				t.Errorf("clusterHeaderVerify(%q, %q) = %v, wantErr %v", tt.timestamp, tt.signature, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// bodyの読み出しを数えるio.Reader。
+type clusterCountingReaderForTest struct {
+	r    io.Reader
+	read int
+}
+
+func (cr *clusterCountingReaderForTest) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.read += n
+	return n, err
+}
+
+// 署名ヘッダのないメッセージや大きすぎるメッセージは、bodyを読まずに(または上限まで読んだところで)拒否する。
+func TestClusterEventsHandlerReject(t *testing.T) {
+	sender := newClusterNode("gw-a", clusterSecretForTest, newMemorySessionStore(), nil, nil, nil)
+	timestamp, signature, body := clusterSignedForTest(t, sender, clusterMessage{Node: "gw-a", BootId: "boot-1", Seq: 1}, time.Now())
+	large := bytes.Repeat([]byte("x"), 2*clusterMaxBodyBytes)
+	tests := []struct {
+		name          string
+		timestamp     string
+		signature     string
+		body          []byte
+		contentLength int64
+		wantStatus    int
+		wantMaxRead   int
+	}{
+		{name: "valid", timestamp: timestamp, signature: signature, body: body, contentLength: int64(len(body)), wantStatus: http.StatusOK, wantMaxRead: len(body)},
+		{name: "unsigned", timestamp: timestamp, body: large, contentLength: int64(len(large)), wantStatus: http.StatusForbidden},
+		{name: "oversized content length", timestamp: timestamp, signature: signature, body: large, contentLength: int64(len(large)), wantStatus: http.StatusRequestEntityTooLarge},
+		// Content-Lengthのない(chunked)場合は、clusterMaxBodyBytesを超えたところで読むのをやめる。
+		{name: "oversized chunked", timestamp: timestamp, signature: signature, body: large, contentLength: -1, wantStatus: http.StatusRequestEntityTooLarge, wantMaxRead: clusterMaxBodyBytes + 64*1024},
+		{name: "wrong signature", timestamp: timestamp, signature: strings.Repeat("00", 32), body: body, contentLength: int64(len(body)), wantStatus: http.StatusForbidden, wantMaxRead: len(body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newClusterNode("gw-b", clusterSecretForTest, newMemorySessionStore(), nil, nil, nil)
+			reader := &clusterCountingReaderForTest{r: bytes.NewReader(tt.body)}
+			req := httptest.NewRequest(http.MethodPost, clusterEventsPath, reader)
+			req.ContentLength = tt.contentLength
+			req.Header.Set(clusterTimestampHeader, tt.timestamp)
+			req.Header.Set(clusterSignatureHeader, tt.signature)
+			rec := httptest.NewRecorder()
+			receiver.eventsHandler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if reader.read > tt.wantMaxRead {
+				t.Errorf("read %v bytes, want at most %v", reader.read, tt.wantMaxRead)
+			}
+			if tt.wantStatus != http.StatusOK && receiver.rejectedMessages.Load() != 1 {
+				t.Errorf("rejected messages = %v, want 1", receiver.rejectedMessages.Load())
+			}
+		})
+	}
+}
+
+// ピアの証明書は、CAの検証に加えてclusterTlsPeerNamesのいずれかと一致しなければならない。
+func TestClusterPeerNameVerify(t *testing.T) {
+	cs := clusterCertStoreForTest(t)
+	if err := cs.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	leaf, parseErr := x509.ParseCertificate(cs.cert.Certificate[0])
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	tests := []struct {
+		name    string
+		names   []string
+		state   tls.ConnectionState
+		wantErr bool
+	}{
+		{name: "match", names: []string{"127.0.0.1"}, state: state},
+		{name: "match second name", names: []string{"gw-a.example.net", "127.0.0.1"}, state: state},
+		{name: "mismatch", names: []string{"gw-a.example.net", "192.0.2.1"}, state: state, wantErr: true},
+		{name: "no names", state: state, wantErr: true},
+		{name: "no peer certificate", names: []string{"127.0.0.1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := clusterPeerNameVerify(tt.names)(tt.state); (err != nil) != tt.wantErr {
+				t.Errorf("clusterPeerNameVerify(%v) = %v, wantErr %v", tt.names, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClusterConfigValidate(t *testing.T) {
+	cs := clusterCertStoreForTest(t)
+	secret := clusterSecretForTest
+	tlsConf := func(certFile, keyFile, caFile string, peerNames []string) rad5gcConfig {
+		return rad5gcConfig{ConfClusterListen: "192.0.2.1:7812", ConfClusterNodeName: "gw-a", ConfClusterSecret: secret,
+			ConfClusterPeers: []string{"192.0.2.2:7812"}, ConfClusterTls: true,
+			ConfClusterTlsCertFile: certFile, ConfClusterTlsKeyFile: keyFile, ConfClusterTlsCaFile: caFile, ConfClusterTlsPeerNames: peerNames}
+	}
+	tests := []struct {
+		name    string
+		conf    rad5gcConfig
+		wantErr bool
+	}{
+		{name: "plaintext loopback", conf: rad5gcConfig{ConfClusterListen: "127.0.0.1:7812", ConfClusterNodeName: "gw-a", ConfClusterSecret: secret,
+			ConfClusterPeers: []string{"127.0.0.1:7813", "[::1]:7814", "localhost:7815"}}},
+		{name: "plaintext listen on all addresses", conf: rad5gcConfig{ConfClusterListen: ":7812", ConfClusterNodeName: "gw-a", ConfClusterSecret: secret}, wantErr: true},
+		{name: "plaintext remote peer", conf: rad5gcConfig{ConfClusterListen: "127.0.0.1:7812", ConfClusterNodeName: "gw-a", ConfClusterSecret: secret,
+			ConfClusterPeers: []string{"192.0.2.2:7812"}}, wantErr: true},
+		{name: "TLS", conf: tlsConf(cs.certFile, cs.keyFile, cs.caFile, []string{"gw-b.example.net"})},
+		{name: "TLS without certificate", conf: tlsConf("", "", cs.caFile, []string{"gw-b.example.net"}), wantErr: true},
+		{name: "TLS without CA", conf: tlsConf(cs.certFile, cs.keyFile, "", []string{"gw-b.example.net"}), wantErr: true},
+		{name: "TLS with missing CA file", conf: tlsConf(cs.certFile, cs.keyFile, cs.caFile+".missing", []string{"gw-b.example.net"}), wantErr: true},
+		{name: "TLS with mismatched key", conf: tlsConf(cs.certFile, cs.caFile, cs.caFile, []string{"gw-b.example.net"}), wantErr: true},
+		{name: "TLS without peer names", conf: tlsConf(cs.certFile, cs.keyFile, cs.caFile, nil), wantErr: true},
+		{name: "no node name", conf: rad5gcConfig{ConfClusterListen: "127.0.0.1:7812", ConfClusterSecret: secret}, wantErr: true},
+		{name: "short secret", conf: rad5gcConfig{ConfClusterListen: "127.0.0.1:7812", ConfClusterNodeName: "gw-a", ConfClusterSecret: "short"}, wantErr: true},
+		{name: "invalid peer", conf: rad5gcConfig{ConfClusterListen: "127.0.0.1:7812", ConfClusterNodeName: "gw-a", ConfClusterSecret: secret,
+			ConfClusterPeers: []string{"127.0.0.1"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := clusterConfigValidate(tt.conf); (err != nil) != tt.wantErr {
+				t.Errorf("clusterConfigValidate = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TTL切れの際にAUSFの認証コンテキストを解放するのは、セッションを所有するノードだけとする。
+func TestEapSessionOwned(t *testing.T) {
+	savedNode := clusterLocalNode
+	t.Cleanup(func() { clusterLocalNode = savedNode })
+	clusterLocalNode = nil
+	if !eapSessionOwned(eapSession{owner: "gw-a"}) {
+		t.Error("session not owned without cluster")
+	}
+	clusterLocalNode = newClusterNode("gw-b", clusterSecretForTest, newMemorySessionStore(), nil, nil, nil)
+	for owner, want := range map[string]bool{"": true, "gw-b": true, "gw-a": false} {
+		if got := eapSessionOwned(eapSession{owner: owner}); got != want {
+			t.Errorf("eapSessionOwned(owner %q) = %v, want %v", owner, got, want)
+		}
+	}
+}
+
+// 2台のノードをhttptestのサーバ(mutual TLS)で起動し、互いに複製する。
+func TestClusterReplicationTwoNodes(t *testing.T) {
+	cs := clusterCertStoreForTest(t)
+	serverA := httptest.NewUnstartedServer(nil)
+	serverB := httptest.NewUnstartedServer(nil)
+	nodeA := newClusterNode("gw-a", clusterSecretForTest, newMemorySessionStore(), []string{serverB.Listener.Addr().String()}, cs, []string{"127.0.0.1"})
+	nodeB := newClusterNode("gw-b", clusterSecretForTest, newMemorySessionStore(), []string{serverA.Listener.Addr().String()}, cs, []string{"127.0.0.1"})
+	for _, pair := range []struct {
+		server *httptest.Server
+		node   *clusterNode
+	}{{serverA, nodeA}, {serverB, nodeB}} {
+		pair.server.Config.Handler = pair.node.handler()
+		pair.server.TLS = &tls.Config{GetConfigForClient: pair.node.serverTlsConfig}
+		pair.server.StartTLS()
+		t.Cleanup(pair.server.Close)
+	}
+	storeA := newReplicatedSessionStore(nodeA.local, nodeA.peers)
+	storeB := newReplicatedSessionStore(nodeB.local, nodeB.peers)
+
+	// 起動前から保持しているセッションは、最初の全セッションの送信(snapshot)で複製される。
+	nodeA.local.Store("state-before-start", eapSession{eapId: 1, uri: "https://ausf.example/1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	for _, peer := range append(append([]*clusterPeer{}, nodeA.peers...), nodeB.peers...) {
+		go peer.run(ctx)
+	}
+	clusterWaitForTest(t, "snapshot from gw-a", func() bool {
+		_, ok := nodeB.local.Load("state-before-start")
+		return ok
+	})
+
+	// Access-Challenge送信時の登録と、次のAccess-Requestでの取り出し(削除)が、それぞれ相手のノードに反映される。
+	storeA.Store("state-1", eapSession{eapId: 2, uri: "https://ausf.example/2", nasAddress: "192.0.2.1"})
+	clusterWaitForTest(t, "store replicated to gw-b", func() bool {
+		session, ok := nodeB.local.Load("state-1")
+		return ok && session.eapId == 2 && session.nasAddress == "192.0.2.1"
+	})
+	if deleted, _ := storeB.Delete("state-1"); !deleted {
+		t.Fatal("state-1 not found on gw-b")
+	}
+	clusterWaitForTest(t, "delete replicated to gw-a", func() bool {
+		_, ok := nodeA.local.Load("state-1")
+		return !ok
+	})
+	for _, peer := range append(append([]*clusterPeer{}, nodeA.peers...), nodeB.peers...) {
+		peer.mu.Lock()
+		connected := peer.connected
+		peer.mu.Unlock()
+		if !connected {
+			t.Errorf("peer %v of %v not connected", peer.address, peer.node.name)
+		}
+	}
+
+	// 署名の不正な複製メッセージは403で拒否し、適用しない。
+	timestamp, _, body := clusterSignedForTest(t, nodeA, clusterMessage{Node: "gw-a", BootId: nodeA.bootId, Seq: 1 << 32,
+		Events: []sessionLogEntry{{Op: sessionLogOpStore, Key: "state-forged", Session: eapSession{eapId: 9}.record()}}}, time.Now())
+	req, reqErr := http.NewRequest(http.MethodPost, serverB.URL+clusterEventsPath, bytes.NewReader(body))
+	if reqErr != nil {
+		t.Fatal(reqErr)
+	}
+	req.Header.Set(clusterTimestampHeader, timestamp)
+	req.Header.Set(clusterSignatureHeader, "00")
+	res, sendErr := nodeA.client.Do(req)
+	if sendErr != nil {
+		t.Fatal(sendErr)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("forged message status = %v, want %v", res.StatusCode, http.StatusForbidden)
+	}
+	if _, ok := nodeB.local.Load("state-forged"); ok || nodeB.rejectedMessages.Load() != 1 {
+		t.Errorf("forged message applied (%v) or not counted (%v)", ok, nodeB.rejectedMessages.Load())
+	}
+
+	// クライアント証明書のない接続は、TLSハンドシェイクで拒否する。
+	noClientCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: cs.rootCAs}}}
+	if res, err := noClientCert.Post(serverB.URL+clusterEventsPath, "application/json", bytes.NewReader(body)); err == nil {
+		res.Body.Close()
+		t.Errorf("request without client certificate accepted (status %v)", res.StatusCode)
+	}
+}
+
+// 空いているポートの"127.0.0.1:[ポート番号]"を返す。
+func clusterFreeAddrForTest(t *testing.T, network string) string {
+	t.Helper()
+	var addr string
+	switch network {
+	case "udp":
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = conn.LocalAddr().String()
+		conn.Close()
+	default:
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = ln.Addr().String()
+		ln.Close()
+	}
+	return addr
+}
+
+// ビルドしたRad-5GC GWを--configで起動したプロセス。
+type clusterProcessForTest struct {
+	cmd    *exec.Cmd
+	output bytes.Buffer
+	done   chan struct{}
+}
+
+func clusterProcessStartForTest(t *testing.T, binary string, configFile string) *clusterProcessForTest {
+	t.Helper()
+	p := &clusterProcessForTest{done: make(chan struct{})}
+	p.cmd = exec.Command(binary, "--config", configFile)
+	p.cmd.Dir = filepath.Dir(configFile)
+	p.cmd.Stdout = &p.output
+	p.cmd.Stderr = &p.output
+	if err := p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		p.cmd.Wait()
+		close(p.done)
+	}()
+	t.Cleanup(p.stop)
+	return p
+}
+
+func (p *clusterProcessForTest) stop() {
+	select {
+	case <-p.done:
+	default:
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// 管理用HTTPサーバのGETの応答(JSON)をvに読み込む。
+func clusterAdminGetForTest(adminAddr string, path string, v any) error {
+	res, err := http.Get("http://" + adminAddr + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %v", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+type clusterStatsForTest struct {
+	BootId string `json:"bootId"`
+	Peers  []struct {
+		Connected    bool   `json:"connected"`
+		PeerBootId   string `json:"peerBootId"`
+		SentMessages uint64 `json:"sentMessages"`
+	} `json:"peers"`
+	ReceivedFrom []struct {
+		Node   string `json:"node"`
+		BootId string `json:"bootId"`
+		Seq    uint64 `json:"seq"`
+	} `json:"receivedFrom"`
+	RejectedMessages uint64 `json:"rejectedMessages"`
+}
+
+// 2つのRad-5GC GWのプロセスを--configで起動し、設定ファイルの読み込みから待ち受け・複製までを確認する。
+// ノードBを再起動すると、bootIdが変わってseqが1からやり直しになり、ノードAから全セッションを受け取り直す。
+func TestClusterTwoProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the binary")
+	}
+	goCmd, lookErr := exec.LookPath("go")
+	if lookErr != nil {
+		t.Skip("go command not found")
+	}
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "rad5gcgw")
+	if out, err := exec.Command(goCmd, "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build failed / %v\n%s", err, out)
+	}
+	cs := clusterCertStoreForTest(t)
+
+	// ノードAは、自分が所有するセッションを1つ保持した状態(eapSessionStore: file)で起動する。
+	sessionFileA := filepath.Join(dir, "a", "sessions.log")
+	if err := os.MkdirAll(filepath.Dir(sessionFileA), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	storeA, _, openErr := openFileSessionStore(sessionFileA, false, time.Minute)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	storeA.Store("state-from-a", eapSession{eapId: 1, uri: "http://127.0.0.1:1/nausf-auth/v1/ue-authentications/ctx-1/eap-session", lastActivity: time.Now(), owner: "gw-a"})
+	storeA.Close()
+
+	type nodeForTest struct {
+		name, clusterAddr, adminAddr, configFile string
+	}
+	nodeA := nodeForTest{name: "gw-a", clusterAddr: clusterFreeAddrForTest(t, "tcp"), adminAddr: clusterFreeAddrForTest(t, "tcp")}
+	nodeB := nodeForTest{name: "gw-b", clusterAddr: clusterFreeAddrForTest(t, "tcp"), adminAddr: clusterFreeAddrForTest(t, "tcp")}
+	for _, pair := range []struct {
+		node         *nodeForTest
+		peer         *nodeForTest
+		sessionStore string
+	}{{&nodeA, &nodeB, "file"}, {&nodeB, &nodeA, "memory"}} {
+		nodeDir := filepath.Join(dir, pair.node.name[len("gw-"):])
+		if err := os.MkdirAll(nodeDir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		pair.node.configFile = filepath.Join(nodeDir, "confrad5gcgw.yaml")
+		config := fmt.Sprintf(`filename: %q
+sharedSecret: "rad5gcgwtest"
+allowedClientAddress: "127.0.0.1"
+radiusListen: %q
+ausfAddress: "127.0.0.1:1"
+eapSessionStore: %q
+eapSessionStoreFile: %q
+adminListen: %q
+clusterListen: %q
+clusterNodeName: %q
+clusterPeers: [%q]
+clusterSecret: %q
+clusterTls: true
+clusterTlsCertFile: %q
+clusterTlsKeyFile: %q
+clusterTlsCaFile: %q
+clusterTlsPeerNames: ["127.0.0.1"]
+`, filepath.Join(nodeDir, "mainsys.log"), clusterFreeAddrForTest(t, "udp"), pair.sessionStore, sessionFileA,
+			pair.node.adminAddr, pair.node.clusterAddr, pair.node.name, pair.peer.clusterAddr, clusterSecretForTest,
+			cs.certFile, cs.keyFile, cs.caFile)
+		if err := os.WriteFile(pair.node.configFile, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	processes := map[string]*clusterProcessForTest{}
+	t.Cleanup(func() {
+		if !t.Failed() {
+			return
+		}
+		for name, p := range processes {
+			p.stop()
+			logOutput, _ := os.ReadFile(filepath.Join(filepath.Dir(p.cmd.Args[2]), "mainsys.log"))
+			t.Logf("%v output:\n%s\n%s", name, p.output.Bytes(), logOutput)
+		}
+	})
+	processes["gw-a"] = clusterProcessStartForTest(t, binary, nodeA.configFile)
+	processes["gw-b"] = clusterProcessStartForTest(t, binary, nodeB.configFile)
+
+	// ピアの再起動はclusterHeartbeatごとの送信で検知するため、待ち時間はclusterHeartbeatより長くする。
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(3 * clusterHeartbeat)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %v", what)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	var statsA, statsB clusterStatsForTest
+	var sessionsB struct {
+		Active int `json:"active"`
+	}
+	waitFor("session replicated to gw-b", func() bool {
+		return clusterAdminGetForTest(nodeB.adminAddr, "/stats/eap-sessions", &sessionsB) == nil && sessionsB.Active == 1
+	})
+	waitFor("peers connected", func() bool {
+		statsA, statsB = clusterStatsForTest{}, clusterStatsForTest{}
+		return clusterAdminGetForTest(nodeA.adminAddr, "/stats/cluster", &statsA) == nil && clusterAdminGetForTest(nodeB.adminAddr, "/stats/cluster", &statsB) == nil &&
+			len(statsA.Peers) == 1 && statsA.Peers[0].Connected && len(statsB.Peers) == 1 && statsB.Peers[0].Connected
+	})
+	oldBootIdB := statsB.BootId
+	if oldBootIdB == "" || statsA.Peers[0].PeerBootId != oldBootIdB {
+		t.Fatalf("bootId of gw-b = %q, peerBootId on gw-a = %q", oldBootIdB, statsA.Peers[0].PeerBootId)
+	}
+
+	processes["gw-b"].stop()
+	processes["gw-b"] = clusterProcessStartForTest(t, binary, nodeB.configFile)
+	waitFor("gw-b restarted with new bootId", func() bool {
+		statsB = clusterStatsForTest{}
+		return clusterAdminGetForTest(nodeB.adminAddr, "/stats/cluster", &statsB) == nil && statsB.BootId != "" && statsB.BootId != oldBootIdB
+	})
+	waitFor("session replicated to restarted gw-b", func() bool {
+		return clusterAdminGetForTest(nodeB.adminAddr, "/stats/eap-sessions", &sessionsB) == nil && sessionsB.Active == 1
+	})
+	receivedFromB := func() (string, uint64) {
+		for _, received := range statsA.ReceivedFrom {
+			if received.Node == "gw-b" {
+				return received.BootId, received.Seq
+			}
+		}
+		return "", 0
+	}
+	waitFor("gw-a to see new bootId of gw-b", func() bool {
+		statsA = clusterStatsForTest{}
+		if clusterAdminGetForTest(nodeA.adminAddr, "/stats/cluster", &statsA) != nil || len(statsA.Peers) != 1 {
+			return false
+		}
+		bootId, _ := receivedFromB()
+		return statsA.Peers[0].Connected && statsA.Peers[0].PeerBootId == statsB.BootId && bootId == statsB.BootId
+	})
+	// gw-aが最後に受け取ったseqは、再起動後のgw-bが送ったメッセージ数を超えない(seqが1からやり直している)。
+	_, seq := receivedFromB()
+	statsB = clusterStatsForTest{}
+	if err := clusterAdminGetForTest(nodeB.adminAddr, "/stats/cluster", &statsB); err != nil {
+		t.Fatal(err)
+	}
+	if len(statsB.Peers) != 1 || seq == 0 || seq > statsB.Peers[0].SentMessages {
+		t.Errorf("seq from gw-b = %v, messages sent by restarted gw-b = %+v", seq, statsB.Peers)
+	}
+	if statsA.RejectedMessages != 0 || statsB.RejectedMessages != 0 {
+		t.Errorf("rejected messages = %v (gw-a), %v (gw-b), want 0", statsA.RejectedMessages, statsB.RejectedMessages)
+	}
+}
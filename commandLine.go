@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 設定ファイルのデフォルトのパス(--config省略時)。
+const defaultConfigFile = "confrad5gcgw.yaml"
+
+// 設定項目を上書きする環境変数の接頭辞。設定項目名をUPPER_SNAKE_CASEにして付ける(sharedSecret → RAD5GCGW_SHARED_SECRET)。
+const configEnvPrefix = "RAD5GCGW_"
+
+// コマンドライン引数。logFile/listenは空文字列なら上書きしない。
+type cmdLineOptions struct {
+	configFile  string
+	logFile     string
+	listen      string
+	checkConfig bool
+	version     bool
+}
+
+// コマンドライン引数を解析する。"-config"・"--config"のどちらの形式も受け付ける。
+// 不正な引数や"--help"の場合は、使い方をoutputに出力してエラーを返す(--helpはflag.ErrHelp)。
+func parseCmdLine(name string, args []string, output io.Writer) (cmdLineOptions, error) {
+	var opts cmdLineOptions
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&opts.configFile, "config", defaultConfigFile, "path to the configuration file")
+	flags.StringVar(&opts.logFile, "log-file", "", "log file name (overrides filename in the configuration file)")
+	flags.StringVar(&opts.listen, "listen", "", "Radius server listen address [IP address]:[port] (overrides radiusListen)")
+	flags.BoolVar(&opts.checkConfig, "check-config", false, "validate the configuration and exit")
+	flags.BoolVar(&opts.version, "version", false, "print the version and exit")
+	flags.Usage = func() {
+		fmt.Fprintf(output, "Usage: %v [options]\n", name)
+		flags.PrintDefaults()
+		fmt.Fprintf(output, "\nEvery configuration key can also be overridden by an environment variable %v<KEY> (e.g. %v).\n", configEnvPrefix, configEnvName("sharedSecret"))
+	}
+	if parseErr := flags.Parse(args); parseErr != nil {
+		return opts, parseErr
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return opts, fmt.Errorf("unexpected argument : %v", flags.Arg(0))
+	}
+	return opts, nil
+}
+
+// コマンドライン引数で指定された設定項目を上書きする。環境変数よりも優先する。
+func (opts cmdLineOptions) apply(configSet *rad5gcConfig) {
+	if opts.logFile != "" {
+		configSet.ConfFilename = opts.logFile
+	}
+	if opts.listen != "" {
+		configSet.ConfRadiusListen = opts.listen
+	}
+}
+
+// 設定項目名(yamlのキー)を環境変数名に変換する。
+// 小文字(または数字)→大文字の境目と、大文字の連続(略語)の終わりに"_"を入れる(duplicateCacheTTL → RAD5GCGW_DUPLICATE_CACHE_TTL、oauth2TokenUrl → RAD5GCGW_OAUTH2_TOKEN_URL)。
+func configEnvName(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	b.WriteString(configEnvPrefix)
+	for i, c := range runes {
+		if i > 0 && unicode.IsUpper(c) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
+
+// 環境変数RAD5GCGW_<KEY>が設定されていれば、rad5gcConfigの該当項目を上書きする。上書きした環境変数名を返す。
+// 文字列・数値・真偽値はそのまま、リスト(radiusClients・ausfPool等)はyamlのフロー形式(例: `["10.0.0.2:18121"]`)で記述する。
+// lookupはos.LookupEnvを想定している。
+func applyConfigEnv(configSet *rad5gcConfig, lookup func(string) (string, bool)) ([]string, error) {
+	var applied []string
+	v := reflect.ValueOf(configSet).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		envName := configEnvName(key)
+		value, ok := lookup(envName)
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		var setErr error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			var n int
+			n, setErr = strconv.Atoi(strings.TrimSpace(value))
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			var b bool
+			b, setErr = strconv.ParseBool(strings.TrimSpace(value))
+			field.SetBool(b)
+		default:
+			replaced := reflect.New(field.Type())
+			setErr = yaml.Unmarshal([]byte(value), replaced.Interface())
+			field.Set(replaced.Elem())
+		}
+		if setErr != nil {
+			return applied, fmt.Errorf("invalid environment variable %v / %w", envName, setErr)
+		}
+		applied = append(applied, envName)
+	}
+	return applied, nil
+}
+
+// --versionの出力。
+func printVersion() {
+	fmt.Printf("Rad-5GC GW ver.%v\n", rad5gcGWCurrentVer)
+}
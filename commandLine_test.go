@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseCmdLine(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		want       cmdLineOptions
+		wantErr    bool
+		wantHelp   bool
+		wantOutput string
+	}{
+		{name: "defaults", want: cmdLineOptions{configFile: defaultConfigFile}},
+		{name: "double dash", args: []string{"--config", "/etc/rad5gcgw/a.yaml", "--log-file", "a.log", "--listen", "127.0.0.1:11812"},
+			want: cmdLineOptions{configFile: "/etc/rad5gcgw/a.yaml", logFile: "a.log", listen: "127.0.0.1:11812"}},
+		{name: "single dash and equals", args: []string{"-config=b.yaml", "-check-config"},
+			want: cmdLineOptions{configFile: "b.yaml", checkConfig: true}},
+		{name: "version", args: []string{"--version"}, want: cmdLineOptions{configFile: defaultConfigFile, version: true}},
+		{name: "help", args: []string{"--help"}, wantErr: true, wantHelp: true, wantOutput: configEnvName("sharedSecret")},
+		{name: "unknown flag", args: []string{"--unknown"}, wantErr: true, wantOutput: "Usage:"},
+		{name: "missing value", args: []string{"--config"}, wantErr: true},
+		{name: "extra argument", args: []string{"--config", "a.yaml", "b.yaml"}, wantErr: true, wantOutput: "Usage:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			got, err := parseCmdLine("rad5gcgw", tt.args, &output)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				if errors.Is(err, flag.ErrHelp) != tt.wantHelp {
+					t.Errorf("error = %v, want help %v", err, tt.wantHelp)
+				}
+				if !strings.Contains(output.String(), tt.wantOutput) {
+					t.Errorf("output = %q, want %q", output.String(), tt.wantOutput)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseCmdLine(%v) = %+v, want %+v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigEnvName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "filename", want: "RAD5GCGW_FILENAME"},
+		{key: "sharedSecret", want: "RAD5GCGW_SHARED_SECRET"},
+		{key: "duplicateCacheTTL", want: "RAD5GCGW_DUPLICATE_CACHE_TTL"},
+		{key: "oauth2TokenUrl", want: "RAD5GCGW_OAUTH2_TOKEN_URL"},
+		{key: "eapSessionTTL", want: "RAD5GCGW_EAP_SESSION_TTL"},
+		{key: "sbiTlsCaFile", want: "RAD5GCGW_SBI_TLS_CA_FILE"},
+		{key: "ausfPool", want: "RAD5GCGW_AUSF_POOL"},
+		{key: "nrfApiRoot", want: "RAD5GCGW_NRF_API_ROOT"},
+		{key: "radsecClientCAFile", want: "RAD5GCGW_RADSEC_CLIENT_CA_FILE"},
+	}
+	for _, tt := range tests {
+		if got := configEnvName(tt.key); got != tt.want {
+			t.Errorf("configEnvName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestApplyConfigEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		want        func(conf rad5gcConfig) bool
+		wantApplied []string
+		wantErr     bool
+	}{
+		{name: "no environment", want: func(conf rad5gcConfig) bool { return conf.ConfSharedSecret == "from-file" }},
+		{name: "string", env: map[string]string{"RAD5GCGW_SHARED_SECRET": "from-env"},
+			want:        func(conf rad5gcConfig) bool { return conf.ConfSharedSecret == "from-env" },
+			wantApplied: []string{"RAD5GCGW_SHARED_SECRET"}},
+		// 空文字列の環境変数も、設定されていれば上書きする。
+		{name: "empty string", env: map[string]string{"RAD5GCGW_SHARED_SECRET": ""},
+			want:        func(conf rad5gcConfig) bool { return conf.ConfSharedSecret == "" },
+			wantApplied: []string{"RAD5GCGW_SHARED_SECRET"}},
+		{name: "int and bool", env: map[string]string{"RAD5GCGW_MAX_SIZE": " 50 ", "RAD5GCGW_ACCOUNTING_ENABLED": "true", "RAD5GCGW_DUPLICATE_CACHE_TTL": "10"},
+			want: func(conf rad5gcConfig) bool {
+				return conf.ConfMaxSize == 50 && conf.ConfAccountingEnabled && conf.ConfDuplicateCacheTTL == 10
+			},
+			wantApplied: []string{"RAD5GCGW_ACCOUNTING_ENABLED", "RAD5GCGW_DUPLICATE_CACHE_TTL", "RAD5GCGW_MAX_SIZE"}},
+		{name: "list", env: map[string]string{"RAD5GCGW_CLUSTER_PEERS": `["127.0.0.1:18122", "127.0.0.1:18123"]`},
+			want: func(conf rad5gcConfig) bool {
+				return slices.Equal(conf.ConfClusterPeers, []string{"127.0.0.1:18122", "127.0.0.1:18123"})
+			},
+			wantApplied: []string{"RAD5GCGW_CLUSTER_PEERS"}},
+		{name: "list of structs", env: map[string]string{"RAD5GCGW_RADIUS_CLIENTS": `[{address: "192.0.2.1", sharedSecret: "env-secret"}]`},
+			want: func(conf rad5gcConfig) bool {
+				return len(conf.ConfRadiusClients) == 1 && conf.ConfRadiusClients[0].Address == "192.0.2.1" && conf.ConfRadiusClients[0].SharedSecret == "env-secret"
+			},
+			wantApplied: []string{"RAD5GCGW_RADIUS_CLIENTS"}},
+		{name: "invalid int", env: map[string]string{"RAD5GCGW_MAX_SIZE": "large"}, wantErr: true},
+		{name: "invalid bool", env: map[string]string{"RAD5GCGW_ACCOUNTING_ENABLED": "enabled"}, wantErr: true},
+		{name: "invalid list", env: map[string]string{"RAD5GCGW_CLUSTER_PEERS": `["127.0.0.1:18122"`}, wantErr: true},
+		// 設定項目にない環境変数は無視する。
+		{name: "unknown variable", env: map[string]string{"RAD5GCGW_UNKNOWN_KEY": "value"},
+			want: func(conf rad5gcConfig) bool { return conf.ConfSharedSecret == "from-file" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := rad5gcConfig{ConfSharedSecret: "from-file", ConfMaxSize: 200, ConfClusterPeers: []string{"127.0.0.1:18121"}}
+			applied, err := applyConfigEnv(&conf, func(name string) (string, bool) {
+				value, ok := tt.env[name]
+				return value, ok
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", conf)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(conf) {
+				t.Errorf("config = %+v", conf)
+			}
+			slices.Sort(applied)
+			if !slices.Equal(applied, tt.wantApplied) {
+				t.Errorf("applied = %v, want %v", applied, tt.wantApplied)
+			}
+		})
+	}
+}
+
+// コマンドライン引数は、環境変数で上書きした後の設定項目をさらに上書きする。
+func TestCmdLineOptionsApply(t *testing.T) {
+	conf := rad5gcConfig{ConfFilename: "mainsys.log", ConfRadiusListen: ":1812"}
+	if _, err := applyConfigEnv(&conf, func(name string) (string, bool) {
+		value, ok := map[string]string{"RAD5GCGW_FILENAME": "env.log", "RAD5GCGW_RADIUS_LISTEN": ":2812"}[name]
+		return value, ok
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cmdLineOptions{logFile: "cmdline.log"}.apply(&conf)
+	if conf.ConfFilename != "cmdline.log" || conf.ConfRadiusListen != ":2812" {
+		t.Errorf("filename = %q, radiusListen = %q, want cmdline.log, :2812", conf.ConfFilename, conf.ConfRadiusListen)
+	}
+}
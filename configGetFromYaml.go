@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -22,47 +24,384 @@ type rad5gcConfig struct {
 	ConfSharedSecret         string `yaml:"sharedSecret"`
 	ConfAllowedClientAddress string `yaml:"allowedClientAddress"`
 	ConfAttributesLogging    bool   `yaml:"attributesLogging"`
+	ConfRadiusListen         string `yaml:"radiusListen"`
 	ConfAUSFaddress          string `yaml:"ausfAddress"`
+	ConfAusfScheme           string `yaml:"ausfScheme"`
 	ConfOverwriteLinkString  bool   `yaml:"overwriteLinkString"`
+	ConfAusfApiPath          string `yaml:"ausfApiPath"`
+	ConfMskSource            string `yaml:"mskSource"`
+
+	ConfAkaIdentityRequest   string `yaml:"akaIdentityRequest"`
+	ConfAkaIdentityMaxRounds int    `yaml:"akaIdentityMaxRounds"`
+
+	ConfAUSFpool                []ausfPoolMemberConfig `yaml:"ausfPool"`
+	ConfAusfHealthCheckInterval int                    `yaml:"ausfHealthCheckInterval"`
+	ConfAusfRoutes              []ausfRouteConfig      `yaml:"ausfRoutes"`
+	ConfAusfRouteRejectNoMatch  bool                   `yaml:"ausfRouteRejectNoMatch"`
+
+	ConfNrfApiRoot          string `yaml:"nrfApiRoot"`
+	ConfNrfRequesterNfType  string `yaml:"nrfRequesterNfType"`
+	ConfNrfRoutingIndicator string `yaml:"nrfRoutingIndicator"`
+
+	ConfLinkRewriteRules []linkRewriteRuleConfig `yaml:"linkRewriteRules"`
+
+	ConfSbiTlsCaFile     string `yaml:"sbiTlsCaFile"`
+	ConfSbiTlsCertFile   string `yaml:"sbiTlsCertFile"`
+	ConfSbiTlsKeyFile    string `yaml:"sbiTlsKeyFile"`
+	ConfSbiTlsServerName string `yaml:"sbiTlsServerName"`
+
+	ConfSbiHttpVersion         string `yaml:"sbiHttpVersion"`
+	ConfSbiRequestTimeout      int    `yaml:"sbiRequestTimeout"`
+	ConfSbiMaxIdleConnsPerHost int    `yaml:"sbiMaxIdleConnsPerHost"`
+	ConfSbiIdleConnTimeout     int    `yaml:"sbiIdleConnTimeout"`
+	ConfSbiKeepAliveInterval   int    `yaml:"sbiKeepAliveInterval"`
+
+	ConfOAuth2Enabled  bool   `yaml:"oauth2Enabled"`
+	ConfOAuth2TokenUrl string `yaml:"oauth2TokenUrl"`
+	ConfNfInstanceId   string `yaml:"nfInstanceId"`
+
+	ConfRadiusClients        []radiusClientConfig `yaml:"radiusClients"`
+	ConfMessageAuthenticator string               `yaml:"messageAuthenticator"`
+
+	ConfDuplicateCacheTTL     int  `yaml:"duplicateCacheTTL"`
+	ConfStatusServerCheckAUSF bool `yaml:"statusServerCheckAUSF"`
+
+	ConfEapSessionTTL        int `yaml:"eapSessionTTL"`
+	ConfEapSessionMaxEntries int `yaml:"eapSessionMaxEntries"`
+
+	ConfEapSessionStore     string `yaml:"eapSessionStore"`
+	ConfEapSessionStoreFile string `yaml:"eapSessionStoreFile"`
+	ConfEapSessionStoreSync bool   `yaml:"eapSessionStoreSync"`
+
+	ConfClusterListen   string   `yaml:"clusterListen"`
+	ConfClusterNodeName string   `yaml:"clusterNodeName"`
+	ConfClusterPeers    []string `yaml:"clusterPeers"`
+	ConfClusterSecret   string   `yaml:"clusterSecret"`
+	ConfClusterTls      bool     `yaml:"clusterTls"`
+
+	ConfClusterTlsCertFile  string   `yaml:"clusterTlsCertFile"`
+	ConfClusterTlsKeyFile   string   `yaml:"clusterTlsKeyFile"`
+	ConfClusterTlsCaFile    string   `yaml:"clusterTlsCaFile"`
+	ConfClusterTlsPeerNames []string `yaml:"clusterTlsPeerNames"`
+
+	ConfAusfContextReleaseEnabled       bool `yaml:"ausfContextReleaseEnabled"`
+	ConfAusfContextReleaseRetries       int  `yaml:"ausfContextReleaseRetries"`
+	ConfAusfContextReleaseRetryInterval int  `yaml:"ausfContextReleaseRetryInterval"`
+
+	ConfAccountingEnabled    bool   `yaml:"accountingEnabled"`
+	ConfAccountingListen     string `yaml:"accountingListen"`
+	ConfAccountingSessionTTL int    `yaml:"accountingSessionTTL"`
+
+	ConfDynAuthPort    int    `yaml:"dynAuthPort"`
+	ConfDynAuthTimeout int    `yaml:"dynAuthTimeout"`
+	ConfAdminListen    string `yaml:"adminListen"`
+	ConfAdminToken     string `yaml:"adminToken"`
+
+	ConfRadsecEnabled      bool   `yaml:"radsecEnabled"`
+	ConfRadsecListen       string `yaml:"radsecListen"`
+	ConfRadsecCertFile     string `yaml:"radsecCertFile"`
+	ConfRadsecKeyFile      string `yaml:"radsecKeyFile"`
+	ConfRadsecClientCAFile string `yaml:"radsecClientCAFile"`
+
+	ConfRadsecHandshakeTimeout int `yaml:"radsecHandshakeTimeout"`
+	ConfRadsecIdleTimeout      int `yaml:"radsecIdleTimeout"`
+	ConfRadsecMaxInflight      int `yaml:"radsecMaxInflight"`
+}
+
+// radiusClientsの1エントリ分。addressはIPアドレスまたはCIDR表記、nasIdentifierは省略可。
+// radsecNameはRadSecクライアント証明書のCN/SAN DNS名で、RadSec専用エントリならaddress/sharedSecretは省略できる。
+// messageAuthenticatorはMessage-Authenticator検証モード(require/require-first/legacy)で、省略時はトップレベルの設定値を使う。
+type radiusClientConfig struct {
+	Address              string `yaml:"address"`
+	NASIdentifier        string `yaml:"nasIdentifier"`
+	SharedSecret         string `yaml:"sharedSecret"`
+	Description          string `yaml:"description"`
+	RadsecName           string `yaml:"radsecName"`
+	MessageAuthenticator string `yaml:"messageAuthenticator"`
+}
+
+// ausfRoutesの1エントリ分。realm/plmn/imsiPrefixesのうち、設定したものを全て満たすIdentityをausfAddressのAUSFへ送る。
+// plmnは"MCC-MNC"形式、imsiPrefixesはIMSIプレフィックスまたは"from-to"形式の範囲。servingNetworkNameは省略可。
+// ausfPoolを設定した場合は、ausfAddressの代わりにプール内のAUSFへ振り分ける。
+// ausfAddress/ausfPoolが共に未設定なら、nrfApiRootのNRFでplmn・routingIndicatorを条件にAUSFを発見する。
+// routingIndicatorは、SUCI形式のIdentityではSUCIのRouting Indicatorとの一致も条件となる。
+type ausfRouteConfig struct {
+	Name               string                 `yaml:"name"`
+	Realm              string                 `yaml:"realm"`
+	Plmn               string                 `yaml:"plmn"`
+	ImsiPrefixes       []string               `yaml:"imsiPrefixes"`
+	AUSFaddress        string                 `yaml:"ausfAddress"`
+	AUSFpool           []ausfPoolMemberConfig `yaml:"ausfPool"`
+	Scheme             string                 `yaml:"scheme"`
+	ServingNetworkName string                 `yaml:"servingNetworkName"`
+	RoutingIndicator   string                 `yaml:"routingIndicator"`
 }
 
-func getRad5gcConfig() (rad5gcConfig, error) {
+// linkRewriteRulesの1エントリ分。match(URLの正規表現)とapiRoot("[scheme]://[ホスト]:[ポート番号]")のうち、設定したものを全て満たすURLを書き換える。
+// scheme/host/portは省略時は元のURLのまま。パスはstripPathPrefixを取り除いてからaddPathPrefixを前に付ける。
+type linkRewriteRuleConfig struct {
+	Name            string `yaml:"name"`
+	Match           string `yaml:"match"`
+	ApiRoot         string `yaml:"apiRoot"`
+	Scheme          string `yaml:"scheme"`
+	Host            string `yaml:"host"`
+	Port            int    `yaml:"port"`
+	StripPathPrefix string `yaml:"stripPathPrefix"`
+	AddPathPrefix   string `yaml:"addPathPrefix"`
+}
+
+// ausfPoolの1エントリ分。weightは重み付きラウンドロビンの重みで、0または省略時は1。
+// schemeは"http"または"https"で、省略時はルートのscheme(さらに省略時はausfScheme)を使う。
+type ausfPoolMemberConfig struct {
+	Address string `yaml:"address"`
+	Weight  int    `yaml:"weight"`
+	Scheme  string `yaml:"scheme"`
+}
+
+// 設定ファイルを読み込み、環境変数とコマンドライン引数で上書きしてから各項目を検証する。
+// 検証に失敗した項目があっても最後まで検証を続け、[CONFIG]として結果を出力する(エラーは最後に見つかったものを返す)。
+func getRad5gcConfig(opts cmdLineOptions) (rad5gcConfig, error) {
 	var configSet rad5gcConfig
 	var getConfigFileErr error
-	// カレントディレクトリの confrad5gcgw.yaml を決め打ちとしている。
-	rf, filereadErr := os.ReadFile("confrad5gcgw.yaml")
+	// --configで指定したファイル(省略時はカレントディレクトリの confrad5gcgw.yaml)を読み込む。
+	fmt.Printf("[CONFIG] Configuration file : %v\n", opts.configFile)
+	rf, filereadErr := os.ReadFile(opts.configFile)
 	if filereadErr != nil {
 		getConfigFileErr = filereadErr
 		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
 	}
-	// 読み込んだ rad5gcgwconf.yaml を rad5gcConfig型の構造体に流し込む。
+	// 読み込んだ設定ファイルを rad5gcConfig型の構造体に流し込む。
 	unmarshalErr := yaml.Unmarshal(rf, &configSet)
 	if unmarshalErr != nil {
 		getConfigFileErr = unmarshalErr
 		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
 	}
-	if len(configSet.ConfSharedSecret) > 258 || len(configSet.ConfSharedSecret) < 1 {
-		getConfigFileErr = errors.New("shared secret is too short or long")
+	// 設定ファイルの値を、環境変数(RAD5GCGW_～)、コマンドライン引数の順に上書きする。秘密鍵等が含まれるため、値はログに出さない。
+	appliedEnv, envErr := applyConfigEnv(&configSet, os.LookupEnv)
+	if envErr != nil {
+		getConfigFileErr = envErr
 		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+	}
+	if len(appliedEnv) > 0 {
+		fmt.Printf("[CONFIG] Overridden by environment : %v\n", strings.Join(appliedEnv, ", "))
+	}
+	opts.apply(&configSet)
+	// radiusClientsが設定されていればそちらを優先し、未設定なら従来のsharedSecret/allowedClientAddressをチェックする。
+	if len(configSet.ConfRadiusClients) > 0 {
+		_, clientTableErr := buildRadiusClientTable(configSet)
+		if clientTableErr != nil {
+			getConfigFileErr = clientTableErr
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Printf("[CONFIG] Radius Clients : %v entries validation check OK\n", len(configSet.ConfRadiusClients))
+		}
 	} else {
-		fmt.Println("[CONFIG] Shared Secret : length OK ")
+		if len(configSet.ConfSharedSecret) > 258 || len(configSet.ConfSharedSecret) < 1 {
+			getConfigFileErr = errors.New("shared secret is too short or long")
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Println("[CONFIG] Shared Secret : length OK ")
+		}
+		if nil == net.ParseIP(configSet.ConfAllowedClientAddress) {
+			getConfigFileErr = errors.New("invalid client Address")
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Println("[CONFIG] Allowed Client Address : validation check OK")
+		}
 	}
-	if nil == net.ParseIP(configSet.ConfAllowedClientAddress) {
-		getConfigFileErr = errors.New("invalid client Address")
+	if _, modeErr := parseMsgAuthMode(configSet.ConfMessageAuthenticator); modeErr != nil {
+		getConfigFileErr = modeErr
 		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
 	} else {
-		fmt.Println("[CONFIG] Allowed Client Address : validation check OK")
+		fmt.Printf("[CONFIG] Message-Authenticator mode (default): %q (empty = require)\n", configSet.ConfMessageAuthenticator)
+	}
+	fmt.Printf("[CONFIG] Duplicate Request Cache TTL: %v sec (0 = default 30 sec)\n", configSet.ConfDuplicateCacheTTL)
+	fmt.Printf("[CONFIG] EAP Session TTL: %v sec (0 = default 60 sec) / max entries: %v (0 = default 10000)\n", configSet.ConfEapSessionTTL, configSet.ConfEapSessionMaxEntries)
+	switch configSet.ConfEapSessionStore {
+	case "", sessionStoreTypeMemory, sessionStoreTypeFile:
+		fmt.Printf("[CONFIG] EAP Session store: %q (empty = memory) / file: %q / fsync: %v\n", configSet.ConfEapSessionStore, configSet.ConfEapSessionStoreFile, configSet.ConfEapSessionStoreSync)
+	default:
+		getConfigFileErr = errors.New("invalid eapSessionStore (memory or file) : " + configSet.ConfEapSessionStore)
+		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+	}
+	fmt.Printf("[CONFIG] AUSF context release: %v (retries: %v (0 = default 2), interval: %v sec (0 = default 1 sec))\n", configSet.ConfAusfContextReleaseEnabled, configSet.ConfAusfContextReleaseRetries, configSet.ConfAusfContextReleaseRetryInterval)
+	fmt.Printf("[CONFIG] Status-Server AUSF check: %v\n", configSet.ConfStatusServerCheckAUSF)
+	fmt.Printf("[CONFIG] Accounting Server: %v / session TTL: %v sec (0 = default 86400 sec)\n", configSet.ConfAccountingEnabled, configSet.ConfAccountingSessionTTL)
+	if configSet.ConfAccountingSessionTTL < 0 {
+		getConfigFileErr = errors.New("invalid accounting session TTL")
+		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+	}
+	if configSet.ConfAccountingEnabled && configSet.ConfAccountingListen != "" {
+		if _, _, acctListenErr := net.SplitHostPort(configSet.ConfAccountingListen); acctListenErr != nil {
+			getConfigFileErr = errors.New("invalid accounting listen address")
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Println("[CONFIG] Accounting listen address : validation check OK")
+		}
+	}
+	if configSet.ConfDynAuthPort < 0 || configSet.ConfDynAuthPort > 65535 {
+		getConfigFileErr = errors.New("invalid dynamic authorization port number")
+		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+	}
+	if configSet.ConfRadiusListen != "" {
+		if _, _, radiusListenErr := net.SplitHostPort(configSet.ConfRadiusListen); radiusListenErr != nil {
+			getConfigFileErr = errors.New("invalid radius listen address")
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Printf("[CONFIG] Radius Server : %v\n", configSet.ConfRadiusListen)
+		}
+	}
+	if configSet.ConfClusterListen != "" {
+		if clusterErr := clusterConfigValidate(configSet); clusterErr != nil {
+			getConfigFileErr = clusterErr
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Printf("[CONFIG] Cluster : %v (node: %v, peers: %v, TLS: %v, peer names: %v)\n", configSet.ConfClusterListen, configSet.ConfClusterNodeName, configSet.ConfClusterPeers, configSet.ConfClusterTls, configSet.ConfClusterTlsPeerNames)
+		}
+	}
+	if configSet.ConfAdminListen != "" {
+		if adminListenErr := adminListenValidate(configSet.ConfAdminListen, configSet.ConfAdminToken); adminListenErr != nil {
+			getConfigFileErr = adminListenErr
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Printf("[CONFIG] Admin Server : %v (token: %v)\n", configSet.ConfAdminListen, configSet.ConfAdminToken != "")
+		}
+	}
+	fmt.Printf("[CONFIG] RadSec Server: %v\n", configSet.ConfRadsecEnabled)
+	if configSet.ConfRadsecEnabled {
+		_, keyPairErr := tls.LoadX509KeyPair(configSet.ConfRadsecCertFile, configSet.ConfRadsecKeyFile)
+		_, caStatErr := os.Stat(configSet.ConfRadsecClientCAFile)
+		switch {
+		case keyPairErr != nil:
+			getConfigFileErr = fmt.Errorf("invalid radsec certificate or key / %w", keyPairErr)
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		case caStatErr != nil:
+			getConfigFileErr = fmt.Errorf("invalid radsec client CA file / %w", caStatErr)
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		default:
+			fmt.Println("[CONFIG] RadSec certificate/key/client CA : validation check OK")
+		}
+		if configSet.ConfRadsecHandshakeTimeout < 0 || configSet.ConfRadsecIdleTimeout < 0 || configSet.ConfRadsecMaxInflight < 0 {
+			getConfigFileErr = errors.New("invalid radsec handshake timeout, idle timeout or max inflight")
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Printf("[CONFIG] RadSec handshake timeout: %v sec (0 = default 10 sec) / idle timeout: %v sec (0 = default 300 sec) / max inflight: %v (0 = default 64)\n", configSet.ConfRadsecHandshakeTimeout, configSet.ConfRadsecIdleTimeout, configSet.ConfRadsecMaxInflight)
+		}
 	}
 	fmt.Printf("[CONFIG] Radius Attributes Logging: %v\n", configSet.ConfAttributesLogging)
-	ausfAddrCheck, ausfPort, sepCheck := strings.Cut(configSet.ConfAUSFaddress, ":")
-	ausfPortCheck, _ := strconv.Atoi(ausfPort)
-	if nil == net.ParseIP(ausfAddrCheck) || ausfPortCheck > 65535 || ausfPortCheck < 0 || !sepCheck {
-		getConfigFileErr = errors.New("invalid AUSF address or Port number")
+	// ausfPoolが設定されていればそちらを既定ルートとして使うので、ausfAddressのチェックは行わない。
+	// ausfAddress/ausfPoolが共に未設定でnrfApiRootが設定されていれば、既定ルートはNRFでAUSFを発見する。
+	switch {
+	case configSet.ConfNrfApiRoot != "" && configSet.ConfAUSFaddress == "" && len(configSet.ConfAUSFpool) == 0:
+		fmt.Println("[CONFIG] AUSF address : not set (discovered by NRF)")
+	case len(configSet.ConfAUSFpool) > 0:
+		if _, poolErr := newAusfPool(configSet.ConfAUSFpool, sbiSchemeOf(configSet.ConfAusfScheme)); poolErr != nil {
+			getConfigFileErr = poolErr
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Printf("[CONFIG] AUSF Pool : %v entries validation check OK\n", len(configSet.ConfAUSFpool))
+		}
+	default:
+		ausfAddrCheck, ausfPort, sepCheck := strings.Cut(configSet.ConfAUSFaddress, ":")
+		ausfPortCheck, _ := strconv.Atoi(ausfPort)
+		if nil == net.ParseIP(ausfAddrCheck) || ausfPortCheck > 65535 || ausfPortCheck < 0 || !sepCheck {
+			getConfigFileErr = errors.New("invalid AUSF address or Port number")
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Println("[CONFIG] AUSF address : validation check OK")
+		}
+	}
+	if schemeErr := sbiSchemeValidate(configSet.ConfAusfScheme); schemeErr != nil {
+		getConfigFileErr = fmt.Errorf("ausfScheme: %w", schemeErr)
 		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
 	} else {
-		fmt.Println("[CONFIG] AUSF address : validation check OK")
+		fmt.Printf("[CONFIG] AUSF scheme : %q (empty = http)\n", configSet.ConfAusfScheme)
+	}
+	if configSet.ConfSbiTlsCertFile != "" || configSet.ConfSbiTlsKeyFile != "" {
+		if _, keyPairErr := tls.LoadX509KeyPair(configSet.ConfSbiTlsCertFile, configSet.ConfSbiTlsKeyFile); keyPairErr != nil {
+			getConfigFileErr = fmt.Errorf("invalid SBI TLS client certificate or key / %w", keyPairErr)
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Println("[CONFIG] SBI TLS client certificate/key (mutual TLS) : validation check OK")
+		}
+	}
+	if configSet.ConfSbiTlsCaFile != "" {
+		if _, caStatErr := os.Stat(configSet.ConfSbiTlsCaFile); caStatErr != nil {
+			getConfigFileErr = fmt.Errorf("invalid SBI TLS CA file / %w", caStatErr)
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Println("[CONFIG] SBI TLS CA : validation check OK")
+		}
+	}
+	switch configSet.ConfSbiHttpVersion {
+	case "", sbiHttpVersion1, sbiHttpVersion2:
+		fmt.Printf("[CONFIG] SBI HTTP version : %q (empty = http1) / request timeout: %v sec (0 = default 5 sec)\n", configSet.ConfSbiHttpVersion, configSet.ConfSbiRequestTimeout)
+	default:
+		getConfigFileErr = errors.New("invalid sbiHttpVersion (http1 or http2) : " + configSet.ConfSbiHttpVersion)
+		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+	}
+	if configSet.ConfNrfApiRoot != "" {
+		nrfUrl, nrfUrlErr := url.Parse(configSet.ConfNrfApiRoot)
+		if nrfUrlErr != nil || (nrfUrl.Scheme != "http" && nrfUrl.Scheme != "https") || nrfUrl.Host == "" {
+			getConfigFileErr = errors.New("invalid nrfApiRoot : " + configSet.ConfNrfApiRoot)
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Printf("[CONFIG] NRF apiRoot : %v (requester: %q, routingIndicator: %q)\n", configSet.ConfNrfApiRoot, configSet.ConfNrfRequesterNfType, configSet.ConfNrfRoutingIndicator)
+		}
+	}
+	if configSet.ConfOAuth2Enabled {
+		switch {
+		case configSet.ConfOAuth2TokenUrl == "" && configSet.ConfNrfApiRoot == "":
+			getConfigFileErr = errors.New("oauth2Enabled requires oauth2TokenUrl or nrfApiRoot")
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		case configSet.ConfNfInstanceId == "":
+			getConfigFileErr = errors.New("oauth2Enabled requires nfInstanceId")
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		default:
+			fmt.Printf("[CONFIG] OAuth2 : enabled (token URL: %q (empty = nrfApiRoot), nfInstanceId: %v)\n", configSet.ConfOAuth2TokenUrl, configSet.ConfNfInstanceId)
+		}
+	}
+	fmt.Printf("[CONFIG] AUSF Health Check Interval: %v sec (0 = default 10 sec)\n", configSet.ConfAusfHealthCheckInterval)
+	if len(configSet.ConfAusfRoutes) > 0 {
+		if _, routeTableErr := buildAusfRouteTable(configSet); routeTableErr != nil {
+			getConfigFileErr = routeTableErr
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Printf("[CONFIG] AUSF Routes : %v entries validation check OK\n", len(configSet.ConfAusfRoutes))
+		}
 	}
+	fmt.Printf("[CONFIG] AUSF Route reject on no match: %v\n", configSet.ConfAusfRouteRejectNoMatch)
 	fmt.Printf("[CONFIG] Overwrite Link String: %v\n", configSet.ConfOverwriteLinkString)
+	if apiPathErr := ausfApiPathValidate(configSet.ConfAusfApiPath); apiPathErr != nil {
+		getConfigFileErr = apiPathErr
+		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+	} else {
+		fmt.Printf("[CONFIG] AUSF API path : %q (empty = /nausf-auth/v1)\n", configSet.ConfAusfApiPath)
+	}
+	if len(configSet.ConfLinkRewriteRules) > 0 {
+		if _, rulesErr := buildLinkRewriteRules(configSet); rulesErr != nil {
+			getConfigFileErr = rulesErr
+			log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+		} else {
+			fmt.Printf("[CONFIG] Link Rewrite Rules : %v entries validation check OK\n", len(configSet.ConfLinkRewriteRules))
+		}
+	}
+	switch configSet.ConfMskSource {
+	case "", mskSourceKseaf, mskSourceNswo:
+		fmt.Printf("[CONFIG] MSK source: %q (empty = kseaf)\n", configSet.ConfMskSource)
+	default:
+		getConfigFileErr = errors.New("invalid mskSource : " + configSet.ConfMskSource)
+		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+	}
+	if _, idReqErr := akaIdentityRequestAttr(configSet.ConfAkaIdentityRequest); idReqErr != nil {
+		getConfigFileErr = idReqErr
+		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+	} else if configSet.ConfAkaIdentityMaxRounds < 0 || configSet.ConfAkaIdentityMaxRounds > 3 {
+		getConfigFileErr = fmt.Errorf("invalid akaIdentityMaxRounds (1-3) : %v", configSet.ConfAkaIdentityMaxRounds)
+		log.Printf("[CONFIG] error: %v\n", getConfigFileErr)
+	} else {
+		fmt.Printf("[CONFIG] AKA' identity request : %q (empty = fullauth) / max rounds: %v (0 = default 3)\n", configSet.ConfAkaIdentityRequest, configSet.ConfAkaIdentityMaxRounds)
+	}
 	fmt.Println("----------")
 	return configSet, getConfigFileErr
 }
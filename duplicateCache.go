@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+)
+
+// RFC 5080 Section 2.2.2 に基づく、重複Access-Request検出用のキャッシュエントリ。
+// 同じ送信元(アドレス:ポート)・Identifier・Request Authenticatorのリクエストを重複とみなす。
+// doneは元リクエストの処理完了時にcloseされ、処理中に届いた重複リクエストはこれを待ってから同じ応答を返す。
+// responseがnilのままなら、元リクエストは破棄(silently discard)されたことを示す。破棄したエントリはキャッシュから削除するため、
+// その後に届いた再送は新しいリクエストとして処理される(AUSFの一時的な障害等から、NASの再送で回復できるようにするため)。
+// なお、UDPではradius.PacketServerが処理中の同一送信元・Identifierのリクエストを破棄するため、処理完了を待つのはRadSecで届いた重複のみとなる。
+type duplicateCacheEntry struct {
+	done        chan struct{}
+	response    *radius.Packet
+	completedAt time.Time
+}
+
+// 重複検出キャッシュ本体。キーはduplicateCacheKey()で生成する文字列、値は*duplicateCacheEntry型。
+var duplicateCache sync.Map
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する（単位は秒）
+var duplicateCacheTTL time.Duration
+
+// 送信元アドレス(クライアントごと)・Identifier・Request Authenticatorからキャッシュのキーを生成する。
+func duplicateCacheKey(r *radius.Request) string {
+	return fmt.Sprintf("%v/%v/%v", r.RemoteAddr, r.Packet.Identifier, hex.EncodeToString(r.Packet.Authenticator[:]))
+}
+
+// リクエストをキャッシュに登録する。既に同じキーが登録されていれば、そのエントリとtrue(重複)を返す。
+func duplicateCacheBegin(r *radius.Request) (*duplicateCacheEntry, bool) {
+	entry := &duplicateCacheEntry{done: make(chan struct{})}
+	actual, loaded := duplicateCache.LoadOrStore(duplicateCacheKey(r), entry)
+	return actual.(*duplicateCacheEntry), loaded
+}
+
+// 元リクエストの処理完了時に呼び出し、送信した応答(破棄した場合はnil)を記録して待機中の重複リクエストを解放する。
+// 破棄した場合はエントリをキャッシュから削除し、以降の再送を改めて処理させる。
+func duplicateCacheComplete(r *radius.Request, entry *duplicateCacheEntry, response *radius.Packet) {
+	entry.response = response
+	entry.completedAt = time.Now()
+	if response == nil {
+		duplicateCache.CompareAndDelete(duplicateCacheKey(r), entry)
+	}
+	close(entry.done)
+}
+
+// 重複リクエストの処理。元リクエストの処理完了を待ち、応答を送っていれば同じ応答を再送する。
+// 処理中に届いた重複リクエストは、元リクエストを破棄していた場合は同様に破棄する(NASの次の再送は新しいリクエストとして処理される)。
+func duplicateCacheReplay(w radius.ResponseWriter, r *radius.Request, entry *duplicateCacheEntry) {
+	select {
+	case <-entry.done:
+	case <-time.After(duplicateCacheTTL):
+		log.Printf("[RADIUS] duplicate %v (ID: 0x%X) from %v : original request still in progress. silently discarded.\n", r.Packet.Code, r.Packet.Identifier, r.RemoteAddr)
+		return
+	}
+	if entry.response == nil {
+		log.Printf("[RADIUS] duplicate %v (ID: 0x%X) from %v : original request was discarded. silently discarded.\n", r.Packet.Code, r.Packet.Identifier, r.RemoteAddr)
+		return
+	}
+	if writingErr := w.Write(entry.response); writingErr != nil {
+		log.Printf("[RADIUS] Failed to resend cached Response packet / %v\n", writingErr)
+	} else {
+		log.Printf("[RADIUS] duplicate %v (ID: 0x%X) from %v : cached %v resent.\n", r.Packet.Code, r.Packet.Identifier, r.RemoteAddr, entry.response.Code)
+	}
+}
+
+// 処理完了からduplicateCacheTTLを経過したエントリを定期的に削除する。main()からgoroutineで起動する。
+func duplicateCacheSweeper() {
+	ticker := time.NewTicker(duplicateCacheTTL)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		duplicateCache.Range(func(key, value any) bool {
+			entry := value.(*duplicateCacheEntry)
+			select {
+			case <-entry.done:
+				if now.Sub(entry.completedAt) > duplicateCacheTTL {
+					duplicateCache.Delete(key)
+				}
+			default:
+			}
+			return true
+		})
+	}
+}
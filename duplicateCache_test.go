@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+)
+
+// 書き込まれた応答を記録するradius.ResponseWriter。
+type responseRecorderForTest struct {
+	mu      sync.Mutex
+	packets []*radius.Packet
+}
+
+func (rw *responseRecorderForTest) Write(packet *radius.Packet) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.packets = append(rw.packets, packet)
+	return nil
+}
+
+func (rw *responseRecorderForTest) count() int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return len(rw.packets)
+}
+
+// 送信元192.0.2.1:port、Identifierがidで、Request Authenticatorが固定のAccess-Requestを生成する。
+func accessRequestForTest(port int, id byte, authenticator byte) *radius.Request {
+	packet := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	packet.Identifier = id
+	packet.Authenticator = [16]byte{authenticator}
+	return &radius.Request{Packet: packet, RemoteAddr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}}
+}
+
+func TestDuplicateCache(t *testing.T) {
+	savedTTL := duplicateCacheTTL
+	t.Cleanup(func() { duplicateCacheTTL = savedTTL })
+	duplicateCacheTTL = time.Second
+
+	original := accessRequestForTest(50001, 1, 0xaa)
+	entry, isDuplicate := duplicateCacheBegin(original)
+	if isDuplicate {
+		t.Fatal("first request detected as duplicate")
+	}
+	t.Cleanup(func() { duplicateCache.Delete(duplicateCacheKey(original)) })
+	// 送信元ポート・Identifier・Request Authenticatorのどれかが異なれば、別のリクエストとして扱う。
+	for _, other := range []*radius.Request{accessRequestForTest(50002, 1, 0xaa), accessRequestForTest(50001, 2, 0xaa), accessRequestForTest(50001, 1, 0xbb)} {
+		if otherEntry, dup := duplicateCacheBegin(other); dup {
+			t.Errorf("%v detected as duplicate", duplicateCacheKey(other))
+		} else {
+			duplicateCacheComplete(other, otherEntry, nil)
+		}
+	}
+
+	// 処理中に届いた重複は、元リクエストの完了を待って同じ応答を返す。
+	dupEntry, isDuplicate := duplicateCacheBegin(accessRequestForTest(50001, 1, 0xaa))
+	if !isDuplicate || dupEntry != entry {
+		t.Fatalf("retransmission not detected as duplicate (%v)", isDuplicate)
+	}
+	waiting := &responseRecorderForTest{}
+	replayed := make(chan struct{})
+	go func() {
+		duplicateCacheReplay(waiting, accessRequestForTest(50001, 1, 0xaa), dupEntry)
+		close(replayed)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if waiting.count() != 0 {
+		t.Fatal("duplicate answered before the original request completed")
+	}
+	response := original.Response(radius.CodeAccessChallenge)
+	duplicateCacheComplete(original, entry, response)
+	<-replayed
+	if waiting.count() != 1 || waiting.packets[0] != response {
+		t.Fatalf("waiting duplicate got %v responses, want the cached response", waiting.count())
+	}
+
+	// 完了後に届いた重複には、キャッシュした応答を再送する。
+	later := &responseRecorderForTest{}
+	laterEntry, isDuplicate := duplicateCacheBegin(accessRequestForTest(50001, 1, 0xaa))
+	if !isDuplicate {
+		t.Fatal("retransmission after completion not detected as duplicate")
+	}
+	duplicateCacheReplay(later, accessRequestForTest(50001, 1, 0xaa), laterEntry)
+	if later.count() != 1 || later.packets[0] != response {
+		t.Errorf("late duplicate got %v responses, want the cached response", later.count())
+	}
+}
+
+func TestDuplicateCacheDiscarded(t *testing.T) {
+	savedTTL := duplicateCacheTTL
+	t.Cleanup(func() { duplicateCacheTTL = savedTTL })
+	duplicateCacheTTL = time.Second
+
+	original := accessRequestForTest(50011, 1, 0xaa)
+	entry, _ := duplicateCacheBegin(original)
+	t.Cleanup(func() { duplicateCache.Delete(duplicateCacheKey(original)) })
+	dupEntry, isDuplicate := duplicateCacheBegin(accessRequestForTest(50011, 1, 0xaa))
+	if !isDuplicate {
+		t.Fatal("retransmission not detected as duplicate")
+	}
+	// 破棄した場合、処理中に届いた重複も破棄し、以降の再送は新しいリクエストとして処理させる。
+	duplicateCacheComplete(original, entry, nil)
+	waiting := &responseRecorderForTest{}
+	duplicateCacheReplay(waiting, accessRequestForTest(50011, 1, 0xaa), dupEntry)
+	if waiting.count() != 0 {
+		t.Errorf("duplicate of discarded request answered")
+	}
+	retryEntry, isDuplicate := duplicateCacheBegin(accessRequestForTest(50011, 1, 0xaa))
+	if isDuplicate || retryEntry == entry {
+		t.Error("retransmission after discard detected as duplicate")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+	"layeh.com/radius/rfc3576"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+var dynAuthPort int
+var dynAuthTimeout time.Duration
+
+// Disconnect-Request/CoA-Requestを1つのNASセッションに送信した結果。
+// codeはACK/NAKのいずれか（送信失敗時は0）、errorCauseはNAKや一部ACKに含まれるError-Cause(101)の値。
+type dynAuthResult struct {
+	nasAddress       string
+	callingStationId string
+	acctSessionId    string
+	code             radius.Code
+	errorCause       rfc3576.ErrorCause
+	err              error
+}
+
+func (d dynAuthResult) String() string {
+	switch {
+	case d.err != nil:
+		return fmt.Sprintf("NAS: %v, Calling-Station-Id: %v, Acct-Session-Id: %v, error: %v", d.nasAddress, d.callingStationId, d.acctSessionId, d.err)
+	case d.errorCause != 0:
+		return fmt.Sprintf("NAS: %v, Calling-Station-Id: %v, Acct-Session-Id: %v, result: %v, Error-Cause: %v", d.nasAddress, d.callingStationId, d.acctSessionId, d.code, d.errorCause)
+	default:
+		return fmt.Sprintf("NAS: %v, Calling-Station-Id: %v, Acct-Session-Id: %v, result: %v", d.nasAddress, d.callingStationId, d.acctSessionId, d.code)
+	}
+}
+
+// SUPIを認証したNASに対してDisconnect-Requestを送信する。
+// 認証済みSTA(authenticatedStaTable)のうちSUPIが一致するもの全てが対象で、Disconnect-ACKを受信したSTAは記録から削除する。
+func dynAuthDisconnect(ctx context.Context, supi string) ([]dynAuthResult, error) {
+	return dynAuthSend(ctx, radius.CodeDisconnectRequest, supi, nil)
+}
+
+// SUPIを認証したNASに対してCoA-Requestを送信する。
+// 引数attrsには変更したい認可属性(Session-Timeout、Filter-Id等)を指定する。
+func dynAuthCoA(ctx context.Context, supi string, attrs radius.Attributes) ([]dynAuthResult, error) {
+	if len(attrs) == 0 {
+		return nil, errors.New("no authorization attribute for CoA-Request")
+	}
+	return dynAuthSend(ctx, radius.CodeCoARequest, supi, attrs)
+}
+
+// Disconnect-Request/CoA-Request送信の共通処理。
+// RFC 5176 のセッション識別属性として、NAS-IP-Address/NAS-Identifier/Calling-Station-Id/Acct-Session-Id/User-Nameを載せる。
+func dynAuthSend(ctx context.Context, code radius.Code, supi string, attrs radius.Attributes) ([]dynAuthResult, error) {
+	var targets []authenticatedSta
+	authenticatedStaTable.Range(func(key, value any) bool {
+		if sta := value.(authenticatedSta); sta.supi == supi {
+			targets = append(targets, sta)
+		}
+		return true
+	})
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no authenticated session for %v", supi)
+	}
+	var results []dynAuthResult
+	for _, sta := range targets {
+		acctSessionIds := acctSessionIdsByStation(sta.nasAddress, sta.callingStationId)
+		if len(acctSessionIds) == 0 {
+			// Accountingを受信していない場合は、Acct-Session-Idなしで送信する。
+			acctSessionIds = []string{""}
+		}
+		for _, acctSessionId := range acctSessionIds {
+			result := dynAuthSendOne(ctx, code, sta, acctSessionId, attrs)
+			log.Printf("[DynAuth] %v for %v / %v\n", code, supi, result)
+			results = append(results, result)
+			if result.code == radius.CodeDisconnectACK {
+				authenticatedStaTable.Delete(authenticatedStaKey(sta.nasAddress, sta.callingStationId))
+			}
+		}
+	}
+	return results, nil
+}
+
+// 1つのNASセッションに対してDisconnect-Request/CoA-Requestを送信し、ACK/NAKを待つ。
+// 共有秘密鍵はAccess-Request送信元IPに対応するRadiusクライアントのものを使う。
+func dynAuthSendOne(ctx context.Context, code radius.Code, sta authenticatedSta, acctSessionId string, attrs radius.Attributes) dynAuthResult {
+	result := dynAuthResult{
+		nasAddress:       sta.nasAddress,
+		callingStationId: sta.callingStationId,
+		acctSessionId:    acctSessionId,
+	}
+	nasUDPAddr := &net.UDPAddr{IP: net.ParseIP(sta.remoteIP)}
+	client, clientOK := radiusClientLookup(nasUDPAddr, sta.nasIdentifier)
+	if !clientOK || len(client.secret) == 0 {
+		result.err = errors.New("no shared secret for NAS " + sta.remoteIP)
+		return result
+	}
+	packet := radius.New(code, client.secret)
+	if nasIP := net.ParseIP(sta.nasAddress); nasIP != nil && nasIP.To4() != nil {
+		rfc2865.NASIPAddress_Add(packet, nasIP)
+	}
+	if sta.nasIdentifier != "" {
+		rfc2865.NASIdentifier_AddString(packet, sta.nasIdentifier)
+	}
+	if sta.callingStationId != "" {
+		rfc2865.CallingStationID_AddString(packet, sta.callingStationId)
+	}
+	if acctSessionId != "" {
+		rfc2866.AcctSessionID_AddString(packet, acctSessionId)
+	}
+	rfc2865.UserName_AddString(packet, sta.supi)
+	rfc2869.EventTimestamp_Add(packet, time.Now())
+	packet.Attributes = append(packet.Attributes, attrs...)
+
+	exchangeCtx, cancel := context.WithTimeout(ctx, dynAuthTimeout)
+	defer cancel()
+	dynAuthClient := radius.Client{
+		Retry:           time.Second,
+		MaxPacketErrors: 10,
+	}
+	response, exchangeErr := dynAuthClient.Exchange(exchangeCtx, packet, net.JoinHostPort(sta.remoteIP, strconv.Itoa(dynAuthPort)))
+	if exchangeErr != nil {
+		result.err = exchangeErr
+		return result
+	}
+	result.code = response.Code
+	result.errorCause = rfc3576.ErrorCause_Get(response)
+	switch response.Code {
+	case radius.CodeDisconnectACK, radius.CodeCoAACK:
+	case radius.CodeDisconnectNAK, radius.CodeCoANAK:
+		result.err = fmt.Errorf("%v received (Error-Cause: %v)", response.Code, result.errorCause)
+	default:
+		result.err = fmt.Errorf("unexpected response code %v", response.Code)
+	}
+	return result
+}
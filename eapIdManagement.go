@@ -1,80 +1,229 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
 )
 
-// EAP idとN12 URIのセットを管理するためのグローバル変数。
-// syncパッケージのMap構造体を使い、EAP-ID(uint8)をキー、紐付きURI(string)を格納することを想定している。
-// ただし、書き込み(STORE)する際はanyで入ってくるので、読み出した(LOAD)valueを戻り値で使う場合は型アサーションが必要。
-var eapIdTable sync.Map
-
-// グローバル変数eapIdTableにおける対象idの読み込みを実行する。
-// 引数はuint8型だが、これはlayer.EAP型の要素Idを引っ張ってくることを想定しているため。
-// 戻り値はstringだが、sync.Loadメソッドの実行結果がanyで返ってくるので型アサーションを必要とする。
-func eapIdTableLoad(eapid uint8) (string, bool) {
-	var valueStr string
-	value, ok := eapIdTable.Load(eapid)
-	if ok {
-		log.Printf("[EAP id table] LOAD / key: 0x%X / value: %v\n", eapid, value)
-		valueAssertion, strOK := value.(string)
-		if strOK {
-			valueStr = valueAssertion
-		} else {
-			log.Printf("[EAP id table] LOAD / key: 0x%X / invalid value (not string)\n", eapid)
-		}
-	} else {
-		log.Printf("[EAP id table] LOAD / key: 0x%X / value not found\n", eapid)
+// Access-Challengeごとに払い出すState(24)の長さ(byte)。
+const eapSessionStateLength = 16
+
+// EAP認証セッション1件分の情報。Access-Challenge送信時に払い出したState(24)に紐付けて管理する。
+// eapIdはAccess-Challengeで送ったEAP-RequestのIdentifierで、次のEAP-ResponseのIdentifierと一致することを確認する。
+// uriはN12の認証コンテキスト(_links href)で、AUSFを介さないAccess-Challenge(AT_FULLAUTH_ID_REQ等)では空になる。
+// nasAddress/callingStationIdは、Stateを払い出したAccess-Requestの送信元と一致することを確認するために使う。
+// ausfAddressはこのセッションの認証コンテキストを持つAUSF(ausfRouteSelectで選択したもの)で、overwriteLinkStringの上書き先となる。
+// keyNameはAKA'-ChallengeのAT_RAND/AT_AUTNから生成したEAP-AKA'のSession-Idで、EAP-Success時のEAP-Key-Nameに使う。
+// identityReqは直前に送ったEAP-Request/AKA'-IdentityのIdentity要求(Attribute Type)、identityRoundsはこのセッションで送った回数。
+// authCtxIdはuriから取り出したAUSFの認証コンテキストID(TS 29.509)で、認証を中断した際の解放(DELETE)のログに使う。
+// createdAtは認証開始(最初のAccess-Challenge送信)の日時で、以降のAccess-Challengeでも引き継ぐ。lastActivityは直近のAccess-Challenge送信の日時。
+// ownerはこのセッションを登録した(Access-Challengeを送った)ノードの名前(clusterNodeName)で、クラスタ構成でない場合は空になる。
+type eapSession struct {
+	eapId            uint8
+	uri              string
+	nasAddress       string
+	callingStationId string
+	ausfAddress      string
+	keyName          []byte
+	authCtxId        string
+	identityReq      uint8
+	identityRounds   int
+	createdAt        time.Time
+	lastActivity     time.Time
+	owner            string
+}
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する（eapSessionTTLの単位は秒）
+// eapSessionTTLは、Access-Challenge送信後にSTAからの応答を待つ時間。これを過ぎたセッションは破棄する。
+// eapSessionMaxEntriesは、同時に保持するEAP認証セッション数の上限。上限に達している間は新規の認証を受け付けない。
+var eapSessionTTL time.Duration
+var eapSessionMaxEntries int
+
+// EAP認証セッションテーブルの状況。GET /stats/eap-sessions で確認できる(保持中のセッション数はeapSessions.Len())。
+// storedは登録した累計、expiredはSTAが応答せずTTLで破棄した累計、rejectedFullは上限到達で受け付けなかった新規認証の累計。
+type eapSessionCounters struct {
+	stored       atomic.Uint64
+	expired      atomic.Uint64
+	rejectedFull atomic.Uint64
+}
+
+var eapSessionStats eapSessionCounters
+
+// Access-Challengeに載せるStateを生成する。値に意味を持たせず、推測されないよう乱数で生成する。
+func eapSessionStateGenerate() ([]byte, error) {
+	state := make([]byte, eapSessionStateLength)
+	if _, randErr := rand.Read(state); randErr != nil {
+		return nil, randErr
+	}
+	return state, nil
+}
+
+// EAP認証セッションの格納先(eapSessions)への書き込みを実行する。Access-Challenge送信後に呼び出すことを想定している。
+// 引数sessionはハンドラで組み立てたセッション情報で、nasAddress/callingStationId/ownerはここで設定する。
+// session.uri(AUSFから返ったlink)は、n12LinkResolveで送信先URLに書き換えてから格納する。
+func eapSessionStore(state []byte, r *radius.Request, session eapSession) {
+	if session.uri != "" {
+		session.uri = n12LinkResolve(session.uri, session.ausfAddress)
+		session.authCtxId = authCtxIdOf(session.uri)
+	}
+	session.nasAddress = nasAddressOf(r)
+	session.callingStationId = rfc2865.CallingStationID_GetString(r.Packet)
+	session.owner = clusterNodeName
+	session.lastActivity = time.Now()
+	if session.createdAt.IsZero() {
+		session.createdAt = session.lastActivity
 	}
-	return valueStr, ok
+	key := hex.EncodeToString(state)
+	if _, storeErr := eapSessions.Store(key, session); storeErr != nil {
+		log.Printf("[EAP session table] STORE / key: %v / persisting failed / %v\n", key, storeErr)
+	}
+	eapSessionStats.stored.Add(1)
+	log.Printf("[EAP session table] STORE / key: %v / EAP-ID: 0x%X / NAS: %v / Calling-Station-Id: %v / value: %v\n", key, session.eapId, session.nasAddress, session.callingStationId, session.uri)
 }
 
-// グローバル変数eapIdTableにおける対象idへの書き込みを実行する。
-// 引数がuint8型なのはLoadと同じ事情。sync.Storeメソッドは戻り値がないのでこちらも同様。
-// ただし、テーブル書き込みの際にRad-5GC GW設定の overwriteLinkString = true なら引数uristrの中身を一部上書きする。
-// 具体的には、http://xxx.xxx.xxx.xxx:xxxxx/のxxx部分を設定項目ausfAddressで上書きする。
-// しかし、引数に取ったuristrはany型のため、stringとして操作する前に型アサーションが必要となっている。
-// また、書き込み前と後をログ出力したいため、sync.Loadメソッドで書き込み前にLOADしてvalueをログ出力させている。
-func eapIdTableStore(eapid uint8, uristr any) error {
-	var linkStringResult string
-	var storeErr error
-	value, ok := eapIdTable.Load(eapid)
-	if ok {
-		log.Printf("[EAP id table] LOAD / key: 0x%X / old value: %v\n", eapid, value)
-	} else {
-		log.Printf("[EAP id table] LOAD / key: 0x%X / value not found\n", eapid)
-	}
-	typeAssertion, strOK := uristr.(string)
-	if strOK {
-		if overwriteLinkString {
-			afterStr, _ := strings.CutPrefix(typeAssertion, "http://")
-			_, afterStrSecond, _ := strings.Cut(afterStr, "/")
-			linkStringResult = "http://" + n12AUSFaddress + "/" + afterStrSecond
+// AUSFから返ったlink(_links href)を、以降のN12 Requestの送信先URLに書き換える。
+// Rad-5GC GW設定の overwriteLinkString = true なら、[scheme]://xxx.xxx.xxx.xxx:xxxxx/のschemeとxxx部分を、
+// 引数ausfAddress(ルーティングで選択したAUSF)のものに上書きする。
+// その後、リンク書き換えルール(linkRewriteRules)に該当すれば、初回Requestの送信先と同様に書き換える。
+func n12LinkResolve(uristr string, ausfAddress string) string {
+	linkStringResult := uristr
+	if overwriteLinkString {
+		if linkUrl, parseErr := url.Parse(uristr); parseErr != nil {
+			log.Printf("[EAP session table] invalid link %q, not overwritten / %v\n", uristr, parseErr)
 		} else {
-			linkStringResult = typeAssertion
+			linkUrl.Scheme = ausfEndpointSchemeOf(ausfAddress)
+			linkUrl.Host = ausfAddress
+			linkStringResult = linkUrl.String()
 		}
-		eapIdTable.Store(eapid, linkStringResult)
-		log.Printf("[EAP id table] STORE / key: 0x%X / new value: %v\n", eapid, linkStringResult)
-	} else {
-		log.Printf("[EAP id table] STORE / key: 0x%X / failed - invalid value: %v", eapid, uristr)
-		storeErrString := errors.New(fmt.Sprintln("invalid argument 2 / unknown type"))
-		storeErr = storeErrString
-	}
-	return storeErr
+	}
+	return linkRewrite(linkStringResult)
+}
+
+// 処理中のAccess-RequestのState(キー)。同じStateのAccess-Requestを並行して処理し、同じ認証コンテキストへN12 Requestを重ねて送らないようにする。
+var eapSessionsInFlight sync.Map
+
+// 受信したAccess-RequestのStateからEAP認証セッションを取り出し、処理中として印を付ける。テーブルからは削除しない。
+// 呼び出し元は応答を送信できたらeapSessionConsumeでテーブルから削除し、いずれの場合もeapSessionReleaseで印を外すこと。
+// 破棄(silently discard)した場合はテーブルに残るため、NASの再送で同じ段階から認証をやり直せる。
+// Stateがない・未登録・処理中の場合や、送信元NAS/Calling-Station-Id/EAP-IDが払い出し時と一致しない場合はエラーを返す。
+// 一致しない場合は別STAからの成りすましの可能性があるため、テーブルのエントリは削除せずに残す。
+func eapSessionLoad(r *radius.Request, eapid uint8) (string, eapSession, error) {
+	var session eapSession
+	state := rfc2865.State_Get(r.Packet)
+	if len(state) == 0 {
+		log.Println("[EAP session table] LOAD / State not found in Access-Request")
+		return "", session, errors.New("state not found")
+	}
+	key := hex.EncodeToString(state)
+	session, ok := eapSessions.Load(key)
+	if !ok {
+		log.Printf("[EAP session table] LOAD / key: %v / value not found\n", key)
+		return "", session, fmt.Errorf("unknown state %v", key)
+	}
+	if time.Since(session.lastActivity) > eapSessionTTL {
+		eapSessionExpire(key, session)
+		return "", eapSession{}, fmt.Errorf("state %v expired", key)
+	}
+	nasAddress := nasAddressOf(r)
+	callingStationId := rfc2865.CallingStationID_GetString(r.Packet)
+	switch {
+	case session.nasAddress != nasAddress || session.callingStationId != callingStationId:
+		log.Printf("[EAP session table] LOAD / key: %v / station mismatch (expected %v/%v, received %v/%v)\n", key, session.nasAddress, session.callingStationId, nasAddress, callingStationId)
+		return "", eapSession{}, fmt.Errorf("state %v is not issued to %v/%v", key, nasAddress, callingStationId)
+	case session.eapId != eapid:
+		log.Printf("[EAP session table] LOAD / key: %v / EAP-ID mismatch (expected 0x%X, received 0x%X)\n", key, session.eapId, eapid)
+		return "", eapSession{}, fmt.Errorf("eap id 0x%X does not match state %v", eapid, key)
+	}
+	if _, inFlight := eapSessionsInFlight.LoadOrStore(key, struct{}{}); inFlight {
+		log.Printf("[EAP session table] LOAD / key: %v / another Access-Request with this State is in progress\n", key)
+		return "", eapSession{}, fmt.Errorf("state %v is in progress", key)
+	}
+	log.Printf("[EAP session table] LOAD / key: %v / EAP-ID: 0x%X / value: %v\n", key, session.eapId, session.uri)
+	return key, session, nil
+}
+
+// 応答(Access-Challenge/Accept/Reject)を送信できたセッションをテーブルから削除する。以降、同じStateは使えない。
+// 送信までの間にTTLで破棄されていた場合は何もしない。
+func eapSessionConsume(key string) {
+	deleted, deleteErr := eapSessions.Delete(key)
+	if !deleted {
+		log.Printf("[EAP session table] DELETE / key: %v / already deleted\n", key)
+		return
+	}
+	if deleteErr != nil {
+		log.Printf("[EAP session table] DELETE / key: %v / persisting failed / %v\n", key, deleteErr)
+	}
+	log.Printf("[EAP session table] DELETE / key: %v\n", key)
+}
+
+// eapSessionLoadで付けた処理中の印を外す。
+func eapSessionRelease(key string) {
+	eapSessionsInFlight.Delete(key)
+}
+
+// 新規の認証を受け付けられないほどセッションテーブルが埋まっているかどうかを判定する。
+// 埋まっている場合はrejectedFullを数える。進行中のセッションの継続は、応答の送信時に1件削除するため判定の対象外とする。
+func eapSessionTableFull() bool {
+	if eapSessions.Len() < eapSessionMaxEntries {
+		return false
+	}
+	eapSessionStats.rejectedFull.Add(1)
+	return true
 }
 
-// グローバル変数eapIdTableの対象idのkey/value消し込みを実行する。
-// 引数がuint8型なのはLoadと同じ事情で、ログ出力のためsync.LoadAndDeleteを使う。
-// キーが存在するなら（valueが何であれ）削除する処理なので、型アサーションは不要。
-func eapIdTableDelete(eapid uint8) {
-	value, ok := eapIdTable.LoadAndDelete(eapid)
-	if ok {
-		log.Printf("[EAP id table] DELETE / key: 0x%X / value: %v\n", eapid, value)
-	} else {
-		log.Printf("[EAP id table] DELETE / key: 0x%X / value not found\n", eapid)
+// STAが応答しないままTTLを過ぎたセッションをテーブルから削除し、AUSFの認証コンテキストがあれば解放する。
+// スイーパーとLoadの両方から呼ばれるため、削除できた場合のみexpiredを数える。
+// クラスタ構成では全ノードが同じセッションを削除するため、解放(DELETE)はセッションを所有するノードだけが行う。
+func eapSessionExpire(key string, session eapSession) {
+	deleted, deleteErr := eapSessions.Delete(key)
+	if !deleted {
+		return
 	}
+	if deleteErr != nil {
+		log.Printf("[EAP session table] EXPIRE / key: %v / persisting failed / %v\n", key, deleteErr)
+	}
+	eapSessionStats.expired.Add(1)
+	log.Printf("[EAP session table] EXPIRE / key: %v / EAP-ID: 0x%X / NAS: %v / Calling-Station-Id: %v / started: %v / last activity: %v\n", key, session.eapId, session.nasAddress, session.callingStationId, session.createdAt.Format(time.RFC3339), session.lastActivity.Format(time.RFC3339))
+	if session.uri != "" && eapSessionOwned(session) {
+		go authContextRelease(session.uri, "session expired")
+	}
+}
+
+// セッションをこのノードが所有しているかどうかを判定する。クラスタ構成でなければ常にtrue。
+func eapSessionOwned(session eapSession) bool {
+	return clusterLocalNode == nil || clusterLocalNode.owns(session)
+}
+
+// 最後のAccess-ChallengeからeapSessionTTLを経過したセッションを定期的に削除する。main()からgoroutineで起動する。
+// 削除の遅れがTTLの半分以内に収まるよう、TTLの半分の間隔で確認する。
+func eapSessionSweeper() {
+	ticker := time.NewTicker(eapSessionTTL / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		eapSessionSweep(now)
+	}
+}
+
+// 時刻nowの時点でeapSessionTTLを経過したセッションを削除する。
+func eapSessionSweep(now time.Time) {
+	eapSessions.Range(func(key string, session eapSession) bool {
+		// 処理中のセッションは、応答の送信後に削除されるか、破棄後の次の確認で破棄する。
+		if _, inFlight := eapSessionsInFlight.Load(key); inFlight {
+			return true
+		}
+		if now.Sub(session.lastActivity) > eapSessionTTL {
+			eapSessionExpire(key, session)
+		}
+		return true
+	})
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// eapSessions/eapSessionTTLをテスト用のメモリ上の格納先に差し替える。
+func eapSessionsSetupForTest(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	savedSessions, savedTTL := eapSessions, eapSessionTTL
+	t.Cleanup(func() { eapSessions, eapSessionTTL = savedSessions, savedTTL })
+	eapSessions = newMemorySessionStore()
+	eapSessionTTL = ttl
+}
+
+// NAS 192.0.2.1からの、StateとCalling-Station-Idを持つAccess-Requestを生成する。
+func stateRequestForTest(t *testing.T, state []byte, callingStationId string) *radius.Request {
+	t.Helper()
+	packet := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	if state != nil {
+		if err := rfc2865.State_Set(packet, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rfc2865.CallingStationID_SetString(packet, callingStationId); err != nil {
+		t.Fatal(err)
+	}
+	return &radius.Request{Packet: packet, RemoteAddr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}}
+}
+
+// 破棄したAccess-Requestのセッションはテーブルに残り、NASの再送で同じ段階からやり直せる。
+func TestEapSessionRetryAfterDiscard(t *testing.T) {
+	eapSessionsSetupForTest(t, time.Minute)
+	state := []byte("0123456789abcdef")
+	r := stateRequestForTest(t, state, "02-00-00-00-00-01")
+	eapSessionStore(state, r, eapSession{eapId: 7})
+
+	key, session, err := eapSessionLoad(r, 7)
+	if err != nil || key != hex.EncodeToString(state) || session.eapId != 7 {
+		t.Fatalf("eapSessionLoad = %v, %+v, %v", key, session, err)
+	}
+	// 処理中は、同じStateのAccess-Requestを受け付けない。
+	if _, _, err := eapSessionLoad(r, 7); err == nil {
+		t.Error("State in progress loaded twice")
+	}
+	// 破棄した場合は印を外すだけで、セッションは残る。
+	eapSessionRelease(key)
+	retryKey, _, err := eapSessionLoad(r, 7)
+	if err != nil {
+		t.Fatalf("retransmission after discard: %v", err)
+	}
+	// 応答を送信したらテーブルから削除し、以降同じStateは使えない。
+	eapSessionConsume(retryKey)
+	eapSessionRelease(retryKey)
+	if _, _, err := eapSessionLoad(r, 7); err == nil {
+		t.Error("State loaded after the response was sent")
+	}
+}
+
+func TestEapSessionLoad(t *testing.T) {
+	state := []byte("0123456789abcdef")
+	tests := []struct {
+		name             string
+		state            []byte
+		nasIP            net.IP
+		callingStationId string
+		eapId            uint8
+		wantErr          bool
+	}{
+		{name: "match", state: state, callingStationId: "02-00-00-00-00-01", eapId: 7},
+		{name: "no State", callingStationId: "02-00-00-00-00-01", eapId: 7, wantErr: true},
+		{name: "unknown State", state: []byte("fedcba9876543210"), callingStationId: "02-00-00-00-00-01", eapId: 7, wantErr: true},
+		{name: "other NAS", state: state, nasIP: net.IPv4(192, 0, 2, 2), callingStationId: "02-00-00-00-00-01", eapId: 7, wantErr: true},
+		{name: "other Calling-Station-Id", state: state, callingStationId: "02-00-00-00-00-02", eapId: 7, wantErr: true},
+		{name: "EAP-ID mismatch", state: state, callingStationId: "02-00-00-00-00-01", eapId: 8, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eapSessionsSetupForTest(t, time.Minute)
+			eapSessionStore(state, stateRequestForTest(t, state, "02-00-00-00-00-01"), eapSession{eapId: 7, uri: "http://192.0.2.100/ctx"})
+			r := stateRequestForTest(t, tt.state, tt.callingStationId)
+			if tt.nasIP != nil {
+				r.RemoteAddr = &net.UDPAddr{IP: tt.nasIP, Port: 50000}
+			}
+			key, session, err := eapSessionLoad(r, tt.eapId)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("eapSessionLoad = %v, %+v, %v", key, session, err)
+			}
+			if !tt.wantErr {
+				eapSessionRelease(key)
+				if session.uri != "http://192.0.2.100/ctx" {
+					t.Errorf("session.uri = %q", session.uri)
+				}
+			}
+			// 一致しなかった場合も、正規のSTAが続行できるようエントリは残る。
+			if _, ok := eapSessions.Load(hex.EncodeToString(state)); !ok {
+				t.Error("session removed by eapSessionLoad")
+			}
+		})
+	}
+}
+
+func TestEapSessionSweep(t *testing.T) {
+	eapSessionsSetupForTest(t, time.Minute)
+	now := time.Now()
+	sessions := map[string]eapSession{
+		"fresh":     {lastActivity: now.Add(-30 * time.Second)},
+		"expired":   {lastActivity: now.Add(-2 * time.Minute)},
+		"in-flight": {lastActivity: now.Add(-2 * time.Minute)},
+	}
+	for key, session := range sessions {
+		eapSessions.Store(key, session)
+	}
+	eapSessionsInFlight.Store("in-flight", struct{}{})
+	t.Cleanup(func() { eapSessionsInFlight.Delete("in-flight") })
+	expiredBefore := eapSessionStats.expired.Load()
+
+	eapSessionSweep(now)
+	for key, want := range map[string]bool{"fresh": true, "expired": false, "in-flight": true} {
+		if _, ok := eapSessions.Load(key); ok != want {
+			t.Errorf("session %q remains = %v, want %v", key, ok, want)
+		}
+	}
+	// 処理中の印が外れれば、次の確認で削除する。
+	eapSessionsInFlight.Delete("in-flight")
+	eapSessionSweep(now)
+	if _, ok := eapSessions.Load("in-flight"); ok {
+		t.Error("expired session remains after in-flight mark was removed")
+	}
+	if expired := eapSessionStats.expired.Load() - expiredBefore; expired != 2 {
+		t.Errorf("expired = %v, want 2", expired)
+	}
+}
+
+// TTL切れのセッションは、Load時にも削除してエラーとする。
+func TestEapSessionLoadExpired(t *testing.T) {
+	eapSessionsSetupForTest(t, time.Minute)
+	state := []byte("0123456789abcdef")
+	r := stateRequestForTest(t, state, "02-00-00-00-00-01")
+	eapSessionStore(state, r, eapSession{eapId: 7})
+	session, _ := eapSessions.Load(hex.EncodeToString(state))
+	session.lastActivity = time.Now().Add(-2 * time.Minute)
+	eapSessions.Store(hex.EncodeToString(state), session)
+
+	if _, _, err := eapSessionLoad(r, 7); err == nil {
+		t.Fatal("expired session loaded")
+	}
+	if _, ok := eapSessions.Load(hex.EncodeToString(state)); ok {
+		t.Error("expired session remains")
+	}
+}
+
+// TTL切れのセッションがAUSFの認証コンテキストを持っていれば、DELETEで解放する。
+func TestEapSessionExpireReleasesAuthContext(t *testing.T) {
+	eapSessionsSetupForTest(t, time.Minute)
+	deleted := make(chan string, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			deleted <- req.URL.Path
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	sbiClientSetupForTest(t, server)
+	savedEnabled := ausfContextReleaseEnabled
+	t.Cleanup(func() { ausfContextReleaseEnabled = savedEnabled })
+	ausfContextReleaseEnabled = true
+
+	link := server.URL + "/nausf-auth/v1/ue-authentications/ctx-1/eap-session"
+	eapSessions.Store("expired", eapSession{uri: link, lastActivity: time.Now().Add(-2 * time.Minute)})
+	releasedBefore := authContextReleaseStats.released.Load()
+	eapSessionSweep(time.Now())
+	select {
+	case path := <-deleted:
+		if path != "/nausf-auth/v1/ue-authentications/ctx-1/eap-session" {
+			t.Errorf("DELETE %v", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("authentication context not released")
+	}
+	// 解放のgoroutineが終わるのを待ち、後続のテストの集計に影響しないようにする。
+	for deadline := time.Now().Add(5 * time.Second); authContextReleaseStats.released.Load() == releasedBefore; {
+		if time.Now().After(deadline) {
+			t.Fatal("release not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
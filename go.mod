@@ -1,6 +1,6 @@
-module main
+module rad5gcgw
 
-go 1.22.1
+go 1.24
 
 require (
 	github.com/google/gopacket v1.1.19
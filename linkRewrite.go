@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// ausfApiPathは初回N12_AuthenticationRequestのURLで、API rootとue-authenticationsの間に入るパス(省略時は"/nausf-auth/v1")。
+var ausfApiPath string
+
+// リンク書き換えルールの1エントリ。matchとapiRootのうち設定されている条件を全て満たすURLに適用する。
+// scheme/host/portは空(0)なら元のURLのものを残す。パスは、stripPathPrefixを取り除いてからaddPathPrefixを前に付ける。
+type linkRewriteRule struct {
+	name            string
+	match           *regexp.Regexp
+	apiRoot         string
+	scheme          string
+	host            string
+	port            int
+	stripPathPrefix string
+	addPathPrefix   string
+}
+
+// 設定ファイルから読み出したリンク書き換えルール。configure()で生成し、以後は読み出し専用で使う。
+var linkRewriteRules []linkRewriteRule
+
+// 設定ファイルのlinkRewriteRules(linkRewriteRuleConfig型のスライス)からリンク書き換えルールを生成する。
+func buildLinkRewriteRules(conf rad5gcConfig) ([]linkRewriteRule, error) {
+	var rules []linkRewriteRule
+	for i, c := range conf.ConfLinkRewriteRules {
+		if c.Match == "" && c.ApiRoot == "" {
+			return nil, fmt.Errorf("linkRewriteRules[%v]: match or apiRoot is required", i)
+		}
+		rule := linkRewriteRule{
+			name:            c.Name,
+			apiRoot:         strings.TrimSuffix(c.ApiRoot, "/"),
+			scheme:          c.Scheme,
+			host:            c.Host,
+			port:            c.Port,
+			stripPathPrefix: strings.TrimSuffix(c.StripPathPrefix, "/"),
+			addPathPrefix:   strings.TrimSuffix(c.AddPathPrefix, "/"),
+		}
+		if rule.name == "" {
+			rule.name = fmt.Sprintf("rule%v", i)
+		}
+		if c.Match != "" {
+			match, compileErr := regexp.Compile(c.Match)
+			if compileErr != nil {
+				return nil, fmt.Errorf("linkRewriteRules[%v]: invalid match / %w", i, compileErr)
+			}
+			rule.match = match
+		}
+		if schemeErr := sbiSchemeValidate(c.Scheme); schemeErr != nil {
+			return nil, fmt.Errorf("linkRewriteRules[%v]: %w", i, schemeErr)
+		}
+		if c.Port < 0 || c.Port > 65535 {
+			return nil, fmt.Errorf("linkRewriteRules[%v]: invalid port %v", i, c.Port)
+		}
+		if strings.Contains(c.Host, ":") && net.ParseIP(c.Host) == nil {
+			return nil, fmt.Errorf("linkRewriteRules[%v]: host must not include port (use port) : %v", i, c.Host)
+		}
+		for _, prefix := range []string{c.StripPathPrefix, c.AddPathPrefix} {
+			if prefix != "" && !strings.HasPrefix(prefix, "/") {
+				return nil, fmt.Errorf("linkRewriteRules[%v]: path prefix must start with \"/\" : %v", i, prefix)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ausfApiPathの書式をチェックする。空文字列は既定値を使う意味で許可する。
+func ausfApiPathValidate(path string) error {
+	if path != "" && (!strings.HasPrefix(path, "/") || strings.ContainsAny(path, "?#")) {
+		return errors.New("invalid ausfApiPath (must start with \"/\") : " + path)
+	}
+	return nil
+}
+
+// URLがこのルールの条件を満たすかどうかを判定する。apiRootは"[scheme]://[ホスト]:[ポート番号]"単位で前方一致とする。
+func (rule linkRewriteRule) matches(rawUrl string) bool {
+	if rule.apiRoot != "" && rawUrl != rule.apiRoot && !strings.HasPrefix(rawUrl, rule.apiRoot+"/") {
+		return false
+	}
+	if rule.match != nil && !rule.match.MatchString(rawUrl) {
+		return false
+	}
+	return true
+}
+
+// N12のURL(初回Requestの送信先、またはAUSFから返る_links href)に、最初に該当したリンク書き換えルールを適用する。
+// 該当するルールがない、またはURLとして解釈できない場合は元のURLをそのまま返す。
+func linkRewrite(rawUrl string) string {
+	for _, rule := range linkRewriteRules {
+		if !rule.matches(rawUrl) {
+			continue
+		}
+		linkUrl, parseErr := url.Parse(rawUrl)
+		if parseErr != nil || linkUrl.Host == "" {
+			log.Printf("[Link rewrite] invalid URL %q, not rewritten\n", rawUrl)
+			return rawUrl
+		}
+		if rule.scheme != "" {
+			linkUrl.Scheme = rule.scheme
+		}
+		host, port := linkUrl.Hostname(), linkUrl.Port()
+		if rule.host != "" {
+			host = rule.host
+		}
+		if rule.port != 0 {
+			port = strconv.Itoa(rule.port)
+		}
+		if port != "" {
+			linkUrl.Host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			linkUrl.Host = "[" + host + "]"
+		} else {
+			linkUrl.Host = host
+		}
+		path := linkUrl.Path
+		if rule.stripPathPrefix != "" && (path == rule.stripPathPrefix || strings.HasPrefix(path, rule.stripPathPrefix+"/")) {
+			path = strings.TrimPrefix(path, rule.stripPathPrefix)
+		}
+		linkUrl.Path = rule.addPathPrefix + path
+		linkUrl.RawPath = ""
+		rewritten := linkUrl.String()
+		log.Printf("[Link rewrite] %v : %v -> %v\n", rule.name, rawUrl, rewritten)
+		return rewritten
+	}
+	return rawUrl
+}
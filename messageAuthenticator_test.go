@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// Access-Requestを生成する。msgAuthが"first"/"last"ならその位置に正しいMessage-Authenticatorを、"invalid"なら誤った値を付与する。
+func msgAuthRequestForTest(t *testing.T, withEap bool, msgAuth string) *radius.Request {
+	t.Helper()
+	packet := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	if err := rfc2865.UserName_SetString(packet, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if withEap {
+		packet.Attributes.Add(79, eapResponseForTest(8))
+	}
+	switch msgAuth {
+	case "first", "invalid":
+		if ps := messageAuthenticatorSign(packet); ps.discardFlag {
+			t.Fatal(ps.errString)
+		}
+		if msgAuth == "invalid" {
+			mac, _ := packet.Attributes.Lookup(80)
+			mac[0] ^= 0xff
+		}
+	case "last":
+		packet.Attributes.Add(80, msgAuthOverwriteZero)
+		mac, _, _ := messageAuthenticatorCalc(packet, packet.Secret)
+		packet.Attributes.Set(80, mac)
+	}
+	return &radius.Request{Packet: packet}
+}
+
+func TestMessageAuthenticatorEnforce(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        msgAuthMode
+		withEap     bool
+		msgAuth     string
+		wantDiscard bool
+	}{
+		{name: "require / first", mode: msgAuthModeRequire, withEap: true, msgAuth: "first"},
+		{name: "require / last", mode: msgAuthModeRequire, withEap: true, msgAuth: "last"},
+		{name: "require / missing without EAP", mode: msgAuthModeRequire, wantDiscard: true},
+		{name: "require / invalid", mode: msgAuthModeRequire, withEap: true, msgAuth: "invalid", wantDiscard: true},
+		{name: "require-first / first", mode: msgAuthModeRequireFirst, withEap: true, msgAuth: "first"},
+		{name: "require-first / last", mode: msgAuthModeRequireFirst, withEap: true, msgAuth: "last", wantDiscard: true},
+		{name: "require-first / missing", mode: msgAuthModeRequireFirst, withEap: true, wantDiscard: true},
+		{name: "legacy / missing without EAP", mode: msgAuthModeLegacy},
+		{name: "legacy / missing with EAP", mode: msgAuthModeLegacy, withEap: true, wantDiscard: true},
+		{name: "legacy / last", mode: msgAuthModeLegacy, withEap: true, msgAuth: "last"},
+		{name: "legacy / invalid", mode: msgAuthModeLegacy, msgAuth: "invalid", wantDiscard: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := messageAuthenticatorEnforce(msgAuthRequestForTest(t, tt.withEap, tt.msgAuth), tt.mode)
+			if ps.discardFlag != tt.wantDiscard {
+				t.Errorf("discardFlag = %v (%v), want %v", ps.discardFlag, ps.errReason, tt.wantDiscard)
+			}
+		})
+	}
+}
+
+func TestMessageAuthenticatorSign(t *testing.T) {
+	// 付与済みのMessage-Authenticatorは置き換え、常に1個だけ先頭に配置する。
+	r := msgAuthRequestForTest(t, true, "last")
+	if ps := messageAuthenticatorSign(r.Packet); ps.discardFlag {
+		t.Fatal(ps.errString)
+	}
+	count := 0
+	for _, attr := range r.Packet.Attributes {
+		if attr.Type == 80 {
+			count++
+		}
+	}
+	if count != 1 || r.Packet.Attributes[0].Type != 80 {
+		t.Fatalf("attributes after signing = %v", r.Packet.Attributes)
+	}
+	if ps := messageAuthenticatorVerify(r); ps.discardFlag {
+		t.Errorf("signed packet not verified: %v", ps.errReason)
+	}
+	// 署名後にAttributeを変更すると検証に失敗する。
+	rfc2865.UserName_SetString(r.Packet, "other")
+	if ps := messageAuthenticatorVerify(r); !ps.discardFlag {
+		t.Error("modified packet verified")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc4072"
+	"layeh.com/radius/vendors/microsoft"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// kseaf : 従来動作。AUSFから返るKseaf(Hex文字列)を半分に割ってMS-MPPE-Send/Recv-Keyに入れる（無線LAN側でPMKは作れない）
+// nswo  : 3GPP Rel-17 NSWO(TS 33.501 Annex S)。初回AuthenticationRequestにnswoIndを載せ、AUSFが返すMSKからMS-MPPE鍵とEAP-Key-Nameを生成する
+var mskSource string
+
+const (
+	mskSourceKseaf = "kseaf"
+	mskSourceNswo  = "nswo"
+)
+
+// MSKの長さ(byte)。RFC 5448/9048 では64byte(Hex文字列で128文字)。
+const mskLength = 64
+
+// EAP-Request/AKA'-Challengeから、EAP-AKA'のSession-Id(0x32 || RAND || AUTN)を生成する(RFC 9048 Section 6.1)。
+// EAP-Success時のEAP-Key-Nameとして使うため、Access-Challenge送信時にEAP認証セッションへ記録しておく。
+// 引数がAKA'-Challengeでない、またはAT_RAND/AT_AUTNが見つからない場合はnilを返す。
+func eapAkaSessionId(eapPayload []byte) []byte {
+	// EAPヘッダ(4byte) + Type(1byte) + Subtype(1byte) + Reserved(2byte)の後ろにAttributeが並ぶ。
+	if len(eapPayload) < 8 || eapPayload[0] != 1 || eapPayload[4] != 50 || eapPayload[5] != 1 {
+		return nil
+	}
+	var atRand, atAutn []byte
+	attrs := eapPayload[8:]
+	for len(attrs) >= 2 {
+		attrLen := int(attrs[1]) * 4
+		if attrLen == 0 || attrLen > len(attrs) {
+			break
+		}
+		// AT_RAND(1)/AT_AUTN(2)は、Reserved(2byte)の後ろに16byteの値を持つ。
+		switch attrs[0] {
+		case 1:
+			if attrLen == 20 {
+				atRand = attrs[4:20]
+			}
+		case 2:
+			if attrLen == 20 {
+				atAutn = attrs[4:20]
+			}
+		}
+		attrs = attrs[attrLen:]
+	}
+	if atRand == nil || atAutn == nil {
+		return nil
+	}
+	sessionId := append([]byte{50}, atRand...)
+	return append(sessionId, atAutn...)
+}
+
+// EAP-Successを載せたAccess-Acceptに、鍵情報(MS-MPPE-Send/Recv-Key、EAP-Key-Name)を付与する。
+// 引数keyStrはauthRespBodyDecodeが返すKseafまたはMSK(いずれもHex文字列)、keyNameはEAP認証セッションに記録したSession-Id。
+func accessAcceptKeySet(rp *radius.Packet, keyStr string, keyName []byte) error {
+	var msMPPEsendKeySrc, msMPPErecvKeySrc []byte
+	switch mskSource {
+	case mskSourceNswo:
+		// RFC 3748/5216の慣例に従い、MSKの前半32byteをMS-MPPE-Recv-Key、後半32byteをMS-MPPE-Send-Keyとする。
+		msk, hexErr := hex.DecodeString(keyStr)
+		if hexErr != nil || len(msk) != mskLength {
+			return fmt.Errorf("invalid MSK from AUSF (length %v)", len(keyStr))
+		}
+		msMPPErecvKeySrc = msk[0:32]
+		msMPPEsendKeySrc = msk[32:64]
+		if keyName != nil {
+			if keyNameErr := rfc4072.EAPKeyName_Add(rp, keyName); keyNameErr != nil {
+				log.Printf("[RADIUS] Fail to set EAP-Key-Name / %v\n", keyNameErr)
+			}
+		} else {
+			log.Println("[RADIUS] EAP-Key-Name is not set (Session-Id not found in EAP session)")
+		}
+	default:
+		// 標準仕様上MSKではなくKseafが入るので、暫定でKseaf文字列を半分に割って32byteずつ入れる。
+		// おそらく無線LAN側でPMK作れない（mskSource: "nswo"が使えない5GC向けの旧動作として残している）
+		if len(keyStr) < 64 {
+			return errors.New("invalid Kseaf from AUSF")
+		}
+		msMPPEsendKeySrc = []byte(keyStr)[0:32]
+		msMPPErecvKeySrc = []byte(keyStr)[32:64]
+	}
+	if sendKeyErr := microsoft.MSMPPESendKey_Set(rp, msMPPEsendKeySrc); sendKeyErr != nil {
+		log.Println("[RADIUS] Fail to set MSMPPESendKey")
+	}
+	if recvKeyErr := microsoft.MSMPPERecvKey_Set(rp, msMPPErecvKeySrc); recvKeyErr != nil {
+		log.Println("[RADIUS] Fail to set MSMPPErecvKey")
+	}
+	return nil
+}
@@ -2,33 +2,36 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strings"
-	"time"
 )
 
 // ----------------------------------------
 // 初回N12_AuthenticationRequestを実行する。
 // 受信したEAP-IdentityまたはEAP-AKA' challenge(AT_IDENTITY)の実体Identityから抽出されたIMSIとNetworkNameを引数に取ることを想定している。
-// なお、設定ファイルrad5gcgwconf.yamlに記載した「ausfAddress」がここで使われる。
-func authReqFirst(imsi, nwName string) (int, string, error) {
+// 送信先は、ausfRouteSelectでIMSI/Realmから選択したルート(引数route)のAUSFプール、またはNRFで発見したAUSFから選ぶ。
+// 送信に失敗した場合はそのAUSFを異常として記録し、次の候補のAUSFへフェイルオーバーする。
+// 戻り値の3つ目は実際にResponseを受信したAUSFのアドレスで、以降のauthReqExchangeはこのAUSFの認証コンテキストを使う。
+func authReqFirst(route ausfRoute, imsi string) (int, string, string, error) {
 	log.Println("[authReqFirst] process start")
 	var processFailFlag bool = false
 	var authFirstReqErr error
-	var n12apiFirstReqUrl string = "http://" + n12AUSFaddress + "/nausf-auth/v1/ue-authentications"
+	// mskSource: "nswo" の場合は、Rel-17 NSWO(TS 29.509)のnswoIndを載せてAUSFにKseafではなくMSKを要求する。
 	var authenticationInfo struct {
 		SupiOrSuci         string `json:"supiOrSuci"`
 		ServingNetworkName string `json:"servingNetworkName"`
+		NswoInd            bool   `json:"nswoInd,omitempty"`
 	}
 	authenticationInfo.SupiOrSuci = imsi
-	authenticationInfo.ServingNetworkName = nwName
+	authenticationInfo.ServingNetworkName = route.servingNetworkName
+	authenticationInfo.NswoInd = mskSource == mskSourceNswo
 
 	// 引数とJSON用構造体からMarshalize実行して、request bodyを生成する。
 	marshalizedAuthenticationInfo, marshalizingErr := json.Marshal(authenticationInfo)
@@ -37,41 +40,66 @@ func authReqFirst(imsi, nwName string) (int, string, error) {
 		processFailFlag = true
 		log.Printf("[authReqFirst] JSON marshalizing error / %v\n", marshalizingErr)
 	}
-	firstReqBodyReader := bytes.NewReader(marshalizedAuthenticationInfo)
-
-	// HTTP Requestを生成する。
-	// 生成できたら、初回N12_AuthenticationRequestに必要なヘッダを付与する。
-	firstReq, firstRequestGenerateErr := http.NewRequestWithContext(
-		context.Background(),
-		http.MethodPost,
-		n12apiFirstReqUrl,
-		firstReqBodyReader)
-	if firstRequestGenerateErr != nil {
-		authFirstReqErr = firstRequestGenerateErr
-		processFailFlag = true
-		log.Printf("[authReqFirst] HTTP request generation error / %v\n", firstRequestGenerateErr)
-	} else {
-		firstReq.Header.Add("content-type", "application/json")
-		firstReq.Header.Add("accept", "application/3gppHal+json")
-		firstReq.Header.Add("accept", "application/problem+json")
+	var candidates []*ausfEndpoint
+	if !processFailFlag {
+		var candidatesErr error
+		candidates, candidatesErr = route.ausfCandidates(imsi)
+		if candidatesErr != nil {
+			authFirstReqErr = candidatesErr
+			processFailFlag = true
+			log.Printf("[authReqFirst] no AUSF available / %v\n", candidatesErr)
+		}
 	}
 
-	// ここまでにprocessAbortedフラグが立っていなければ、HTTPクライアントを設定してRequestを送信する。
+	// ここまでにprocessFailFlagが立っていなければ、候補順にHTTP Requestを生成して送信する。
+	// 送信先ごとにRequestを作り直すのは、送信失敗時にbodyのReaderが消費済みとなっているため。
 	var respStCode int
 	var respBodyStrings string
+	var usedAusfAddress string
 	if !processFailFlag {
-		client := http.Client{
-			Timeout: 5 * time.Second,
-		}
-		res, sendRequestErr := client.Do(firstReq)
-		log.Printf("[authReqFirst] HTTP request send (for %v)\n", authenticationInfo.SupiOrSuci)
-		// Request送信して、送信失敗ケースとResponse body読み取り失敗ケースのエラーハンドリングを実施。
-		// 正常にResponse受信してbody読み取れたら、bodyは[]byteからstringに変換して戻り値に格納する。
-		// ※この関数実施後に、ファクトリ関数authRespBodyDecodeを用いてJSON marshalize＆base64デコードを行うことを想定。
-		if sendRequestErr != nil {
-			authFirstReqErr = sendRequestErr
-			log.Printf("[authReqFirst] fail to send HTTP request / %v\n", sendRequestErr)
-		} else {
+		for _, endpoint := range candidates {
+			n12apiFirstReqUrl := linkRewrite(endpoint.apiRoot() + ausfApiPath + "/ue-authentications")
+			// HTTP Requestを生成する。
+			// 生成できたら、初回N12_AuthenticationRequestに必要なヘッダを付与する。
+			// 期限(sbiRequestTimeout)は送信先ごとに設定し、Response bodyを読み終えたらcancelする。
+			ctx, cancel := sbiRequestContext()
+			firstReq, firstRequestGenerateErr := http.NewRequestWithContext(
+				ctx,
+				http.MethodPost,
+				n12apiFirstReqUrl,
+				bytes.NewReader(marshalizedAuthenticationInfo))
+			if firstRequestGenerateErr != nil {
+				cancel()
+				authFirstReqErr = firstRequestGenerateErr
+				log.Printf("[authReqFirst] HTTP request generation error / %v\n", firstRequestGenerateErr)
+				break
+			}
+			firstReq.Header.Add("content-type", "application/json")
+			firstReq.Header.Add("accept", "application/3gppHal+json")
+			firstReq.Header.Add("accept", "application/problem+json")
+			res, sendRequestErr := n12RequestSend(sbiClient, firstReq)
+			log.Printf("[authReqFirst] HTTP request send to %v (for %v)\n", endpoint.address, authenticationInfo.SupiOrSuci)
+			// Request送信して、送信失敗ケースは次の候補へフェイルオーバーする。
+			// 正常にResponse受信してbody読み取れたら、bodyは[]byteからstringに変換して戻り値に格納する。
+			// ※この関数実施後に、ファクトリ関数authRespBodyDecodeを用いてJSON marshalize＆base64デコードを行うことを想定。
+			// アクセストークンを取得できない場合はAUSFの異常ではないため、フェイルオーバーせずにエラーとする。
+			if errors.Is(sendRequestErr, errOAuth2TokenUnavailable) {
+				cancel()
+				authFirstReqErr = sendRequestErr
+				log.Printf("[authReqFirst] fail to send HTTP request / %v\n", sendRequestErr)
+				break
+			}
+			if sendRequestErr != nil {
+				cancel()
+				authFirstReqErr = sendRequestErr
+				log.Printf("[authReqFirst] fail to send HTTP request / %v\n", sendRequestErr)
+				endpoint.setHealthy(false, sendRequestErr.Error())
+				continue
+			}
+			sbiResponseCount(res)
+			endpoint.setHealthy(true, "N12 response received")
+			authFirstReqErr = nil
+			usedAusfAddress = endpoint.address
 			resBodyBytes, readingBodyErr := io.ReadAll(res.Body)
 			if readingBodyErr != nil {
 				authFirstReqErr = readingBodyErr
@@ -85,16 +113,18 @@ func authReqFirst(imsi, nwName string) (int, string, error) {
 				log.Printf("[authReqFirst] HTTP response body reading complete (for %v)\n", authenticationInfo.SupiOrSuci)
 				res.Body.Close()
 			}
+			cancel()
+			break
 		}
 	}
-	return respStCode, respBodyStrings, authFirstReqErr
+	return respStCode, respBodyStrings, usedAusfAddress, authFirstReqErr
 }
 
 // ----------------------------------------
 // 初回以降のAuthenticationRequestで、端末からのEAP-MessageをN12 IFに載せ替えて送出するためのファクトリ関数。
-// EAP-IDに紐付いたHTTP Request送出先URIを取得しなければならないため、別ソースのファクトリ関数eapIdTableLoadを使用する。
+// HTTP Request送出先URIは、Stateに紐付いたEAP認証セッション(eapSessionLoadで取得)のものを引数n12apiExchangeUrlで受け取る。
 // なお、引数はEAP-Message（の[]byte）利用が前提のため、EAP-IDについてはRFC3748上、引数の2byte目(つまり[1])を抽出すればよい。
-func authReqExchange(eapContents []byte) (int, string, error) {
+func authReqExchange(eapContents []byte, n12apiExchangeUrl string) (int, string, error) {
 	log.Println("[authReqExchange] process start")
 	var processFailFlag bool = false
 	var authReqExchangeErr error
@@ -110,18 +140,20 @@ func authReqExchange(eapContents []byte) (int, string, error) {
 	// また、後でRequest bodyに入れ込むため、この段階でReader生成しておく。
 	reqExchangeBodyString := `{"eapPayload":"` + string(base64encodedEapMsg) + `"}`
 	reqExchangeBodyReader := bytes.NewReader([]byte(reqExchangeBodyString))
-	// EAP-IDに紐づくHTTP Request送出先URLを、EAP-ID tableから取得。
-	n12apiExchangeUrl, idExistCheck := eapIdTableLoad(eapId)
-	if !idExistCheck {
+	// Stateに紐づくEAP認証セッションがN12の認証コンテキストを持っていなければ、送信先がないのでエラーとする。
+	if n12apiExchangeUrl == "" {
 		processFailFlag = true
-		log.Println("[authReqExchange] EAP-ID not found in EAP-ID table.")
-		authReqExchangeErr = errors.New("eap id not found")
+		log.Println("[authReqExchange] N12 authentication context not found in EAP session.")
+		authReqExchangeErr = errors.New("n12 authentication context not found")
 	}
 
 	// これまでの処理で生成したBody用ReaderとRequest送信先URLを用いて、HTTP Requestを生成する。
-	// EAP-IDからRequest送信先URLを取得できていなければ、この段階でもエラー発生するはず（なのでこれもログ出力しておく）
+	// Request送信先URLが空なら、この段階でもエラー発生するはず（なのでこれもログ出力しておく）
+	// 期限(sbiRequestTimeout)はResponse bodyの読み取りまでとし、関数終了時にcancelする。
+	ctx, cancel := sbiRequestContext()
+	defer cancel()
 	reqExchange, reqExchangeErr := http.NewRequestWithContext(
-		context.Background(),
+		ctx,
 		http.MethodPost,
 		n12apiExchangeUrl,
 		reqExchangeBodyReader)
@@ -134,22 +166,24 @@ func authReqExchange(eapContents []byte) (int, string, error) {
 		reqExchange.Header.Add("accept", "application/3gppHal+json")
 		reqExchange.Header.Add("accept", "application/problem+json")
 	}
-	// ここまでにprocessFailFlagが立っていなければ、HTTPクライアントを設定してRequestを送信する。
+	// ここまでにprocessFailFlagが立っていなければ、共有のHTTPクライアント(sbiClient)でRequestを送信する。
 	var respStCode int
 	var respBodyStrings string
 	if !processFailFlag {
-		client := http.Client{
-			Timeout: 5 * time.Second,
-		}
-		res, sendRequestErr := client.Do(reqExchange)
+		res, sendRequestErr := n12RequestSend(sbiClient, reqExchange)
 		log.Printf("[authReqExchange] HTTP request send (for EAP-ID 0x%X from STA)\n", eapId)
 		// Request送信して、送信失敗ケースとResponse body読み取り失敗ケースのエラーハンドリングを実施。
 		// 正常にResponse受信してbody読み取れたら、bodyは[]byteからstringに変換して戻り値に格納する。
 		// ※この関数実施後に、ファクトリ関数authRespBodyDecodeを用いてJSON marshalize＆base64デコードを行うことを想定。
+		// 認証コンテキストは初回Requestを受けたAUSFにしかないため、送信に失敗しても他のAUSFへはフェイルオーバーしない。
 		if sendRequestErr != nil {
 			authReqExchangeErr = sendRequestErr
 			log.Printf("[authReqExchange] fail to send HTTP request / %v\n", sendRequestErr)
+			if !errors.Is(sendRequestErr, errOAuth2TokenUnavailable) {
+				ausfEndpointMarkFailed(reqExchange.URL.Host, sendRequestErr.Error())
+			}
 		} else {
+			sbiResponseCount(res)
 			resBodyBytes, readingBodyErr := io.ReadAll(res.Body)
 			if readingBodyErr != nil {
 				authReqExchangeErr = readingBodyErr
@@ -172,7 +206,7 @@ func authReqExchange(eapContents []byte) (int, string, error) {
 // 上記2つのファクトリ関数で得たResponse body(string)から、Radiusで返すEAP-Message等を抽出するファクトリ関数。
 // 引数に「ステータスコード(stCode int)」と「ボディ文字列(respBodyStr string:JSON想定)」を取る。
 // （ステータスコードによりJSONフォーマットが変わるため）
-// 戻り値は「EAPpayload([]byte)」と「EAP-ID(uint8)」と「str(_linkかcause)」と「エラー」となっている。
+// 戻り値は「EAPpayload([]byte)」と「EAP-ID(uint8)」と「str(_link・Kseaf・MSK・cause等)」と「エラー」となっている。
 // これは関数実行後に、戻り値のEAP-IDとlinkを用いてEAP-ID tableに利用中ID＆Linkを書き込む流れになることを想定している。
 func authRespBodyDecode(stCode int, respBodyStr string) ([]byte, uint8, string, error) {
 	var eapPayload []byte
@@ -185,6 +219,30 @@ func authRespBodyDecode(stCode int, respBodyStr string) ([]byte, uint8, string,
 		// EAP-Success/EAP-Failure/EAPセッション継続の3パターンが存在し、それぞれJSONフォーマットが異なる。
 		log.Printf("[Rad-5GC GW] Status Code %v : decoding response body...\n", stCode)
 		switch {
+		case strings.Contains(respBodyStr, `"msk"`):
+			// NSWO(nswoInd)で認証した場合のEAP-Success。KseafではなくMSK(Hex文字列)が返る。
+			type eapSuccessNswoJson struct {
+				EapPayload string `json:"eapPayload"`
+				Msk        string `json:"msk"`
+			}
+			decodedArg := eapSuccessNswoJson{}
+			decoder := json.NewDecoder(strings.NewReader(respBodyStr))
+			jsonDecodeErr := decoder.Decode(&decodedArg)
+			if jsonDecodeErr != nil {
+				authRespDecodeErr = jsonDecodeErr
+				log.Printf("[Rad-5GC GW] Status Code %v : response body JSON decoding error / %v\n", stCode, jsonDecodeErr)
+				log.Printf("[Rad-5GC GW] Status Code %v : response body(error) : %v\n", stCode, respBodyStr)
+			} else {
+				bhDecodedData, pickedEapId, bhDecodingErr := base64AndHexDecode(stCode, decodedArg.EapPayload)
+				if bhDecodingErr != nil {
+					authRespDecodeErr = bhDecodingErr
+				} else {
+					eapPayload = bhDecodedData
+					eapId = pickedEapId
+					resultStr = decodedArg.Msk
+					log.Printf("[Rad-5GC GW] Status Code %v (EAP-Success / NSWO) : decode success.\n", stCode)
+				}
+			}
 		case strings.Contains(respBodyStr, "kSeaf"):
 			type eapSuccessJson struct {
 				EapPayload string `json:"eapPayload"`
@@ -308,16 +366,32 @@ func authRespBodyDecode(stCode int, respBodyStr string) ([]byte, uint8, string,
 	return eapPayload, eapId, resultStr, authRespDecodeErr
 }
 
+// EAP-Success時のResponse body(200)から、AUSFが返すsupiを抽出する。
+// AccountingやCoA等でSTAとSUPIを紐付けるために使う。supiが含まれていなければ""を返す。
+func authRespSupiPick(respBodyStr string) string {
+	var supiJson struct {
+		Supi string `json:"supi"`
+	}
+	decoder := json.NewDecoder(strings.NewReader(respBodyStr))
+	if jsonDecodeErr := decoder.Decode(&supiJson); jsonDecodeErr != nil {
+		log.Printf("[Rad-5GC GW] supi decoding error / %v\n", jsonDecodeErr)
+	}
+	return supiJson.Supi
+}
+
 // ファクトリ関数authRespBodyDecodeで必要な処理のうち、base64デコード＋Hex文字列byte化の部分を切り出して関数化した。
 // 引数はint(ステータスコード)とstring(JSONデコード後のdecodedArg.5gAuthDataまたはdecodedArg.EapPayloadを想定)とする。
 // 引数でステータスコードを取るのは、ログ出力に作業対象responseのステータスコードを明記したいため。
 // 戻り値は、Hex文字列をbyte化した[]byte型・eapIdを想定したbyte型・エラー型とする。
+// 4byte未満でEAPパケットとして扱えない場合はエラーを返す。
 func base64AndHexDecode(stCode int, str string) ([]byte, uint8, error) {
 	var payloadBytes []byte
 	var eapId uint8
 	var decodeErr error
 	sixFourDecodedbytes := make([]byte, base64.StdEncoding.DecodedLen(len(str)))
-	_, sixFourDecodeErr := base64.StdEncoding.Decode(sixFourDecodedbytes, []byte(str))
+	// DecodedLenはパディング分を含む最大長のため、実際にデコードした長さで切り詰める。
+	sixFourDecodedLen, sixFourDecodeErr := base64.StdEncoding.Decode(sixFourDecodedbytes, []byte(str))
+	sixFourDecodedbytes = sixFourDecodedbytes[:sixFourDecodedLen]
 	if sixFourDecodeErr != nil {
 		decodeErr = sixFourDecodeErr
 		log.Printf("[Rad-5GC GW] Status Code %v : base64 decoding error / %v\n", stCode, sixFourDecodeErr)
@@ -327,6 +401,10 @@ func base64AndHexDecode(stCode int, str string) ([]byte, uint8, error) {
 		if hexToByteErr != nil {
 			decodeErr = hexToByteErr
 			log.Printf("[Rad-5GC GW] Status Code %v : base64-decoded data cannot change from hex string to byte slice / %v\n", stCode, hexToByteErr)
+		} else if len(hexDecodedBytes) < 4 {
+			// 呼び出し元はCode(先頭byte)で分岐するため、EAPヘッダ(Code/Identifier/Length)に満たないものはエラーとする。
+			decodeErr = fmt.Errorf("EAP payload too short (%v bytes)", len(hexDecodedBytes))
+			log.Printf("[Rad-5GC GW] Status Code %v : %v\n", stCode, decodeErr)
 		} else {
 			payloadBytes = hexDecodedBytes
 			eapId = hexDecodedBytes[1]
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestBase64AndHexDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    []byte
+		wantId  uint8
+		wantErr bool
+	}{
+		{name: "EAP-Success", str: base64.StdEncoding.EncodeToString([]byte("03070004")), want: []byte{3, 7, 0, 4}, wantId: 7},
+		{name: "empty", str: "", wantErr: true},
+		{name: "shorter than EAP header", str: base64.StdEncoding.EncodeToString([]byte("0307")), wantErr: true},
+		{name: "not hex", str: base64.StdEncoding.EncodeToString([]byte("zz070004")), wantErr: true},
+		{name: "not base64", str: "!!!!", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, eapId, err := base64AndHexDecode(200, tt.str)
+			if (err != nil) != tt.wantErr || !bytes.Equal(payload, tt.want) || eapId != tt.wantId {
+				t.Errorf("base64AndHexDecode(%q) = %v, %v, %v", tt.str, payload, eapId, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// NAI(RFC 7542)の最大長(octet)。
+const naiMaxLength = 253
+
+// EAP Identityの解析エラー。Access-RejectのReply-Messageに載せるため、どの部分がなぜ不正かを保持する。
+type identityError struct {
+	part   string
+	reason string
+}
+
+func (e *identityError) Error() string {
+	return e.part + ": " + e.reason
+}
+
+// RFC 7542のNAIを分解した結果。
+// decorated NAI("homerealm!user@visited")の場合、usernameは"!"より後ろ、homeRealmは"!"より前のRealmとなる。
+type nai struct {
+	username  string
+	realm     string
+	homeRealm string
+}
+
+// RFC 7542に従ってNAIを分解・検証する。Realmは省略可("user"のみ)とし、ユーザ名部分も"@realm"のみの場合は空となる。
+func parseNai(identity string) (nai, error) {
+	var n nai
+	if identity == "" {
+		return n, &identityError{part: "identity", reason: "empty"}
+	}
+	if len(identity) > naiMaxLength {
+		return n, &identityError{part: "identity", reason: fmt.Sprintf("too long (%v octets)", len(identity))}
+	}
+	if !utf8.ValidString(identity) {
+		return n, &identityError{part: "identity", reason: "invalid UTF-8"}
+	}
+	for _, c := range identity {
+		if c <= 0x20 || c == 0x7f {
+			return n, &identityError{part: "identity", reason: fmt.Sprintf("invalid character %q", c)}
+		}
+	}
+	username, realm, hasRealm := strings.Cut(identity, "@")
+	if hasRealm {
+		if realmErr := naiRealmValidate(realm); realmErr != nil {
+			return n, &identityError{part: "realm", reason: realmErr.Error()}
+		}
+		n.realm = realm
+	}
+	if home, user, decorated := strings.Cut(username, "!"); decorated {
+		if strings.Contains(user, "!") {
+			return n, &identityError{part: "username", reason: "nested decoration is not supported"}
+		}
+		if realmErr := naiRealmValidate(home); realmErr != nil {
+			return n, &identityError{part: "home realm", reason: realmErr.Error()}
+		}
+		n.homeRealm = home
+		username = user
+	}
+	if strings.HasPrefix(username, ".") || strings.HasSuffix(username, ".") || strings.Contains(username, "..") {
+		return n, &identityError{part: "username", reason: "invalid dot position"}
+	}
+	n.username = username
+	return n, nil
+}
+
+// Realmの各ラベルをチェックする(RFC 7542 2.2)。ラベルは1～63文字で、英数字とハイフン(非ASCII文字も許可)からなり、先頭と末尾はハイフン以外。
+func naiRealmValidate(realm string) error {
+	if realm == "" {
+		return fmt.Errorf("empty")
+	}
+	for _, label := range strings.Split(realm, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid label length in %q", realm)
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("label %q starts or ends with hyphen", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c >= 0x80) {
+				return fmt.Errorf("invalid character %q in label %q", c, label)
+			}
+		}
+	}
+	return nil
+}
+
+// EAP-Response/AKA-IdentityのTypeData(Subtype・Reserved・Attribute)からAT_IDENTITY(14)のIdentityを取り出す(RFC 4187 10.5)。
+// AT_IDENTITYはType(1byte)・Length(1byte、4byte単位)・Actual Identity Length(2byte)・Identity(パディングあり)の順に並ぶ。
+func eapAkaAtIdentity(typeData []byte) (string, error) {
+	if len(typeData) < 3 {
+		return "", &identityError{part: "AT_IDENTITY", reason: "EAP-Response/AKA-Identity too short"}
+	}
+	attrs := typeData[3:]
+	for len(attrs) >= 2 {
+		attrLen := int(attrs[1]) * 4
+		if attrLen == 0 || attrLen > len(attrs) {
+			return "", &identityError{part: "AT_IDENTITY", reason: "invalid attribute length"}
+		}
+		if attrs[0] == 14 {
+			if attrLen < 4 {
+				return "", &identityError{part: "AT_IDENTITY", reason: "invalid attribute length"}
+			}
+			actualLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+			if 4+actualLen > attrLen {
+				return "", &identityError{part: "AT_IDENTITY", reason: fmt.Sprintf("actual identity length %v exceeds attribute", actualLen)}
+			}
+			return string(attrs[4 : 4+actualLen]), nil
+		}
+		attrs = attrs[attrLen:]
+	}
+	return "", &identityError{part: "AT_IDENTITY", reason: "not found"}
+}
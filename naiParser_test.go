@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseNai(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity string
+		want     nai
+		wantPart string // エラーの場合のidentityError.part
+	}{
+		{name: "permanent identity", identity: "0001010000000001@wlan.mnc001.mcc001.3gppnetwork.org",
+			want: nai{username: "0001010000000001", realm: "wlan.mnc001.mcc001.3gppnetwork.org"}},
+		{name: "non-wlan realm", identity: "6001010000000001@ims.mnc123.mcc310.3gppnetwork.org",
+			want: nai{username: "6001010000000001", realm: "ims.mnc123.mcc310.3gppnetwork.org"}},
+		{name: "no realm", identity: "user", want: nai{username: "user"}},
+		{name: "realm only", identity: "@wlan.mnc001.mcc001.3gppnetwork.org", want: nai{realm: "wlan.mnc001.mcc001.3gppnetwork.org"}},
+		{name: "decorated", identity: "wlan.mnc001.mcc001.3gppnetwork.org!0001010000000001@visited.example.net",
+			want: nai{username: "0001010000000001", realm: "visited.example.net", homeRealm: "wlan.mnc001.mcc001.3gppnetwork.org"}},
+		{name: "internationalized realm", identity: "user@例え.jp", want: nai{username: "user", realm: "例え.jp"}},
+		{name: "empty", identity: "", wantPart: "identity"},
+		{name: "too long", identity: "user@" + strings.Repeat("a.", 125) + "jp", wantPart: "identity"},
+		{name: "space", identity: "us er@example.net", wantPart: "identity"},
+		{name: "invalid UTF-8", identity: "user@\xff.example.net", wantPart: "identity"},
+		{name: "empty realm", identity: "user@", wantPart: "realm"},
+		{name: "empty label", identity: "user@example..net", wantPart: "realm"},
+		{name: "hyphen label", identity: "user@-example.net", wantPart: "realm"},
+		{name: "label too long", identity: "user@" + strings.Repeat("a", 64) + ".net", wantPart: "realm"},
+		{name: "invalid realm character", identity: "user@exa_mple.net", wantPart: "realm"},
+		{name: "nested decoration", identity: "a.example!b.example!user@visited.example", wantPart: "username"},
+		{name: "invalid home realm", identity: "!user@visited.example", wantPart: "home realm"},
+		{name: "leading dot", identity: ".user@example.net", wantPart: "username"},
+		{name: "double dot", identity: "us..er@example.net", wantPart: "username"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNai(tt.identity)
+			if tt.wantPart != "" {
+				var idErr *identityError
+				if !errors.As(err, &idErr) || idErr.part != tt.wantPart {
+					t.Fatalf("parseNai(%q) error = %v, want identityError in %q", tt.identity, err, tt.wantPart)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseNai(%q) error = %v", tt.identity, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseNai(%q) = %+v, want %+v", tt.identity, got, tt.want)
+			}
+		})
+	}
+}
+
+// AT_IDENTITY(Type 14)を生成する。Identityは4byte境界までパディングする。
+func atIdentityForTest(identity string, actualLen int) []byte {
+	padded := (len(identity) + 3) / 4 * 4
+	attr := make([]byte, 4+padded)
+	attr[0] = 14
+	attr[1] = byte(len(attr) / 4)
+	binary.BigEndian.PutUint16(attr[2:4], uint16(actualLen))
+	copy(attr[4:], identity)
+	return attr
+}
+
+func TestEapAkaAtIdentity(t *testing.T) {
+	// Subtype(5: AKA-Identity)とReserved(2byte)。
+	header := []byte{0x05, 0x00, 0x00}
+	identity15 := "0001010000000001@wlan.mnc001.mcc001.3gppnetwork.org"
+	identity16 := "60010100000000012@wlan.mnc01.mcc001.3gppnetwork.org"
+	otherAttr := []byte{0x0b, 0x01, 0x00, 0x00}
+	tests := []struct {
+		name     string
+		typeData []byte
+		want     string
+		wantErr  bool
+	}{
+		{name: "padded identity", typeData: append(append([]byte{}, header...), atIdentityForTest(identity15, len(identity15))...), want: identity15},
+		{name: "aligned identity", typeData: append(append([]byte{}, header...), atIdentityForTest(identity16, len(identity16))...), want: identity16},
+		{name: "after other attribute", typeData: append(append(append([]byte{}, header...), otherAttr...), atIdentityForTest("user", 4)...), want: "user"},
+		{name: "actual length exceeds attribute", typeData: append(append([]byte{}, header...), atIdentityForTest("user", 9)...), wantErr: true},
+		{name: "zero attribute length", typeData: append(append([]byte{}, header...), 0x0e, 0x00, 0x00, 0x04), wantErr: true},
+		{name: "attribute length exceeds data", typeData: append(append([]byte{}, header...), 0x0e, 0x03, 0x00, 0x04, 'u', 's', 'e', 'r'), wantErr: true},
+		{name: "not found", typeData: append(append([]byte{}, header...), otherAttr...), wantErr: true},
+		{name: "too short", typeData: []byte{0x05}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := eapAkaAtIdentity(tt.typeData)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("identity = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// nrfApiRootが空文字列ならNRFによるAUSFの発見(Nnrf_NFDiscovery)は行わない。
+// nrfRoutingIndicatorは既定ルートでNRFに問い合わせる際のRouting Indicator(空なら条件にしない)。
+var nrfApiRoot string
+var nrfRequesterNfType string
+var nrfRoutingIndicator string
+
+// NRFのSearchResultにvalidityPeriodがない場合のキャッシュ保持時間。
+const nrfDefaultValidityPeriod = 60 * time.Second
+
+// Nnrf_NFDiscoveryのSearchResult(TS 29.510)のうち、AUSFの選択に必要な項目のみを定義している。
+type nrfSearchResult struct {
+	ValidityPeriod int                `json:"validityPeriod"`
+	NfInstances    []nrfNFProfileAusf `json:"nfInstances"`
+}
+
+type nrfNFProfileAusf struct {
+	NfInstanceId  string   `json:"nfInstanceId"`
+	NfType        string   `json:"nfType"`
+	NfStatus      string   `json:"nfStatus"`
+	Ipv4Addresses []string `json:"ipv4Addresses"`
+	Priority      int      `json:"priority"`
+	Capacity      int      `json:"capacity"`
+	AusfInfo      struct {
+		SupiRanges []struct {
+			Start   string `json:"start"`
+			End     string `json:"end"`
+			Pattern string `json:"pattern"`
+		} `json:"supiRanges"`
+		RoutingIndicators []string `json:"routingIndicators"`
+	} `json:"ausfInfo"`
+	NfServices []struct {
+		ServiceName string `json:"serviceName"`
+		Scheme      string `json:"scheme"`
+		ApiPrefix   string `json:"apiPrefix"`
+		IpEndPoints []struct {
+			Ipv4Address string `json:"ipv4Address"`
+			Port        int    `json:"port"`
+		} `json:"ipEndPoints"`
+	} `json:"nfServices"`
+}
+
+// NRFで発見したAUSFインスタンス1台分のSUPI範囲。startとendは同じ桁数の数字列で、patternは正規表現。
+type nrfSupiRange struct {
+	start   string
+	end     string
+	pattern *regexp.Regexp
+}
+
+// 1つの検索条件(PLMN・Routing Indicator)に対するNRFの検索結果のキャッシュ。
+// poolは発見したAUSFのプールで、supiRangesはアドレスごとのSUPI範囲(ausfInfo.supiRanges。なければ全SUPIが対象)。
+type nrfDiscoveryEntry struct {
+	pool       *ausfPool
+	supiRanges map[string][]nrfSupiRange
+	expiresAt  time.Time
+}
+
+// NRFの検索結果のキャッシュ本体。キーはnrfDiscoveryKey()で生成する文字列。
+var nrfDiscoveryCache = struct {
+	mu    sync.Mutex
+	table map[string]*nrfDiscoveryEntry
+}{table: map[string]*nrfDiscoveryEntry{}}
+
+func nrfDiscoveryKey(mcc, mnc, routingIndicator string) string {
+	return mcc + "-" + mnc + "/" + routingIndicator
+}
+
+// realm("wlan.mnc001.mcc001.3gppnetwork.org")からMCC/MNCを取り出す。MNCはTS 23.003に従い、先頭の0を補った3桁から2桁に戻す。
+var realmPlmnPattern = regexp.MustCompile(`mnc(\d{3})\.mcc(\d{3})\.3gppnetwork\.org$`)
+
+func plmnFromRealm(realm string) (string, string, bool) {
+	matched := realmPlmnPattern.FindStringSubmatch(realm)
+	if matched == nil {
+		return "", "", false
+	}
+	return matched[2], strings.TrimPrefix(matched[1], "0"), true
+}
+
+// SUPI("imsi-"付き)またはSUCIを担当するAUSFの送信先候補を、NRFの検索結果(キャッシュ)から返す。
+// キャッシュがない、またはvalidityPeriodを過ぎていればNRFへ問い合わせる。問い合わせに失敗した場合は、期限切れのキャッシュがあればそれを使う。
+func nrfAusfCandidates(mcc, mnc, routingIndicator, supi string) ([]*ausfEndpoint, error) {
+	key := nrfDiscoveryKey(mcc, mnc, routingIndicator)
+	nrfDiscoveryCache.mu.Lock()
+	entry, cached := nrfDiscoveryCache.table[key]
+	nrfDiscoveryCache.mu.Unlock()
+	if !cached || time.Now().After(entry.expiresAt) {
+		discovered, discoveryErr := nrfDiscoverAusf(mcc, mnc, routingIndicator)
+		switch {
+		case discoveryErr == nil:
+			entry = discovered
+			nrfDiscoveryCache.mu.Lock()
+			nrfDiscoveryCache.table[key] = entry
+			nrfDiscoveryCache.mu.Unlock()
+		case cached:
+			log.Printf("[NRF] discovery failed, keep using expired result for %v / %v\n", key, discoveryErr)
+		default:
+			return nil, discoveryErr
+		}
+	}
+	// ausfInfo.supiRangesを持つAUSFは、範囲内のSUPIのみを担当する。SUCIはSUPIが分からないため範囲では絞り込まない。
+	imsi, isImsi := strings.CutPrefix(supi, "imsi-")
+	var candidates []*ausfEndpoint
+	for _, endpoint := range entry.pool.candidates() {
+		ranges := entry.supiRanges[endpoint.address]
+		if len(ranges) == 0 || !isImsi {
+			candidates = append(candidates, endpoint)
+			continue
+		}
+		for _, r := range ranges {
+			if r.contains(imsi) {
+				candidates = append(candidates, endpoint)
+				break
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no AUSF discovered for %v (%v)", supi, key)
+	}
+	return candidates, nil
+}
+
+func (r nrfSupiRange) contains(imsi string) bool {
+	if r.pattern != nil {
+		return r.pattern.MatchString(imsi)
+	}
+	return len(imsi) == len(r.start) && r.start <= imsi && imsi <= r.end
+}
+
+// NRFへNnrf_NFDiscovery(GET /nnrf-disc/v1/nf-instances)を送信し、AUSFの検索結果からプールを生成する。
+func nrfDiscoverAusf(mcc, mnc, routingIndicator string) (*nrfDiscoveryEntry, error) {
+	query := url.Values{}
+	query.Set("target-nf-type", "AUSF")
+	query.Set("requester-nf-type", nrfRequesterNfType)
+	query.Set("service-names", "nausf-auth")
+	if mcc != "" {
+		targetPlmn, _ := json.Marshal([]map[string]string{{"mcc": mcc, "mnc": mnc}})
+		query.Set("target-plmn-list", string(targetPlmn))
+	}
+	if routingIndicator != "" {
+		query.Set("routing-indicator", routingIndicator)
+	}
+	discoveryUrl := strings.TrimSuffix(nrfApiRoot, "/") + "/nnrf-disc/v1/nf-instances?" + query.Encode()
+	// NRFへの問い合わせもN12と同じsbiClient(SBIのCA/クライアント証明書、接続の使い回し)を使い、期限はsbiRequestTimeoutとする。
+	ctx, cancel := sbiRequestContext()
+	defer cancel()
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, discoveryUrl, nil)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	req.Header.Add("accept", "application/json")
+	req.Header.Add("accept", "application/problem+json")
+	log.Printf("[NRF] NFDiscovery request send : %v\n", discoveryUrl)
+	res, sendErr := sbiClient.Do(req)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	defer res.Body.Close()
+	sbiResponseCount(res)
+	body, readErr := io.ReadAll(res.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("NFDiscovery failed / STATUS: %v / %v", res.Status, string(body))
+	}
+	var result nrfSearchResult
+	if decodeErr := json.Unmarshal(body, &result); decodeErr != nil {
+		return nil, decodeErr
+	}
+	entry := &nrfDiscoveryEntry{
+		pool:       &ausfPool{},
+		supiRanges: map[string][]nrfSupiRange{},
+		expiresAt:  time.Now().Add(nrfDefaultValidityPeriod),
+	}
+	if result.ValidityPeriod > 0 {
+		entry.expiresAt = time.Now().Add(time.Duration(result.ValidityPeriod) * time.Second)
+	}
+	for _, profile := range result.NfInstances {
+		if profile.NfType != "AUSF" || (profile.NfStatus != "" && profile.NfStatus != "REGISTERED") {
+			continue
+		}
+		scheme, address, addrErr := nrfProfileAddress(profile)
+		if addrErr != nil {
+			log.Printf("[NRF] NF instance %v skipped / %v\n", profile.NfInstanceId, addrErr)
+			continue
+		}
+		// NFプロファイルのcapacityを重み付きラウンドロビンの重みとして使う。
+		weight := profile.Capacity
+		if weight <= 0 {
+			weight = 1
+		}
+		entry.pool.members = append(entry.pool.members, &ausfPoolMember{endpoint: ausfEndpointGet(scheme, address), weight: weight})
+		for _, r := range profile.AusfInfo.SupiRanges {
+			supiRange := nrfSupiRange{start: r.Start, end: r.End}
+			if r.Pattern != "" {
+				pattern, patternErr := regexp.Compile(r.Pattern)
+				if patternErr != nil {
+					log.Printf("[NRF] NF instance %v invalid supiRanges pattern %q / %v\n", profile.NfInstanceId, r.Pattern, patternErr)
+					continue
+				}
+				supiRange.pattern = pattern
+			}
+			entry.supiRanges[address] = append(entry.supiRanges[address], supiRange)
+		}
+		log.Printf("[NRF] AUSF discovered : %v (%v://%v, capacity: %v)\n", profile.NfInstanceId, scheme, address, weight)
+	}
+	if len(entry.pool.members) == 0 {
+		return nil, errors.New("no AUSF instance in NFDiscovery result")
+	}
+	return entry, nil
+}
+
+// NFプロファイルからnausf-authのschemeと送信先("[ホスト]:[ポート番号]")を取り出す。
+// nfServicesのapiPrefix → ipEndPoints → プロファイルのipv4Addressesの順に使う。schemeはNFServiceのscheme(なければausfScheme)。
+func nrfProfileAddress(profile nrfNFProfileAusf) (string, string, error) {
+	for _, service := range profile.NfServices {
+		if service.ServiceName != "nausf-auth" {
+			continue
+		}
+		scheme := sbiSchemeOf(service.Scheme, ausfScheme)
+		defaultPort := "80"
+		if scheme == sbiSchemeHttps {
+			defaultPort = "443"
+		}
+		if service.ApiPrefix != "" {
+			prefixUrl, parseErr := url.Parse(service.ApiPrefix)
+			if parseErr == nil && prefixUrl.Host != "" {
+				if prefixUrl.Scheme == sbiSchemeHttps || prefixUrl.Scheme == sbiSchemeHttp {
+					scheme = prefixUrl.Scheme
+				}
+				if prefixUrl.Port() == "" {
+					return scheme, net.JoinHostPort(prefixUrl.Hostname(), defaultPort), nil
+				}
+				return scheme, prefixUrl.Host, nil
+			}
+		}
+		for _, ep := range service.IpEndPoints {
+			if ep.Ipv4Address == "" {
+				continue
+			}
+			port := defaultPort
+			if ep.Port != 0 {
+				port = strconv.Itoa(ep.Port)
+			}
+			return scheme, net.JoinHostPort(ep.Ipv4Address, port), nil
+		}
+	}
+	if len(profile.Ipv4Addresses) > 0 {
+		scheme := sbiSchemeOf(ausfScheme)
+		port := "80"
+		if scheme == sbiSchemeHttps {
+			port = "443"
+		}
+		return scheme, net.JoinHostPort(profile.Ipv4Addresses[0], port), nil
+	}
+	return "", "", errors.New("no nausf-auth endpoint in NF profile")
+}
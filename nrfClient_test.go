@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// httptestのTLSサーバの証明書をCAとしたsbiClientを用意する(運用者CAで署名されたNRF/AUSFを想定)。
+// 変更したグローバル変数はテスト終了時に元に戻す。
+func sbiClientSetupForTest(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	caFile := filepath.Join(t.TempDir(), "sbi-ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if writeErr := os.WriteFile(caFile, caPEM, 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	savedClient, savedStore, savedTimeout, savedVersion := sbiClient, sbiCertStore, sbiRequestTimeout, sbiHttpVersion
+	t.Cleanup(func() {
+		sbiClient, sbiCertStore, sbiRequestTimeout, sbiHttpVersion = savedClient, savedStore, savedTimeout, savedVersion
+	})
+	sbiRequestTimeout = 5 * time.Second
+	sbiHttpVersion = sbiHttpVersion1
+	sbiCertStore = &sbiTlsCertStore{caFile: caFile}
+	sbiClient = newSbiClient(sbiCertStore)
+}
+
+// AUSF 3台分のSearchResult。ausf-aはSUPI範囲(start/end)、ausf-bはSUPI範囲(pattern)を持ち、ausf-cは登録停止中。
+const nrfTestSearchResult = `{
+  "validityPeriod": 120,
+  "nfInstances": [
+    {"nfInstanceId": "ausf-a", "nfType": "AUSF", "nfStatus": "REGISTERED", "capacity": 2,
+     "ausfInfo": {"supiRanges": [{"start": "001010000000000", "end": "001010000000499"}]},
+     "nfServices": [{"serviceName": "nausf-auth", "scheme": "https", "ipEndPoints": [{"ipv4Address": "192.0.2.1", "port": 8443}]}]},
+    {"nfInstanceId": "ausf-b", "nfType": "AUSF", "nfStatus": "REGISTERED",
+     "ausfInfo": {"supiRanges": [{"pattern": "^0010100000005[0-9]{2}$"}]},
+     "nfServices": [{"serviceName": "nausf-auth", "apiPrefix": "https://192.0.2.2:8443"}]},
+    {"nfInstanceId": "ausf-c", "nfType": "AUSF", "nfStatus": "SUSPENDED", "ipv4Addresses": ["192.0.2.3"]}
+  ]
+}`
+
+func TestNrfAusfCandidates(t *testing.T) {
+	var requests atomic.Int32
+	var failing atomic.Bool
+	nrf := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		query := r.URL.Query()
+		if r.URL.Path != "/nnrf-disc/v1/nf-instances" || query.Get("target-nf-type") != "AUSF" || query.Get("routing-indicator") != "0012" {
+			t.Errorf("unexpected NFDiscovery request : %v", r.URL)
+		}
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write([]byte(nrfTestSearchResult))
+	}))
+	defer nrf.Close()
+	sbiClientSetupForTest(t, nrf)
+	savedApiRoot, savedNfType := nrfApiRoot, nrfRequesterNfType
+	t.Cleanup(func() { nrfApiRoot, nrfRequesterNfType = savedApiRoot, savedNfType })
+	nrfApiRoot = nrf.URL
+	nrfRequesterNfType = "AMF"
+	nrfDiscoveryCache.mu.Lock()
+	nrfDiscoveryCache.table = map[string]*nrfDiscoveryEntry{}
+	nrfDiscoveryCache.mu.Unlock()
+
+	// supiRangesによる絞り込み。SUCIはSUPIが分からないため絞り込まない。
+	tests := []struct {
+		name    string
+		supi    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "start/end range", supi: "imsi-001010000000123", want: []string{"192.0.2.1:8443"}},
+		{name: "pattern range", supi: "imsi-001010000000555", want: []string{"192.0.2.2:8443"}},
+		{name: "out of all ranges", supi: "imsi-001010000000999", wantErr: true},
+		{name: "different length", supi: "imsi-00101000000012", wantErr: true},
+		{name: "SUCI", supi: "suci-0-001-01-0012-0-0-0000000123", want: []string{"192.0.2.1:8443", "192.0.2.2:8443"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates, err := nrfAusfCandidates("001", "01", "0012", tt.supi)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", candidates)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range candidates {
+				if c.scheme != sbiSchemeHttps {
+					t.Errorf("%v: scheme = %v, want https", c.address, c.scheme)
+				}
+				got = append(got, c.address)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("candidates = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// validityPeriodの間はキャッシュを使い、NRFへは1回しか問い合わせない。
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("NFDiscovery requests = %v, want 1", n)
+	}
+	key := nrfDiscoveryKey("001", "01", "0012")
+	nrfDiscoveryCache.mu.Lock()
+	entry := nrfDiscoveryCache.table[key]
+	nrfDiscoveryCache.mu.Unlock()
+	if remaining := time.Until(entry.expiresAt); remaining < 110*time.Second || remaining > 120*time.Second {
+		t.Errorf("cache expires in %v, want about validityPeriod (120s)", remaining)
+	}
+
+	// validityPeriodを過ぎたら問い合わせ直し、NRFが応答しなければ期限切れのキャッシュを使い続ける。
+	entry.expiresAt = time.Now().Add(-time.Second)
+	failing.Store(true)
+	if _, err := nrfAusfCandidates("001", "01", "0012", "imsi-001010000000123"); err != nil {
+		t.Errorf("expired cache not used on NRF failure / %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("NFDiscovery requests = %v, want 2", n)
+	}
+}
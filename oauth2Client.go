@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// oauth2Enabled = true なら、N12のRequestにNRFから取得したアクセストークンをBearerトークンとして付与する(TS 33.501 13.4.1)。
+// oauth2TokenUrlが空ならnrfApiRoot + "/oauth2/token"を使う。nfInstanceIdはトークン要求に載せる自身のNFインスタンスID(UUID)。
+var oauth2Enabled bool
+var oauth2TokenUrl string
+var oauth2NfInstanceId string
+
+// N12(Nausf_UEAuthentication)のスコープ。
+const oauth2ScopeNausfAuth = "nausf-auth"
+
+// アクセストークンを取得できない場合のエラー。AUSFの異常ではないので、呼び出し元はAUSFを異常として記録しない。
+var errOAuth2TokenUnavailable = errors.New("OAuth2 access token unavailable")
+
+// アクセストークンの有効期限(expires_in)がない場合の保持時間。
+const oauth2DefaultExpiresIn = 60 * time.Second
+
+// NRFのトークンエンドポイントが返すAccessTokenRsp(TS 29.510)のうち、使用する項目のみを定義している。
+type oauth2AccessTokenRsp struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// 取得済みアクセストークンのキャッシュ。refreshAtを過ぎたら有効期限前でも取得し直す。
+// 取得中はmuを保持し続けるので、同時に複数のRequestがトークンを要求してもNRFへの問い合わせは1回になる。
+var oauth2TokenCache struct {
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+// nausf-authスコープのアクセストークンを返す。キャッシュがない、refreshAtを過ぎた、またはforceRefresh = trueならNRFから取得し直す。
+func oauth2AccessToken(forceRefresh bool) (string, error) {
+	oauth2TokenCache.mu.Lock()
+	defer oauth2TokenCache.mu.Unlock()
+	if !forceRefresh && oauth2TokenCache.token != "" && time.Now().Before(oauth2TokenCache.refreshAt) {
+		return oauth2TokenCache.token, nil
+	}
+	tokenRsp, tokenErr := oauth2TokenRequest()
+	if tokenErr != nil {
+		oauth2TokenCache.token = ""
+		return "", tokenErr
+	}
+	expiresIn := oauth2DefaultExpiresIn
+	if tokenRsp.ExpiresIn > 0 {
+		expiresIn = time.Duration(tokenRsp.ExpiresIn) * time.Second
+	}
+	// 有効期限切れでRequestが401にならないよう、有効期間の9割が経過した時点で更新する。
+	oauth2TokenCache.token = tokenRsp.AccessToken
+	oauth2TokenCache.refreshAt = time.Now().Add(expiresIn * 9 / 10)
+	log.Printf("[OAuth2] access token obtained (scope: %v, expires in %v)\n", tokenRsp.Scope, expiresIn)
+	return oauth2TokenCache.token, nil
+}
+
+// NRFのトークンエンドポイントへclient_credentialsグラントでAccessTokenReqを送信する。
+func oauth2TokenRequest() (oauth2AccessTokenRsp, error) {
+	var tokenRsp oauth2AccessTokenRsp
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("nfInstanceId", oauth2NfInstanceId)
+	form.Set("nfType", nrfRequesterNfType)
+	form.Set("targetNfType", "AUSF")
+	form.Set("scope", oauth2ScopeNausfAuth)
+	tokenUrl := oauth2TokenUrl
+	if tokenUrl == "" {
+		tokenUrl = strings.TrimSuffix(nrfApiRoot, "/") + "/oauth2/token"
+	}
+	// トークンエンドポイントもN12と同じsbiClient(SBIのCA/クライアント証明書)を使い、期限はsbiRequestTimeoutとする。
+	ctx, cancel := sbiRequestContext()
+	defer cancel()
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, tokenUrl, strings.NewReader(form.Encode()))
+	if reqErr != nil {
+		return tokenRsp, reqErr
+	}
+	req.Header.Add("content-type", "application/x-www-form-urlencoded")
+	req.Header.Add("accept", "application/json")
+	log.Printf("[OAuth2] AccessTokenReq send : %v\n", tokenUrl)
+	res, sendErr := sbiClient.Do(req)
+	if sendErr != nil {
+		return tokenRsp, sendErr
+	}
+	defer res.Body.Close()
+	sbiResponseCount(res)
+	body, readErr := io.ReadAll(res.Body)
+	if readErr != nil {
+		return tokenRsp, readErr
+	}
+	if res.StatusCode != http.StatusOK {
+		return tokenRsp, fmt.Errorf("AccessTokenReq failed / STATUS: %v / %v", res.Status, string(body))
+	}
+	if decodeErr := json.Unmarshal(body, &tokenRsp); decodeErr != nil {
+		return tokenRsp, decodeErr
+	}
+	if tokenRsp.AccessToken == "" || !strings.EqualFold(tokenRsp.TokenType, "Bearer") {
+		return tokenRsp, errors.New("invalid AccessTokenRsp (no Bearer access_token)")
+	}
+	return tokenRsp, nil
+}
+
+// N12のHTTP Requestを送信する。oauth2Enabled = true ならBearerトークンを付与し、
+// 401 Unauthorizedが返った場合はトークンを取得し直して1回だけ再送する（NRF側でトークンが失効・更新された場合を想定）。
+// 再送のため、reqはbytes.Reader等でbodyを作りGetBodyが設定されていることを前提とする。
+func n12RequestSend(client *http.Client, req *http.Request) (*http.Response, error) {
+	if !oauth2Enabled {
+		return client.Do(req)
+	}
+	token, tokenErr := oauth2AccessToken(false)
+	if tokenErr != nil {
+		return nil, fmt.Errorf("%w / %v", errOAuth2TokenUnavailable, tokenErr)
+	}
+	retryReq := req.Clone(req.Context())
+	req.Header.Set("authorization", "Bearer "+token)
+	res, sendErr := client.Do(req)
+	if sendErr != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, sendErr
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	log.Printf("[OAuth2] 401 Unauthorized from %v, retry with a new access token\n", req.URL.Host)
+	token, tokenErr = oauth2AccessToken(true)
+	if tokenErr != nil {
+		return nil, fmt.Errorf("%w / %v", errOAuth2TokenUnavailable, tokenErr)
+	}
+	if req.GetBody != nil {
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, bodyErr
+		}
+		retryReq.Body = body
+	}
+	retryReq.Header.Set("authorization", "Bearer "+token)
+	return client.Do(retryReq)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// トークンエンドポイント(/oauth2/token)とAUSF(/nausf-auth/v1/ue-authentications)を兼ねるスタブ。
+// トークンは払い出すたびに"token-1"、"token-2"…と変わる。ausfはAUSF宛てRequestのハンドラ。
+type oauth2TestServer struct {
+	*httptest.Server
+	tokenRequests atomic.Int32
+	ausfRequests  atomic.Int32
+}
+
+func newOAuth2TestServer(t *testing.T, ausf func(w http.ResponseWriter, r *http.Request)) *oauth2TestServer {
+	t.Helper()
+	ts := &oauth2TestServer{}
+	ts.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth2/token":
+			n := ts.tokenRequests.Add(1)
+			if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != oauth2ScopeNausfAuth || r.FormValue("nfInstanceId") != oauth2NfInstanceId {
+				t.Errorf("unexpected AccessTokenReq : %v", r.Form)
+			}
+			w.Header().Set("content-type", "application/json")
+			fmt.Fprintf(w, `{"access_token": "token-%v", "token_type": "Bearer", "expires_in": 100, "scope": "nausf-auth"}`, n)
+		default:
+			ts.ausfRequests.Add(1)
+			ausf(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	sbiClientSetupForTest(t, ts.Server)
+	savedEnabled, savedUrl, savedNfInstanceId := oauth2Enabled, oauth2TokenUrl, oauth2NfInstanceId
+	t.Cleanup(func() { oauth2Enabled, oauth2TokenUrl, oauth2NfInstanceId = savedEnabled, savedUrl, savedNfInstanceId })
+	oauth2Enabled = true
+	oauth2TokenUrl = ts.URL + "/oauth2/token"
+	oauth2NfInstanceId = "8d6a7c3e-0000-4000-8000-000000000001"
+	oauth2TokenCache.mu.Lock()
+	oauth2TokenCache.token = ""
+	oauth2TokenCache.refreshAt = time.Time{}
+	oauth2TokenCache.mu.Unlock()
+	return ts
+}
+
+func TestOAuth2AccessTokenRefresh(t *testing.T) {
+	ts := newOAuth2TestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	first, err := oauth2AccessToken(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 有効期間の9割が経過するまではキャッシュしたトークンを使う。
+	second, err := oauth2AccessToken(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != "token-1" || second != "token-1" || ts.tokenRequests.Load() != 1 {
+		t.Fatalf("tokens = %v, %v (requests: %v), want token-1 twice with 1 request", first, second, ts.tokenRequests.Load())
+	}
+	oauth2TokenCache.mu.Lock()
+	remaining := time.Until(oauth2TokenCache.refreshAt)
+	oauth2TokenCache.mu.Unlock()
+	if remaining < 85*time.Second || remaining > 90*time.Second {
+		t.Errorf("token refreshes in %v, want 90%% of expires_in (90s)", remaining)
+	}
+	// 有効期限(expires_in)前でも、refreshAtを過ぎたら取得し直す。
+	oauth2TokenCache.mu.Lock()
+	oauth2TokenCache.refreshAt = time.Now().Add(-time.Second)
+	oauth2TokenCache.mu.Unlock()
+	refreshed, err := oauth2AccessToken(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed != "token-2" || ts.tokenRequests.Load() != 2 {
+		t.Errorf("refreshed token = %v (requests: %v), want token-2 with 2 requests", refreshed, ts.tokenRequests.Load())
+	}
+}
+
+func TestN12RequestSendRetryOn401(t *testing.T) {
+	tests := []struct {
+		name             string
+		acceptedToken    string
+		wantStatus       int
+		wantTokenReqs    int32
+		wantAusfRequests int32
+	}{
+		// AUSF側でトークンが失効していた場合は、取得し直したトークンで1回だけ再送する。
+		{name: "retry with fresh token", acceptedToken: "token-2", wantStatus: http.StatusCreated, wantTokenReqs: 2, wantAusfRequests: 2},
+		{name: "accepted first time", acceptedToken: "token-1", wantStatus: http.StatusCreated, wantTokenReqs: 1, wantAusfRequests: 1},
+		{name: "no second retry", acceptedToken: "", wantStatus: http.StatusUnauthorized, wantTokenReqs: 2, wantAusfRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const reqBody = `{"supiOrSuci": "imsi-001010000000001"}`
+			ts := newOAuth2TestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != reqBody {
+					t.Errorf("request body = %q, want %q", body, reqBody)
+				}
+				if tt.acceptedToken == "" || r.Header.Get("authorization") != "Bearer "+tt.acceptedToken {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			})
+			req, reqErr := http.NewRequest(http.MethodPost, ts.URL+"/nausf-auth/v1/ue-authentications", bytes.NewReader([]byte(reqBody)))
+			if reqErr != nil {
+				t.Fatal(reqErr)
+			}
+			res, sendErr := n12RequestSend(sbiClient, req)
+			if sendErr != nil {
+				t.Fatal(sendErr)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %v, want %v", res.StatusCode, tt.wantStatus)
+			}
+			if n := ts.tokenRequests.Load(); n != tt.wantTokenReqs {
+				t.Errorf("token requests = %v, want %v", n, tt.wantTokenReqs)
+			}
+			if n := ts.ausfRequests.Load(); n != tt.wantAusfRequests {
+				t.Errorf("AUSF requests = %v, want %v", n, tt.wantAusfRequests)
+			}
+		})
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/md5"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"strings"
 	"time"
 
@@ -16,17 +19,15 @@ import (
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
 	"layeh.com/radius/rfc2869"
-	"layeh.com/radius/vendors/microsoft"
 )
 
 // バージョン表記
 const rad5gcGWCurrentVer string = "0.7.5"
 
-// 以下はinit()でrad5gcgwconf.yamlファイルから読み出して設定する
-var sharedSecret string
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// （Radiusクライアントと共有秘密鍵はradiusClientTable.goのradiusClientTableで管理する）
+var radiusListenAddr string
 var radiusAttributesLogOutputFlag bool
-var allowedClientAddr string
-var n12AUSFaddress string
 var overwriteLinkString bool
 
 // msgAuthOverwriteZeroは、チェック用MessageAuthenticatorの算出で16オクテットの0x00が必要なため、ベタ書きした。
@@ -41,18 +42,17 @@ type processingStatus struct {
 
 // EAP-Identityでセットされる実体Identityを適切に分解して格納するための構造体。
 type eapIdentiySet struct {
-	identityPrefix string
-	imsi           string
-	networkName    string
+	identityPrefix   string
+	imsi             string
+	networkName      string
+	routingIndicator string
+	supiOrSuci       string
+	homeRealm        string
 }
 
-func init() {
-	fmt.Printf("[Rad-5GC GW] ver.%v reading configuration...\n", rad5gcGWCurrentVer)
-	var readConfig rad5gcConfig
-	readConfig, initErr := getRad5gcConfig()
-	if initErr != nil {
-		log.Fatalf("[Rad-5GC GW] reading configuration failed / %v\n", initErr)
-	}
+// 読み込んだ設定をグローバル変数に反映し、ログ出力先・クライアント一覧・AUSFプール等を初期化する。
+// 設定ファイルのパスをコマンドライン引数で受け取るため、configure()ではなくmainの引数解析後に呼び出す。
+func configure(readConfig rad5gcConfig) {
 	log.SetOutput(&lumberjack.Logger{
 		Filename:   readConfig.ConfFilename,
 		MaxSize:    readConfig.ConfMaxSize,
@@ -63,18 +63,240 @@ func init() {
 	})
 	log.Println("--------------------")
 	log.Printf("[Rad-5GC GW] ver.%v initializing...\n", rad5gcGWCurrentVer)
-	sharedSecret = readConfig.ConfSharedSecret
+	clientTable, clientTableErr := buildRadiusClientTable(readConfig)
+	if clientTableErr != nil {
+		log.Fatalf("[Rad-5GC GW] building Radius client table failed / %v\n", clientTableErr)
+	}
+	radiusClientTable = clientTable
+	for _, c := range radiusClientTable {
+		log.Printf("[Rad-5GC GW] Radius client : %v (NAS-Identifier: %q, Message-Authenticator: %v) %v\n", c.network, c.nasIdentifier, c.msgAuthMode, c.description)
+	}
 	radiusAttributesLogOutputFlag = readConfig.ConfAttributesLogging
-	allowedClientAddr = readConfig.ConfAllowedClientAddress
-	n12AUSFaddress = readConfig.ConfAUSFaddress
+	radiusListenAddr = readConfig.ConfRadiusListen
+	if radiusListenAddr == "" {
+		radiusListenAddr = ":1812"
+	}
+	accountingEnabled = readConfig.ConfAccountingEnabled
+	accountingListenAddr = readConfig.ConfAccountingListen
+	statusServerCheckAUSF = readConfig.ConfStatusServerCheckAUSF
+	duplicateCacheTTL = time.Duration(readConfig.ConfDuplicateCacheTTL) * time.Second
+	if duplicateCacheTTL <= 0 {
+		duplicateCacheTTL = 30 * time.Second
+	}
+	accountingSessionTTL = time.Duration(readConfig.ConfAccountingSessionTTL) * time.Second
+	if accountingSessionTTL <= 0 {
+		accountingSessionTTL = 24 * time.Hour
+	}
+	eapSessionTTL = time.Duration(readConfig.ConfEapSessionTTL) * time.Second
+	if eapSessionTTL <= 0 {
+		eapSessionTTL = 60 * time.Second
+	}
+	eapSessionMaxEntries = readConfig.ConfEapSessionMaxEntries
+	if eapSessionMaxEntries <= 0 {
+		eapSessionMaxEntries = 10000
+	}
+	ausfContextReleaseEnabled = readConfig.ConfAusfContextReleaseEnabled
+	ausfContextReleaseRetries = readConfig.ConfAusfContextReleaseRetries
+	if ausfContextReleaseRetries <= 0 {
+		ausfContextReleaseRetries = 2
+	}
+	ausfContextReleaseRetryInterval = time.Duration(readConfig.ConfAusfContextReleaseRetryInterval) * time.Second
+	if ausfContextReleaseRetryInterval <= 0 {
+		ausfContextReleaseRetryInterval = 1 * time.Second
+	}
+	dynAuthPort = readConfig.ConfDynAuthPort
+	if dynAuthPort == 0 {
+		dynAuthPort = 3799
+	}
+	dynAuthTimeout = time.Duration(readConfig.ConfDynAuthTimeout) * time.Second
+	if dynAuthTimeout <= 0 {
+		dynAuthTimeout = 5 * time.Second
+	}
+	adminListenAddr = readConfig.ConfAdminListen
+	adminToken = readConfig.ConfAdminToken
+	radsecEnabled = readConfig.ConfRadsecEnabled
+	radsecListenAddr = readConfig.ConfRadsecListen
+	radsecCertFile = readConfig.ConfRadsecCertFile
+	radsecKeyFile = readConfig.ConfRadsecKeyFile
+	radsecClientCAFile = readConfig.ConfRadsecClientCAFile
+	radsecHandshakeTimeout = time.Duration(readConfig.ConfRadsecHandshakeTimeout) * time.Second
+	if radsecHandshakeTimeout <= 0 {
+		radsecHandshakeTimeout = 10 * time.Second
+	}
+	radsecIdleTimeout = time.Duration(readConfig.ConfRadsecIdleTimeout) * time.Second
+	if radsecIdleTimeout <= 0 {
+		radsecIdleTimeout = 300 * time.Second
+	}
+	radsecMaxInflight = readConfig.ConfRadsecMaxInflight
+	if radsecMaxInflight <= 0 {
+		radsecMaxInflight = 64
+	}
+	nrfApiRoot = readConfig.ConfNrfApiRoot
+	nrfRequesterNfType = readConfig.ConfNrfRequesterNfType
+	if nrfRequesterNfType == "" {
+		nrfRequesterNfType = "AMF"
+	}
+	nrfRoutingIndicator = readConfig.ConfNrfRoutingIndicator
+	oauth2Enabled = readConfig.ConfOAuth2Enabled
+	oauth2TokenUrl = readConfig.ConfOAuth2TokenUrl
+	oauth2NfInstanceId = readConfig.ConfNfInstanceId
+	ausfScheme = sbiSchemeOf(readConfig.ConfAusfScheme)
+	sbiTlsCaFile = readConfig.ConfSbiTlsCaFile
+	sbiTlsCertFile = readConfig.ConfSbiTlsCertFile
+	sbiTlsKeyFile = readConfig.ConfSbiTlsKeyFile
+	sbiTlsServerName = readConfig.ConfSbiTlsServerName
+	sbiCertStore = &sbiTlsCertStore{
+		certFile: sbiTlsCertFile,
+		keyFile:  sbiTlsKeyFile,
+		caFile:   sbiTlsCaFile,
+	}
+	if loadErr := sbiCertStore.reloadIfChanged(); loadErr != nil {
+		log.Fatalf("[Rad-5GC GW] loading SBI TLS certificate failed / %v\n", loadErr)
+	}
+	sbiHttpVersion = readConfig.ConfSbiHttpVersion
+	if sbiHttpVersion == "" {
+		sbiHttpVersion = sbiHttpVersion1
+	}
+	sbiRequestTimeout = time.Duration(readConfig.ConfSbiRequestTimeout) * time.Second
+	if sbiRequestTimeout <= 0 {
+		sbiRequestTimeout = 5 * time.Second
+	}
+	sbiMaxIdleConnsPerHost = readConfig.ConfSbiMaxIdleConnsPerHost
+	if sbiMaxIdleConnsPerHost <= 0 {
+		sbiMaxIdleConnsPerHost = 16
+	}
+	sbiIdleConnTimeout = time.Duration(readConfig.ConfSbiIdleConnTimeout) * time.Second
+	if sbiIdleConnTimeout <= 0 {
+		sbiIdleConnTimeout = 90 * time.Second
+	}
+	sbiKeepAliveInterval = time.Duration(readConfig.ConfSbiKeepAliveInterval) * time.Second
+	if sbiKeepAliveInterval <= 0 {
+		sbiKeepAliveInterval = 30 * time.Second
+	}
+	sbiClient = newSbiClient(sbiCertStore)
+	defaultPool, defaultPoolErr := ausfPoolOrDiscovery(readConfig.ConfAUSFaddress, readConfig.ConfAUSFpool, ausfScheme, nrfApiRoot)
+	if defaultPoolErr != nil {
+		log.Fatalf("[Rad-5GC GW] building AUSF pool failed / %v\n", defaultPoolErr)
+	}
+	ausfDefaultPool = defaultPool
+	log.Printf("[Rad-5GC GW] AUSF pool (default route) : %v\n", ausfDefaultPool)
+	routeTable, routeTableErr := buildAusfRouteTable(readConfig)
+	if routeTableErr != nil {
+		log.Fatalf("[Rad-5GC GW] building AUSF route table failed / %v\n", routeTableErr)
+	}
+	ausfRouteTable = routeTable
+	for _, route := range ausfRouteTable {
+		log.Printf("[Rad-5GC GW] AUSF route : %v (realm: %q, plmn: %q, imsiPrefixes: %v) -> %v\n", route.name, route.realm, route.plmn, route.imsiPrefixes, route.pool)
+	}
+	ausfRouteRejectNoMatch = readConfig.ConfAusfRouteRejectNoMatch
+	ausfHealthCheckInterval = time.Duration(readConfig.ConfAusfHealthCheckInterval) * time.Second
+	if ausfHealthCheckInterval <= 0 {
+		ausfHealthCheckInterval = 10 * time.Second
+	}
 	overwriteLinkString = readConfig.ConfOverwriteLinkString
+	ausfApiPath = strings.TrimSuffix(readConfig.ConfAusfApiPath, "/")
+	if ausfApiPath == "" {
+		ausfApiPath = "/nausf-auth/v1"
+	}
+	rewriteRules, rewriteRulesErr := buildLinkRewriteRules(readConfig)
+	if rewriteRulesErr != nil {
+		log.Fatalf("[Rad-5GC GW] building link rewrite rules failed / %v\n", rewriteRulesErr)
+	}
+	linkRewriteRules = rewriteRules
+	mskSource = readConfig.ConfMskSource
+	if mskSource == "" {
+		mskSource = mskSourceKseaf
+	}
+	akaIdentityRequest = readConfig.ConfAkaIdentityRequest
+	if akaIdentityRequest == "" {
+		akaIdentityRequest = akaIdentityRequestFullauth
+	}
+	akaIdentityMaxRounds = readConfig.ConfAkaIdentityMaxRounds
+	if akaIdentityMaxRounds <= 0 {
+		akaIdentityMaxRounds = 3
+	}
+	// EAP認証セッションの格納先は、TTLや認証コンテキストの解放(sbiClient)の設定が済んでから開く。
+	// 再起動前のセッションのうちTTLを過ぎていたものは復元せず、AUSFの認証コンテキストを解放する。
+	eapSessionStoreType = readConfig.ConfEapSessionStore
+	eapSessionStoreFile = readConfig.ConfEapSessionStoreFile
+	if eapSessionStoreFile == "" {
+		eapSessionStoreFile = "rad5gcgw-sessions.log"
+	}
+	eapSessionStoreSync = readConfig.ConfEapSessionStoreSync
+	store, expiredSessions, storeErr := newSessionStore(eapSessionStoreType, eapSessionStoreFile, eapSessionStoreSync, eapSessionTTL)
+	if storeErr != nil {
+		log.Fatalf("[Rad-5GC GW] opening EAP session store failed / %v\n", storeErr)
+	}
+	eapSessions = store
+	// clusterListenが設定されていれば、ピアへの複製を行う格納先で包む。
+	clusterListenAddr = readConfig.ConfClusterListen
+	clusterNodeName = readConfig.ConfClusterNodeName
+	clusterPeerAddrs = readConfig.ConfClusterPeers
+	clusterSecret = readConfig.ConfClusterSecret
+	clusterTls = readConfig.ConfClusterTls
+	clusterTlsCertFile = readConfig.ConfClusterTlsCertFile
+	clusterTlsKeyFile = readConfig.ConfClusterTlsKeyFile
+	clusterTlsCaFile = readConfig.ConfClusterTlsCaFile
+	clusterTlsPeerNames = readConfig.ConfClusterTlsPeerNames
+	if clusterListenAddr != "" {
+		var clusterCertStore *sbiTlsCertStore
+		if clusterTls {
+			clusterCertStore = &sbiTlsCertStore{
+				certFile: clusterTlsCertFile,
+				keyFile:  clusterTlsKeyFile,
+				caFile:   clusterTlsCaFile,
+			}
+			if loadErr := clusterCertStore.reloadIfChanged(); loadErr != nil {
+				log.Fatalf("[Rad-5GC GW] loading cluster TLS certificate failed / %v\n", loadErr)
+			}
+		}
+		clusterLocalNode = newClusterNode(clusterNodeName, clusterSecret, store, clusterPeerAddrs, clusterCertStore, clusterTlsPeerNames)
+		eapSessions = newReplicatedSessionStore(store, clusterLocalNode.peers)
+	}
+	// クラスタ構成では、ピアから複製されたセッションの認証コンテキストは所有するノードが解放する。
+	for _, session := range expiredSessions {
+		eapSessionStats.expired.Add(1)
+		if session.uri != "" && eapSessionOwned(session) {
+			go authContextRelease(session.uri, "session expired before restart")
+		}
+	}
 }
 
 func main() {
+	opts, cmdLineErr := parseCmdLine(os.Args[0], os.Args[1:], os.Stderr)
+	if errors.Is(cmdLineErr, flag.ErrHelp) {
+		return
+	}
+	if cmdLineErr != nil {
+		fmt.Fprintf(os.Stderr, "[Rad-5GC GW] %v\n", cmdLineErr)
+		os.Exit(2)
+	}
+	if opts.version {
+		printVersion()
+		return
+	}
+	fmt.Printf("[Rad-5GC GW] ver.%v reading configuration...\n", rad5gcGWCurrentVer)
+	readConfig, configErr := getRad5gcConfig(opts)
+	// --check-configの場合は検証結果のみを出力して終了する(ポートの待ち受けやセッションファイルのオープンは行わない)。
+	if opts.checkConfig {
+		if configErr != nil {
+			fmt.Printf("[Rad-5GC GW] configuration check failed / %v\n", configErr)
+			os.Exit(1)
+		}
+		fmt.Println("[Rad-5GC GW] configuration check OK")
+		return
+	}
+	if configErr != nil {
+		log.Fatalf("[Rad-5GC GW] reading configuration failed / %v\n", configErr)
+	}
+	configure(readConfig)
 	handler := func(w radius.ResponseWriter, r *radius.Request) {
 		var responsePacket *radius.Packet
-		var eapSessionInfoId uint8
-		var eapSessionInfoURI string
+		var eapSessionInfo eapSession
+		// Access-Acceptの送信に成功したら、このSUPIを認証済みSTAとして記録する。
+		var acceptedSupi string
+		// AUSFがEAP-Success/EAP-Failureを返して認証コンテキストを閉じた場合にtrueにする。
+		var n12ContextClosed bool
 		eapPacket := new(layers.EAP)
 		reqReceivedStatus := processingStatus{
 			discardFlag: false,
@@ -87,14 +309,42 @@ func main() {
 				log.Printf("[RADIUS] Attribute %v : %X\n", i+1, r.Packet.Attributes[i].Attribute)
 			}
 		}
-		// 受信したRadiusパケットのSrcアドレス成否判定。NGならreqReceivedStatusでdiscardFlag:trueにする。
+		// 受信したRadiusパケットの送信元クライアント成否判定。NGならreqReceivedStatusでdiscardFlag:trueにする。
+		// 未登録アドレスはSecretSourceの段階で破棄されているが、ここではNAS-Identifierも含めて再チェックする。
+		var reqClient radiusClient
 		if !reqReceivedStatus.discardFlag {
-			checkAddr, _, _ := strings.Cut(r.RemoteAddr.String(), ":")
-			if checkAddr != allowedClientAddr {
+			nasId := rfc2865.NASIdentifier_GetString(r.Packet)
+			client, clientOK := requestClientLookup(r, nasId)
+			if !clientOK {
 				reqReceivedStatus.discardFlag = true
-				reqReceivedStatus.errReason = "[RADIUS] Client IP Address not Allowed : " + checkAddr
+				reqReceivedStatus.errReason = fmt.Sprintf("[RADIUS] Client not Allowed : %v (NAS-Identifier: %q)", r.RemoteAddr, nasId)
+			} else {
+				reqClient = client
+				log.Printf("[RADIUS] Client : %v\n", reqClient)
 			}
 		}
+		// Message-Authenticatorの検証。BlastRADIUS(CVE-2024-3596)対策として、クライアントごとの検証モード(require/require-first/legacy)に従う。
+		if !reqReceivedStatus.discardFlag {
+			if psMsgAuth := messageAuthenticatorEnforce(r, reqClient.msgAuthMode); psMsgAuth.discardFlag {
+				reqReceivedStatus = psMsgAuth
+			}
+		}
+		// Status-Server(RFC 5997)は、EAP処理・重複検出の対象外としてここで応答して終了する。
+		if !reqReceivedStatus.discardFlag && r.Packet.Code == radius.CodeStatusServer {
+			statusServerHandle(w, r, radius.CodeAccessAccept)
+			return
+		}
+		// 重複リクエスト(APからの再送)の判定。RFC 5080に基づき、同一送信元・Identifier・Request Authenticatorなら重複とみなす。
+		// 重複ならEAP処理(authReqFirst/authReqExchange)は行わず、元リクエストの処理完了を待って同じ応答を再送する。
+		var dupEntry *duplicateCacheEntry
+		if !reqReceivedStatus.discardFlag {
+			entry, isDuplicate := duplicateCacheBegin(r)
+			if isDuplicate {
+				duplicateCacheReplay(w, r, entry)
+				return
+			}
+			dupEntry = entry
+		}
 		// Proxy-State(33)の有無確認。
 		// Accept/Challenge/Rejectでもそのまま載せる必要があるので、各種判定前であるこのタイミングで実行＆確保しておく。
 		var attr33 map[int][]byte
@@ -117,22 +367,70 @@ func main() {
 				eapPacket = pkt
 			}
 		}
+		// EAP-AKA'のEAP-ResponseはAccess-Challengeへの応答なので、その際に払い出したState(24)から認証セッションを特定する。
+		// Stateがない・未登録・送信元STAが異なる場合は、他STAのN12認証コンテキストを使わないよう破棄する。
+		// セッションは応答を送信できた時点でテーブルから削除する。破棄した場合は残すため、NASの再送で同じ段階からやり直せる。
+		var eapSess eapSession
+		var eapSessKey string
+		if !reqReceivedStatus.discardFlag && eapPacket.Type == 50 {
+			key, sess, sessErr := eapSessionLoad(r, eapPacket.Id)
+			if sessErr != nil {
+				reqReceivedStatus.discardFlag = true
+				reqReceivedStatus.errReason = "EAP session not found for State."
+				reqReceivedStatus.errString = sessErr
+			} else {
+				eapSessKey = key
+				defer eapSessionRelease(key)
+				eapSess = sess
+				eapSessionInfo.ausfAddress = sess.ausfAddress
+				eapSessionInfo.createdAt = sess.createdAt
+			}
+		}
+		// 新規の認証(EAP-Response/Identity)は、EAP認証セッションテーブルが上限(eapSessionMaxEntries)に達していれば破棄する。
+		// Access-Rejectではなく破棄とすることで、NASの再送やセカンダリサーバへのフェイルオーバーに任せる。
+		if !reqReceivedStatus.discardFlag && eapPacket.Type == 1 && eapSessionTableFull() {
+			reqReceivedStatus.discardFlag = true
+			reqReceivedStatus.errReason = "EAP session table is full."
+			reqReceivedStatus.errString = fmt.Errorf("%v sessions in progress", eapSessions.Len())
+		}
+		// EAP-AKA'はTypeData先頭byte(EAP Subtype)で分岐するため、TypeDataが空のものは破棄する。
+		if !reqReceivedStatus.discardFlag && eapPacket.Type == 50 && len(eapPacket.TypeData) == 0 {
+			reqReceivedStatus.discardFlag = true
+			reqReceivedStatus.errReason = "EAP-AKA' Subtype not found."
+			reqReceivedStatus.errString = errors.New("eap-aka' packet without type data")
+		}
 		// EAP Typeから後続処理を判定する。
 		// EAP-Identity/EAP-AKA'/それ以外/の3グループに分岐し、EAP-IdentityはID Prefixで、EAP-AKA'はEAP SubTypeでさらに分岐する。
 		if !reqReceivedStatus.discardFlag {
 			switch compareEapType := eapPacket.Type; compareEapType {
 			case 1:
-				switch idPrefixCheckSet := eapIdentityByteToString(eapPacket); idPrefixCheckSet.identityPrefix {
-				case "6":
-					nwName, nwNameErr := toNWNameForN12(idPrefixCheckSet.networkName)
-					if nwNameErr != nil {
-						log.Printf("%v\n", nwNameErr)
+				// Identityが解析できない場合は、identityPrefixが空のままなのでdefault(Access-Reject)に進み、解析エラーをReply-Messageで返す。
+				idPrefixCheckSet, identityErr := eapIdentityParse(string(eapPacket.TypeData))
+				switch idPrefixCheckSet.identityPrefix {
+				case "6", identityPrefixSuci:
+					// IMSI/Realmから送信先AUSFとServingNetworkNameを決定する。該当ルートなし(reject設定時)はAccess-Rejectを返す。
+					// SUCIの場合はIMSIが秘匿されているため、PLMNとRouting Indicatorで決定する。
+					route, routeErr := ausfRouteSelect(idPrefixCheckSet)
+					if errors.Is(routeErr, errAusfRouteNotFound) {
+						var code radius.Code = radius.CodeAccessReject
+						log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
+						rejectResponseNoRoute := r.Response(code)
+						if err := rfc2865.ReplyMessage_AddString(rejectResponseNoRoute, "No AUSF route for this identity."); err != nil {
+							reqReceivedStatus.discardFlag = true
+							reqReceivedStatus.errReason = "Failed to add Reply-Message."
+							reqReceivedStatus.errString = err
+						} else {
+							responsePacket = rejectResponseNoRoute
+						}
+					} else if routeErr != nil {
+						log.Printf("%v\n", routeErr)
 						reqReceivedStatus.discardFlag = true
 						reqReceivedStatus.errReason = "Failed to assemble Network name for N12."
-						reqReceivedStatus.errString = nwNameErr
+						reqReceivedStatus.errString = routeErr
 					} else {
-						var supi string = "imsi-" + idPrefixCheckSet.imsi
-						authRespFirstStCode, authRespFirstBodyStr, authReqFirstErr := authReqFirst(supi, nwName)
+						// SUCIはそのままAUSFへ渡し、秘匿の解除はUDM(SIDF)に任せる。
+						var supi string = idPrefixCheckSet.supiOrSuci
+						authRespFirstStCode, authRespFirstBodyStr, usedAusfAddress, authReqFirstErr := authReqFirst(route, supi)
 						if authReqFirstErr != nil {
 							log.Printf("%v\n", authReqFirstErr)
 							reqReceivedStatus.discardFlag = true
@@ -150,10 +448,11 @@ func main() {
 									var code radius.Code = radius.CodeAccessChallenge
 									log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
 									accessChallengeAKAchallenge := r.Response(code)
-									accessChallengeAKAchallenge.Attributes.Add(79, authRespFirstEapPayload)
+									eapMessageAdd(accessChallengeAKAchallenge, authRespFirstEapPayload)
 									responsePacket = accessChallengeAKAchallenge
-									eapSessionInfoId = authRespFirstEapId
-									eapSessionInfoURI = linkStr
+									eapSessionInfo.eapId = authRespFirstEapId
+									eapSessionInfo.uri = linkStr
+									eapSessionInfo.ausfAddress = usedAusfAddress
 								case 400, 403, 404, 500, 501, 503:
 									var code radius.Code = radius.CodeAccessReject
 									accessRejectRespFirstProblem := r.Response(code)
@@ -170,22 +469,42 @@ func main() {
 							}
 						}
 					}
-				case "7", "8":
-					var code radius.Code = radius.CodeAccessChallenge
-					log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
-					challengeRespAKAidentityReq := r.Response(code)
-					// AT_FULLAUTH_ID_REQを直接生成
-					var attributeAKAidentityReq = []byte{0x01, 0x00, 0x00, 0x0c, 0x32, 0x05, 0x00, 0x00, 0x11, 0x01, 0x00, 0x00}
-					var eapSessionId byte = generateEAPId()
-					attributeAKAidentityReq[1] = eapSessionId
-					challengeRespAKAidentityReq.Attributes.Add(79, attributeAKAidentityReq)
-					responsePacket = challengeRespAKAidentityReq
+				case "0", "2", "4", "7", "8", identityPrefixAnonymous:
+					// 仮名("2"/"7")・高速再認証("4"/"8")・匿名のIdentityはAUSFへ渡せないため、EAP-Request/AKA'-IdentityでIdentityを要求し直す。
+					// EAP-AKAのIdentity("0"/"2"/"4")には、EAP-AKA'のAKA'-Identityで答え直させることでEAP-AKA'へ誘導する。
+					// Identity要求を送れない場合(akaIdentityRequest/akaIdentityMaxRoundsの設定不備)は、永続Identityを得られないためAccess-Rejectを返す。
+					idReqAttr, nextReqErr := akaIdentityNextRequest(idPrefixCheckSet.identityPrefix, 0, 0)
+					if nextReqErr != nil {
+						var code radius.Code = radius.CodeAccessReject
+						log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
+						rejectResponseNoIdReq := r.Response(code)
+						log.Printf("[EAP] AKA'-Identity cannot be requested for identity prefix %q / %v\n", idPrefixCheckSet.identityPrefix, nextReqErr)
+						if err := rfc2865.ReplyMessage_AddString(rejectResponseNoIdReq, fmt.Sprintf("Not a permanent identity : %v", idPrefixCheckSet.identityPrefix)); err != nil {
+							reqReceivedStatus.discardFlag = true
+							reqReceivedStatus.errReason = "Failed to add Reply-Message."
+							reqReceivedStatus.errString = err
+						} else {
+							responsePacket = rejectResponseNoIdReq
+						}
+					} else {
+						var code radius.Code = radius.CodeAccessChallenge
+						log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
+						challengeRespAKAidentityReq, eapSessionId := akaIdentityChallenge(r, idReqAttr)
+						log.Printf("[EAP] EAP request / AKA'-Identity (%v, round 1) for identity prefix %q\n", akaIdentityAttrName(idReqAttr), idPrefixCheckSet.identityPrefix)
+						eapSessionInfo.eapId = eapSessionId
+						eapSessionInfo.identityReq = idReqAttr
+						eapSessionInfo.identityRounds = 1
+						responsePacket = challengeRespAKAidentityReq
+					}
 				default:
 					var code radius.Code = radius.CodeAccessReject
 					rejectResponseUnknownId := r.Response(code)
 					log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
 					var rejectResponseNotIdentifiedReplyString string = fmt.Sprintf("Unknown identity : %v", idPrefixCheckSet.identityPrefix)
-					log.Printf("[RADIUS] Unknown identity : %v%v%v\n", idPrefixCheckSet.identityPrefix, idPrefixCheckSet.imsi, idPrefixCheckSet.networkName)
+					if identityErr != nil {
+						rejectResponseNotIdentifiedReplyString = fmt.Sprintf("Invalid identity (%v)", identityErr)
+					}
+					log.Printf("[RADIUS] %v : %q\n", rejectResponseNotIdentifiedReplyString, eapPacket.TypeData)
 					err := rfc2865.ReplyMessage_AddString(rejectResponseUnknownId, rejectResponseNotIdentifiedReplyString)
 					if err != nil {
 						reqReceivedStatus.discardFlag = true
@@ -201,14 +520,12 @@ func main() {
 				switch compareEapSubType := eapPacket.TypeData[0]; compareEapSubType {
 				case 1:
 					log.Printf("[EAP] EAP SubType : %v / AKA'-Challenge received\n", compareEapSubType)
-					authRespExchStCode, authRespExchBodyStr, authRespExchErr := authReqExchange(eapPacket.Contents)
+					authRespExchStCode, authRespExchBodyStr, authRespExchErr := authReqExchange(eapPacket.Contents, eapSess.uri)
 					if authRespExchErr != nil {
-						eapIdTableDelete(eapPacket.Id)
 						reqReceivedStatus.discardFlag = true
 						reqReceivedStatus.errReason = "N12 Authentication Response failure."
 						reqReceivedStatus.errString = authRespExchErr
 					} else {
-						eapIdTableDelete(eapPacket.Id)
 						exchEapPayload, exchEapId, exchResultStr, exchErr := authRespBodyDecode(authRespExchStCode, authRespExchBodyStr)
 						if exchErr != nil {
 							reqReceivedStatus.discardFlag = true
@@ -220,37 +537,38 @@ func main() {
 								var code radius.Code = radius.CodeAccessChallenge
 								log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
 								accessChallengeAKAchallenge := r.Response(code)
-								accessChallengeAKAchallenge.Attributes.Add(79, exchEapPayload)
+								eapMessageAdd(accessChallengeAKAchallenge, exchEapPayload)
 								responsePacket = accessChallengeAKAchallenge
 								log.Println("[EAP] EAP request / AKA-Challenge")
-								eapSessionInfoId = exchEapId
-								eapSessionInfoURI = exchResultStr
+								eapSessionInfo.eapId = exchEapId
+								eapSessionInfo.uri = exchResultStr
 							case 3:
 								var code radius.Code = radius.CodeAccessAccept
 								log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
 								accessAcceptEAPSuccess := r.Response(code)
-								accessAcceptEAPSuccess.Attributes.Add(79, exchEapPayload)
-								log.Printf("[EAP] EAP Success / Kseaf : %v\n", exchResultStr)
+								eapMessageAdd(accessAcceptEAPSuccess, exchEapPayload)
+								log.Printf("[EAP] EAP Success / key material (%v) : %v\n", mskSource, exchResultStr)
+								n12ContextClosed = true
 								// MS-MPPE send/recv key generation and Attribute Addition
-								// 標準仕様上MSKではなくKseafが入るので、暫定でKseaf文字列を半分に割って32byteずつ入れる。
-								// おそらく無線LAN側でPMK作れない（ここは長期的課題とする。3GPP Release 17 NSWOF機能取り込みとセット）
-								msMPPEsendKeySrc := []byte(exchResultStr)[0:32]
-								msMPPErecvKeySrc := []byte(exchResultStr)[32:64]
-								sendKeyErr := microsoft.MSMPPESendKey_Set(accessAcceptEAPSuccess, msMPPEsendKeySrc)
-								if sendKeyErr != nil {
-									log.Println("[RADIUS] Fail to set MSMPPESendKey")
-								}
-								recvKeyErr := microsoft.MSMPPERecvKey_Set(accessAcceptEAPSuccess, msMPPErecvKeySrc)
-								if recvKeyErr != nil {
-									log.Println("[RADIUS] Fail to set MSMPPErecvKey")
+								// 鍵の生成元(Kseafまたは NSWOのMSK)は設定項目mskSourceで選択する。
+								if keySetErr := accessAcceptKeySet(accessAcceptEAPSuccess, exchResultStr, eapSess.keyName); keySetErr != nil {
+									reqReceivedStatus.discardFlag = true
+									reqReceivedStatus.errReason = "Failed to set key material to Access-Accept."
+									reqReceivedStatus.errString = keySetErr
 								}
 								responsePacket = accessAcceptEAPSuccess
+								// Accounting/CoA用に、AUSFが返したSUPI(なければUser-Name)を送信後に認証済みSTAとして記録する。
+								acceptedSupi = authRespSupiPick(authRespExchBodyStr)
+								if acceptedSupi == "" {
+									acceptedSupi = rfc2865.UserName_GetString(r.Packet)
+								}
 							case 4:
 								var code radius.Code = radius.CodeAccessReject
 								log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
 								accessRejectEAPfailure := r.Response(code)
-								accessRejectEAPfailure.Attributes.Add(79, exchEapPayload)
+								eapMessageAdd(accessRejectEAPfailure, exchEapPayload)
 								log.Printf("[EAP] EAP Failure / authResult : %v\n", exchResultStr)
+								n12ContextClosed = true
 								responsePacket = accessRejectEAPfailure
 							default:
 								reqReceivedStatus.discardFlag = true
@@ -262,14 +580,12 @@ func main() {
 					}
 				case 2:
 					log.Printf("[EAP] EAP SubType : %v / AKA-Authentication-Reject\n", compareEapSubType)
-					authRespExchStCode, authRespExchBodyStr, authRespExchErr := authReqExchange(eapPacket.Contents)
+					authRespExchStCode, authRespExchBodyStr, authRespExchErr := authReqExchange(eapPacket.Contents, eapSess.uri)
 					if authRespExchErr != nil {
-						eapIdTableDelete(eapPacket.Id)
 						reqReceivedStatus.discardFlag = true
 						reqReceivedStatus.errReason = "N12 Authentication Response failure."
 						reqReceivedStatus.errString = authRespExchErr
 					} else {
-						eapIdTableDelete(eapPacket.Id)
 						exchEapPayload, exchEapId, exchResultStr, exchErr := authRespBodyDecode(authRespExchStCode, authRespExchBodyStr)
 						if exchErr != nil {
 							reqReceivedStatus.discardFlag = true
@@ -279,21 +595,20 @@ func main() {
 							var code radius.Code = radius.CodeAccessReject
 							log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
 							accessRejectEAPfailure := r.Response(code)
-							accessRejectEAPfailure.Attributes.Add(79, exchEapPayload)
+							eapMessageAdd(accessRejectEAPfailure, exchEapPayload)
 							log.Printf("[EAP] EAP Failure(0x%v) / authResult : %v\n", exchEapId, exchResultStr)
+							n12ContextClosed = true
 							responsePacket = accessRejectEAPfailure
 						}
 					}
 				case 4:
 					log.Printf("[EAP] EAP SubType : %v / AKA-Synchronization-Failure\n", compareEapSubType)
-					authRespExchStCode, authRespExchBodyStr, authRespExchErr := authReqExchange(eapPacket.Contents)
+					authRespExchStCode, authRespExchBodyStr, authRespExchErr := authReqExchange(eapPacket.Contents, eapSess.uri)
 					if authRespExchErr != nil {
-						eapIdTableDelete(eapPacket.Id)
 						reqReceivedStatus.discardFlag = true
 						reqReceivedStatus.errReason = "N12 Authentication Response failure."
 						reqReceivedStatus.errString = authRespExchErr
 					} else {
-						eapIdTableDelete(eapPacket.Id)
 						exchEapPayload, exchEapId, exchResultStr, exchErr := authRespBodyDecode(authRespExchStCode, authRespExchBodyStr)
 						if exchErr != nil {
 							reqReceivedStatus.discardFlag = true
@@ -305,17 +620,18 @@ func main() {
 								var code radius.Code = radius.CodeAccessChallenge
 								log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
 								accessChallengeAKAchallenge := r.Response(code)
-								accessChallengeAKAchallenge.Attributes.Add(79, exchEapPayload)
+								eapMessageAdd(accessChallengeAKAchallenge, exchEapPayload)
 								responsePacket = accessChallengeAKAchallenge
 								log.Println("[EAP] EAP request / AKA-Challenge")
-								eapSessionInfoId = exchEapId
-								eapSessionInfoURI = exchResultStr
+								eapSessionInfo.eapId = exchEapId
+								eapSessionInfo.uri = exchResultStr
 							case 4:
 								var code radius.Code = radius.CodeAccessReject
 								log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
 								accessRejectEAPfailure := r.Response(code)
-								accessRejectEAPfailure.Attributes.Add(79, exchEapPayload)
+								eapMessageAdd(accessRejectEAPfailure, exchEapPayload)
 								log.Printf("[EAP] EAP Failure / authResult : %v\n", exchResultStr)
+								n12ContextClosed = true
 								responsePacket = accessRejectEAPfailure
 							default:
 								reqReceivedStatus.discardFlag = true
@@ -327,23 +643,73 @@ func main() {
 					}
 				case 5:
 					log.Printf("[EAP] EAP SubType : %v / AKA-Identity\n", compareEapSubType)
-					var eapRespAKAidentitySet eapIdentiySet
-					eapRespAKAidentitySet.identityPrefix = string(eapPacket.TypeData[7])
-					eapRespAKAidentitySet.imsi = string(eapPacket.TypeData[8:23])
-					eapRespAKAidentitySet.networkName = string(eapPacket.TypeData[23:])
-					nwName, nwNameErr := toNWNameForN12(eapRespAKAidentitySet.networkName)
-					if nwNameErr != nil {
-						log.Printf("%v\n", nwNameErr)
+					// AT_IDENTITYのIdentityを解析し、永続Identity(IMSIまたはSUCI)ならAUSFへ初回Requestを送る。
+					// 永続Identityでなく、これ以上Identityを要求できない場合はReply-Message付きのAccess-Rejectを返す。
+					var route ausfRoute
+					var routeErr error
+					atIdentity, atIdentityErr := eapAkaAtIdentity(eapPacket.TypeData)
+					eapRespAKAidentitySet, identityErr := eapIdentityParse(atIdentity)
+					if atIdentityErr != nil {
+						identityErr = atIdentityErr
+					}
+					// 永続Identityでなければ、Identity要求の状態(eapSess.identityReq/identityRounds)に従って次の要求を送る。
+					var idReqAttr uint8
+					if identityErr == nil && !isPermanentIdentity(eapRespAKAidentitySet.identityPrefix) {
+						nextReq, nextReqErr := akaIdentityNextRequest(eapRespAKAidentitySet.identityPrefix, eapSess.identityReq, eapSess.identityRounds)
+						if nextReqErr != nil {
+							identityErr = &identityError{part: "AT_IDENTITY", reason: fmt.Sprintf("not a permanent identity : %v (%v)", eapRespAKAidentitySet.identityPrefix, nextReqErr)}
+						} else {
+							idReqAttr = nextReq
+						}
+					}
+					if identityErr == nil && idReqAttr == 0 {
+						route, routeErr = ausfRouteSelect(eapRespAKAidentitySet)
+					}
+					if identityErr == nil && idReqAttr != 0 {
+						var code radius.Code = radius.CodeAccessChallenge
+						log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
+						challengeRespAKAidentityReq, eapSessionId := akaIdentityChallenge(r, idReqAttr)
+						log.Printf("[EAP] EAP request / AKA'-Identity (%v, round %v) for identity prefix %q\n", akaIdentityAttrName(idReqAttr), eapSess.identityRounds+1, eapRespAKAidentitySet.identityPrefix)
+						eapSessionInfo.eapId = eapSessionId
+						eapSessionInfo.identityReq = idReqAttr
+						eapSessionInfo.identityRounds = eapSess.identityRounds + 1
+						responsePacket = challengeRespAKAidentityReq
+					} else if identityErr != nil {
+						var code radius.Code = radius.CodeAccessReject
+						log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
+						rejectResponseInvalidId := r.Response(code)
+						log.Printf("[RADIUS] Invalid identity in AKA-Identity / %v\n", identityErr)
+						if err := rfc2865.ReplyMessage_AddString(rejectResponseInvalidId, fmt.Sprintf("Invalid identity (%v)", identityErr)); err != nil {
+							reqReceivedStatus.discardFlag = true
+							reqReceivedStatus.errReason = "Failed to add Reply-Message."
+							reqReceivedStatus.errString = err
+						} else {
+							responsePacket = rejectResponseInvalidId
+						}
+					} else if errors.Is(routeErr, errAusfRouteNotFound) {
+						var code radius.Code = radius.CodeAccessReject
+						log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
+						rejectResponseNoRoute := r.Response(code)
+						if err := rfc2865.ReplyMessage_AddString(rejectResponseNoRoute, "No AUSF route for this identity."); err != nil {
+							reqReceivedStatus.discardFlag = true
+							reqReceivedStatus.errReason = "Failed to add Reply-Message."
+							reqReceivedStatus.errString = err
+						} else {
+							responsePacket = rejectResponseNoRoute
+						}
+					} else if routeErr != nil {
+						log.Printf("%v\n", routeErr)
 						reqReceivedStatus.discardFlag = true
 						reqReceivedStatus.errReason = "Failed to assemble Network name for N12."
-						reqReceivedStatus.errString = nwNameErr
+						reqReceivedStatus.errString = routeErr
 					} else {
-						authRespFirstStCode, authRespFirstBodyStr, authReqFirstErr := authReqFirst(eapRespAKAidentitySet.imsi, nwName)
+						var supi string = eapRespAKAidentitySet.supiOrSuci
+						authRespFirstStCode, authRespFirstBodyStr, usedAusfAddress, authReqFirstErr := authReqFirst(route, supi)
 						if authReqFirstErr != nil {
 							log.Printf("%v\n", authReqFirstErr)
 							reqReceivedStatus.discardFlag = true
 							reqReceivedStatus.errReason = "Failed to send N12 AuthenticationRequest."
-							reqReceivedStatus.errString = nwNameErr
+							reqReceivedStatus.errString = authReqFirstErr
 						} else {
 							authRespFirstEapPayload, authRespFirstEapId, linkStr, respBodyDecodeErr := authRespBodyDecode(authRespFirstStCode, authRespFirstBodyStr)
 							if respBodyDecodeErr != nil {
@@ -354,10 +720,11 @@ func main() {
 								var code radius.Code = radius.CodeAccessChallenge
 								log.Printf("[RADIUS] writing %v to %v\n", code, r.RemoteAddr)
 								accessChallengeAKAchallenge := r.Response(code)
-								accessChallengeAKAchallenge.Attributes.Add(79, authRespFirstEapPayload)
+								eapMessageAdd(accessChallengeAKAchallenge, authRespFirstEapPayload)
 								responsePacket = accessChallengeAKAchallenge
-								eapSessionInfoId = authRespFirstEapId
-								eapSessionInfoURI = linkStr
+								eapSessionInfo.eapId = authRespFirstEapId
+								eapSessionInfo.uri = linkStr
+								eapSessionInfo.ausfAddress = usedAusfAddress
 							}
 						}
 					}
@@ -371,11 +738,9 @@ func main() {
 						reqReceivedStatus.discardFlag = true
 						reqReceivedStatus.errReason = "Failed to add Reply-Message."
 						reqReceivedStatus.errString = err
-						eapIdTableDelete(eapPacket.Id)
 					} else {
 						responsePacket = rejectResponseEapTypeUnsupEAPsub
 						log.Printf("[EAP] EAP SubType (0x%v) is not supported.\n", compareEapSubType)
-						eapIdTableDelete(eapPacket.Id)
 					}
 				}
 			default:
@@ -393,20 +758,31 @@ func main() {
 				}
 			}
 		}
-		// 上記のResponseパケット生成処理の最終段階として、Proxy-StateとMessage-Authenticator付与処理を実行する。
+		// 上記のResponseパケット生成処理の最終段階として、State・Proxy-State・Message-Authenticator付与処理を実行する。
+		// Access-Challengeには毎回新しいStateを払い出し、次のAccess-Requestで認証セッションを特定できるようにする。
 		// responsePacketが生成されていなければスルー。
+		var eapSessionState []byte
+		var eapSessionStored bool
+		var responseSent bool
+		if responsePacket != nil && responsePacket.Code == radius.CodeAccessChallenge {
+			state, stateErr := eapSessionStateGenerate()
+			if stateErr != nil {
+				reqReceivedStatus.discardFlag = true
+				reqReceivedStatus.errReason = "Failed to generate State."
+				reqReceivedStatus.errString = stateErr
+			} else {
+				eapSessionState = state
+				rfc2865.State_Set(responsePacket, state)
+			}
+		}
 		if responsePacket != nil {
 			if attr33Exist {
 				for _, v := range attr33 {
 					responsePacket.Attributes.Add(33, v)
 				}
 			}
-			responsePacket.Attributes.Add(80, msgAuthOverwriteZero)
-			calculatedMAC, _, psCalcMAC := messageAuthenticatorCalc(responsePacket, []byte(sharedSecret))
-			if psCalcMAC.errString != nil {
-				reqReceivedStatus = psCalcMAC
-			} else {
-				responsePacket.Attributes.Set(80, calculatedMAC)
+			if psSign := messageAuthenticatorSign(responsePacket); psSign.discardFlag {
+				reqReceivedStatus = psSign
 			}
 		}
 		// discardFlagが false のままたどり着けば、受信したAccess-Requestに対するresponse系RADIUSメッセージがここで返送される。
@@ -417,11 +793,18 @@ func main() {
 
 			} else {
 				log.Printf("[RADIUS] %v (ID:0x%v) send to %v\n", responsePacket.Code, responsePacket.Identifier, r.RemoteAddr)
-				if eapSessionInfoURI != "" {
-					tableStoreErr := eapIdTableStore(eapSessionInfoId, eapSessionInfoURI)
-					if tableStoreErr != nil {
-						log.Printf("%v", tableStoreErr)
-					}
+				responseSent = true
+				if eapSessKey != "" {
+					eapSessionConsume(eapSessKey)
+				}
+				if eapSessionState != nil {
+					challengePayload, _ := eapMessageConcat(responsePacket)
+					eapSessionInfo.keyName = eapAkaSessionId(challengePayload)
+					eapSessionStore(eapSessionState, r, eapSessionInfo)
+					eapSessionStored = true
+				}
+				if responsePacket.Code == radius.CodeAccessAccept {
+					authenticatedStaStore(r, acceptedSupi)
 				}
 			}
 		}
@@ -430,15 +813,83 @@ func main() {
 			log.Printf("[RADIUS] %v (ID: %v) is silently discarded.\n", r.Packet.Code, r.Packet.Identifier)
 			log.Printf("[RADIUS] %v / %v\n", reqReceivedStatus.errReason, reqReceivedStatus.errString)
 		}
+		// AUSFの認証コンテキストが残ったまま認証が終わる場合(ローカル要因でのAccess-Reject・破棄、送信失敗等)は、DELETEで解放する。
+		// 新しいlinkをセッションとして格納できなかった場合と、格納済みのlinkを引き継がない応答を送信した場合が対象となる。
+		// 継続中のセッション(eapSess)で破棄・送信失敗した場合は、セッションがテーブルに残り再送で使うため、そのlinkは解放しない
+		// (再送が来なければ、eapSessionTTLを過ぎた時点でeapSessionExpireが解放する)。
+		if !n12ContextClosed {
+			switch {
+			case eapSessionInfo.uri != "" && !eapSessionStored:
+				if newUri := n12LinkResolve(eapSessionInfo.uri, eapSessionInfo.ausfAddress); newUri != eapSess.uri {
+					go authContextRelease(newUri, "authentication aborted")
+				}
+			case responseSent && eapSess.uri != "" && eapSessionInfo.uri == "":
+				go authContextRelease(eapSess.uri, "authentication aborted")
+			}
+		}
+		// 重複検出キャッシュに処理結果を記録し、処理中に届いた重複リクエストを解放する。
+		if dupEntry != nil {
+			if reqReceivedStatus.discardFlag {
+				duplicateCacheComplete(r, dupEntry, nil)
+			} else {
+				duplicateCacheComplete(r, dupEntry, responsePacket)
+			}
+		}
 	}
-	// Radius Serverに対するハンドラと共有秘密鍵の適用
+	// Radius Serverに対するハンドラと共有秘密鍵(Radiusクライアント一覧から送信元ごとに選択)の適用
 	server := radius.PacketServer{
+		Addr:         radiusListenAddr,
 		Handler:      radius.HandlerFunc(handler),
-		SecretSource: radius.StaticSecretSource([]byte(sharedSecret)),
+		SecretSource: clientTableSecretSource{},
+	}
+	go duplicateCacheSweeper()
+	go eapSessionSweeper()
+	go accountingSessionSweeper()
+	go ausfHealthChecker()
+	// Accountingが有効なら、認証用Radius Serverと並行してAccounting Serverを起動する。
+	if accountingEnabled {
+		acctServer := newAccountingServer()
+		go func() {
+			log.Printf("[Accounting] Accounting server start on %v\n", acctServer.Addr)
+			if acctStartErr := acctServer.ListenAndServe(); acctStartErr != nil {
+				log.Println("[Accounting] Activation failed.")
+				log.Fatal(acctStartErr)
+			}
+		}()
+	}
+	// RadSecが有効なら、UDPと同じハンドラでRadSec(TCP/TLS) listenerを起動する。
+	if radsecEnabled {
+		go func() {
+			if radsecStartErr := radsecListenAndServe(radius.HandlerFunc(handler)); radsecStartErr != nil {
+				log.Println("[RadSec] Activation failed.")
+				log.Fatal(radsecStartErr)
+			}
+		}()
+	}
+	// clusterListenが設定されていれば、ピアからの複製を受け付けるサーバと、ピアごとの送信ループを起動する。
+	if clusterListenAddr != "" {
+		go func() {
+			if clusterStartErr := clusterServerStart(); clusterStartErr != nil {
+				log.Println("[Cluster] Activation failed.")
+				log.Fatal(clusterStartErr)
+			}
+		}()
+		for _, peer := range clusterLocalNode.peers {
+			go peer.run(context.Background())
+		}
+	}
+	// adminListenが設定されていれば、管理用HTTPサーバ(CoA/Disconnect等の管理コマンド)を起動する。
+	if adminListenAddr != "" {
+		go func() {
+			if adminStartErr := adminServerStart(); adminStartErr != nil {
+				log.Println("[Admin] Activation failed.")
+				log.Fatal(adminStartErr)
+			}
+		}()
 	}
 	// 上記のRadius Serverを指定してRad-5GC GW起動
-	fmt.Println("[Rad-5GC GW] Activation success and start.")
-	log.Println("[Rad-5GC GW] Activation success and start.")
+	fmt.Printf("[Rad-5GC GW] Activation success and start on %v.\n", radiusListenAddr)
+	log.Printf("[Rad-5GC GW] Activation success and start on %v.\n", radiusListenAddr)
 	if rad5gcGWStartErr := server.ListenAndServe(); rad5gcGWStartErr != nil {
 		log.Println("[Rad-5GC GW] Activation failed.")
 		log.Fatal(rad5gcGWStartErr)
@@ -466,33 +917,52 @@ func multiAttrGet(rp *radius.Packet, t radius.Type) (map[int][]byte, bool) {
 	return attrSet, isExist
 }
 
+// 複数のAttribute 79(EAP-Message)を受信順に連結し、1つのEAPパケットに組み立てる(RFC 3579 Section 3.1)。
+// EAP-Messageが存在しない場合、nilとfalseが返る。
+func eapMessageConcat(rp *radius.Packet) ([]byte, bool) {
+	var eapMessage []byte
+	attrSet, attrExist := multiAttrGet(rp, 79)
+	for i := 0; i < len(attrSet); i++ {
+		eapMessage = append(eapMessage, attrSet[i]...)
+	}
+	return eapMessage, attrExist
+}
+
+// EAPパケットを253byteごとに分割し、複数のAttribute 79(EAP-Message)として順番にRadiusパケットへ追加する。
+// 1つのAttributeに253byteを超える値は格納できないため、AUSFから受け取ったEAPパケットは必ずこの関数で追加すること。
+func eapMessageAdd(rp *radius.Packet, eapPayload []byte) {
+	const eapMessageMaxChunk = 253
+	for len(eapPayload) > 0 {
+		chunkLen := len(eapPayload)
+		if chunkLen > eapMessageMaxChunk {
+			chunkLen = eapMessageMaxChunk
+		}
+		rp.Attributes.Add(79, eapPayload[:chunkLen])
+		eapPayload = eapPayload[chunkLen:]
+	}
+}
+
 // radiusパケットからEAP-Message有無を確認し、あればeapPacketSourceにデコード結果（のlayers.EAP構造体）を返す。戻り値ps.discardFlag:falseを明示。
 // なければEAP-Messageなし＋ps.discardFlag:trueを返す。
-// EAP-Messageが有る場合のMessage-Authenticatorチェックも入れている。
+// Message-Authenticatorのチェックは、事前にmessageAuthenticatorEnforceで(EAP-Messageが有る場合は検証モードによらず)実施済み。
 func isEAPMessageIncluded(r *radius.Request) (processingStatus, *layers.EAP, error) {
 	ps := processingStatus{}
 	eapPacketSource := new(layers.EAP)
-	var df gopacket.DecodeFeedback
-	var returnAttr79 radius.Attribute
-	returnAttr79, _ = r.Packet.Attributes.Lookup(79)
-	if returnAttr79 != nil {
+	// 分割されたEAP-Messageの一部が欠けているとEAPヘッダのLengthに満たないため、DecodeFromBytesがSetTruncatedを呼べるようにしておく。
+	var df gopacket.DecodeFeedback = gopacket.NilDecodeFeedback
+	// EAP-Messageは253byteを超えると複数のAttribute 79に分割されて届くため、全て連結してから扱う。
+	returnAttr79, attr79Exist := eapMessageConcat(r.Packet)
+	if attr79Exist {
 		log.Printf("[EAP] EAP-Message: %X", returnAttr79)
-		_, msgAuthCheckResult, msgAuthCheckPs := messageAuthenticatorCalc(r.Packet, []byte(sharedSecret))
-		if msgAuthCheckResult {
-			if err := eapPacketSource.DecodeFromBytes(returnAttr79, df); err != nil {
-				ps.discardFlag = true
-				ps.errReason = "EAP Packet decoding failure"
-				ps.errString = err
-			} else {
-				ps.discardFlag = false
-				log.Printf("[EAP] Code: 0x%X, Id: 0x%X, Length: 0x%X, EAPType: 0x%X\n", eapPacketSource.Code, eapPacketSource.Id, eapPacketSource.Length, eapPacketSource.Type)
-				log.Printf("[EAP] TypeData: %X\n", eapPacketSource.TypeData)
-				// log.Printf("EAP layer contents : 0x%X\n", eapPacketSource.BaseLayer.Contents)
-			}
+		if err := eapPacketSource.DecodeFromBytes(returnAttr79, df); err != nil {
+			ps.discardFlag = true
+			ps.errReason = "EAP Packet decoding failure"
+			ps.errString = err
 		} else {
-			ps.discardFlag = msgAuthCheckPs.discardFlag
-			ps.errReason = msgAuthCheckPs.errReason
-			ps.errString = msgAuthCheckPs.errString
+			ps.discardFlag = false
+			log.Printf("[EAP] Code: 0x%X, Id: 0x%X, Length: 0x%X, EAPType: 0x%X\n", eapPacketSource.Code, eapPacketSource.Id, eapPacketSource.Length, eapPacketSource.Type)
+			log.Printf("[EAP] TypeData: %X\n", eapPacketSource.TypeData)
+			// log.Printf("EAP layer contents : 0x%X\n", eapPacketSource.BaseLayer.Contents)
 		}
 	} else {
 		ps.discardFlag = true
@@ -502,32 +972,27 @@ func isEAPMessageIncluded(r *radius.Request) (processingStatus, *layers.EAP, err
 	return ps, eapPacketSource, ps.errString
 }
 
-// Responseに入れるMessage-Authenticatorの算出にも使い回せるようにできている、はず。
+// 受信したRadiusパケットのMessage-Authenticatorを検証する。検証モードに応じた判定はmessageAuthenticatorEnforceで行う。
 // Message-Authenticatorを持たないRadiusパケットを引数に取るとmsgAuthNotFoundErrを返すようにしている。
-// EAP-Messageを持たないパケットにMessage-Authenticatorを追加したい場合は、radius.Attributes.Addメソッドで事前にAVP自体を追加しておくこと。
+// 応答パケットへのMessage-Authenticator付与は、先頭に配置するためmessageAuthenticatorSignを使うこと。
 func messageAuthenticatorCalc(rp *radius.Packet, sharedSecret []byte) ([]byte, bool, processingStatus) {
-	var resultErrStrings error
 	var ps processingStatus
 	messageAuthenticator, msgAuthNotFoundErr := rfc2869.MessageAuthenticator_Lookup(rp)
-	if msgAuthNotFoundErr != nil {
-		resultErrStrings = msgAuthNotFoundErr
-	}
-	var chPkt *radius.Packet = rp
+	// 受信パケット自体のMessage-Authenticatorを書き換えないよう、Attributeのスライスを複製してから0x00で上書きする。
+	chPkt := *rp
+	chPkt.Attributes = append(radius.Attributes(nil), rp.Attributes...)
 	chPkt.Attributes.Set(80, msgAuthOverwriteZero)
 	chBytes, chBytesErr := chPkt.MarshalBinary()
-	if chBytesErr != nil {
-		resultErrStrings = chBytesErr
-	}
 	mac := hmac.New(md5.New, sharedSecret)
 	mac.Write(chBytes)
 	expectedMAC := mac.Sum(nil)
 	result := hmac.Equal(expectedMAC, messageAuthenticator)
 	switch {
-	case resultErrStrings == msgAuthNotFoundErr:
+	case msgAuthNotFoundErr != nil:
 		ps.discardFlag = true
 		ps.errReason = "AVP Message-Authenticator not found."
 		ps.errString = msgAuthNotFoundErr
-	case resultErrStrings == chBytesErr:
+	case chBytesErr != nil:
 		ps.discardFlag = true
 		ps.errReason = "Packet marshaling error."
 		ps.errString = chBytesErr
@@ -539,48 +1004,71 @@ func messageAuthenticatorCalc(rp *radius.Packet, sharedSecret []byte) ([]byte, b
 	return expectedMAC, result, ps
 }
 
-// EAPパケットでEAP-Type:Identity(1)が来ているとき、EAPパケット内のTypeDataの長さをチェックして
-// 適切(Prefix:1byte/IMSI:15byte/NAI:35byte)ならeapIdentiySet型にして返す。
-// そうでなければ、元EAPパケットのTypeDataをstringにしてidentityPrefixに詰め込み、他を""(ゼロ値)にしてeapIdentiySet型で返す。
-func eapIdentityByteToString(p *layers.EAP) eapIdentiySet {
+// EAP-Response/IdentityまたはAT_IDENTITYのIdentityを解析してeapIdentiySet型にして返す。
+// NAIはRFC 7542に従って分解し、ユーザ名の先頭1文字をidentityPrefixとする。永続Identity("0"/"6")なら、続く14～15桁をIMSIとする。
+// SUCI形式のNAI("type0.rid...")なら、identityPrefixをidentityPrefixSuciとし、supiOrSuciにSUCI文字列を入れて返す。
+// 匿名のNAI("anonymous@realm"または"@realm")なら、identityPrefixをidentityPrefixAnonymousとする。
+// 解析できない場合はidentityError型のエラーを返す(identityPrefixは空)。
+func eapIdentityParse(identity string) (eapIdentiySet, error) {
 	var set eapIdentiySet
-	if len(p.TypeData) == 51 {
-		set.identityPrefix = string(p.TypeData[0])
-		set.imsi = string(p.TypeData[1:16])
-		set.networkName = string(p.TypeData[16:])
-	} else {
-		set.identityPrefix = string(p.TypeData)
-		set.imsi = ""
-		set.networkName = ""
+	if isSuciNai(identity) {
+		suci, suciErr := parseSuciNai(identity)
+		if suciErr != nil {
+			return set, &identityError{part: "SUCI", reason: suciErr.Error()}
+		}
+		set.identityPrefix = identityPrefixSuci
+		set.imsi = suci.imsiForRouting()
+		set.networkName = suci.networkName
+		set.routingIndicator = suci.routingIndicator
+		set.supiOrSuci = suci.supiOrSuci()
+		return set, nil
 	}
-	return set
+	parsed, naiErr := parseNai(identity)
+	if naiErr != nil {
+		return set, naiErr
+	}
+	if parsed.realm != "" {
+		set.networkName = "@" + parsed.realm
+	}
+	set.homeRealm = parsed.homeRealm
+	if isAnonymousUsername(parsed.username) {
+		if parsed.realm == "" {
+			return set, &identityError{part: "username", reason: "anonymous identity without realm"}
+		}
+		set.identityPrefix = identityPrefixAnonymous
+		return set, nil
+	}
+	prefix := parsed.username[:1]
+	switch prefix {
+	case "0", "6":
+		imsi := parsed.username[1:]
+		if len(imsi) < 14 || len(imsi) > 15 || !isDigits(imsi) {
+			return set, &identityError{part: "username", reason: fmt.Sprintf("IMSI must be 14 or 15 digits : %q", imsi)}
+		}
+		set.imsi = imsi
+		set.supiOrSuci = "imsi-" + imsi
+	}
+	set.identityPrefix = prefix
+	return set, nil
 }
 
-// 最初のEAP-Response/AKA-identtyで仮名・高速再認証のIdentityPrefixが来たケースで、FullAuthで差し戻すためのEAP-Request用IDを生成するためのもの。
-// AUSFから返ってくるEAP-RequestのEAP-IDと衝突しないよう、ランダムId生成後にグローバル変数eapIdTableをチェックして使用中だったら再生成に入る。
+// 仮名・高速再認証・匿名のIdentityが来たケースで、AKA'-IdentityでIdentityを要求し直すためのEAP-Request用IDを生成するためのもの。
+// 認証セッションはState(24)で特定するため、AUSFが使用中のEAP-IDと重複しても問題ない。
 func generateEAPId() byte {
-	var generatedId byte
-	for {
-		seed := time.Now().UnixNano()
-		randGenerator := rand.New(rand.NewSource(seed))
-		zeroToFFInt := randGenerator.Intn(255)
-		_, ok := eapIdTableLoad(byte(zeroToFFInt))
-		if !ok {
-			generatedId = byte(zeroToFFInt)
-			break
-		}
-	}
-	return generatedId
+	seed := time.Now().UnixNano()
+	randGenerator := rand.New(rand.NewSource(seed))
+	return byte(randGenerator.Intn(256))
 }
 
 // 最初のN12 AuthenticationRequestを送信するための引数ServingNetworkNameを作成するための関数。
-// 構造体eapIdentiySet.networkNameを引数に取ることを想定している。
+// 構造体eapIdentiySet.networkNameを引数に取ることを想定している。ausfRouteSelectで、ルートにservingNetworkNameがない場合に使われる。
+// "@wlan.～"に限らず、SUCI形式のNAIのRealm("@nai.5gc.～")等、"mncXXX.mccYYY.3gppnetwork.org"で終わるRealmは
+// "5G:mncXXX.mccYYY.3gppnetwork.org"に変換する。それ以外のRealmはルートのservingNetworkNameで指定する必要がある。
 func toNWNameForN12(str string) (string, error) {
 	var nwNameErr error
 	var modifiedStr string
-	if strings.HasPrefix(str, "@wlan.") && strings.HasSuffix(str, ".3gppnetwork.org") {
-		cutStr, _ := strings.CutPrefix(str, "@wlan.")
-		modifiedStr = "5G:" + cutStr
+	if matched := realmPlmnPattern.FindStringSubmatch(strings.ToLower(str)); matched != nil {
+		modifiedStr = fmt.Sprintf("5G:mnc%v.mcc%v.3gppnetwork.org", matched[1], matched[2])
 	} else {
 		err := errors.New("invalid network name")
 		nwNameErr = err
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestEapIdentityParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity string
+		want     eapIdentiySet
+		wantErr  bool
+	}{
+		{name: "15-digit IMSI", identity: "0001010123456789@wlan.mnc001.mcc001.3gppnetwork.org",
+			want: eapIdentiySet{identityPrefix: "0", imsi: "001010123456789", supiOrSuci: "imsi-001010123456789", networkName: "@wlan.mnc001.mcc001.3gppnetwork.org"}},
+		{name: "14-digit IMSI", identity: "600101012345678@wlan.mnc01.mcc001.3gppnetwork.org",
+			want: eapIdentiySet{identityPrefix: "6", imsi: "00101012345678", supiOrSuci: "imsi-00101012345678", networkName: "@wlan.mnc01.mcc001.3gppnetwork.org"}},
+		{name: "13-digit IMSI", identity: "00010101234567@wlan.mnc001.mcc001.3gppnetwork.org", wantErr: true},
+		{name: "16-digit IMSI", identity: "00010101234567890@wlan.mnc001.mcc001.3gppnetwork.org", wantErr: true},
+		{name: "non-digit IMSI", identity: "000101012345678a@wlan.mnc001.mcc001.3gppnetwork.org", wantErr: true},
+		{name: "pseudonym", identity: "2pseudonym@wlan.mnc001.mcc001.3gppnetwork.org",
+			want: eapIdentiySet{identityPrefix: "2", networkName: "@wlan.mnc001.mcc001.3gppnetwork.org"}},
+		{name: "anonymous", identity: "anonymous@wlan.mnc001.mcc001.3gppnetwork.org",
+			want: eapIdentiySet{identityPrefix: identityPrefixAnonymous, networkName: "@wlan.mnc001.mcc001.3gppnetwork.org"}},
+		{name: "realm only", identity: "@wlan.mnc001.mcc001.3gppnetwork.org",
+			want: eapIdentiySet{identityPrefix: identityPrefixAnonymous, networkName: "@wlan.mnc001.mcc001.3gppnetwork.org"}},
+		{name: "anonymous without realm", identity: "anonymous", wantErr: true},
+		{name: "decorated", identity: "wlan.mnc001.mcc001.3gppnetwork.org!0001010123456789@visited.example.net",
+			want: eapIdentiySet{identityPrefix: "0", imsi: "001010123456789", supiOrSuci: "imsi-001010123456789", networkName: "@visited.example.net", homeRealm: "wlan.mnc001.mcc001.3gppnetwork.org"}},
+		{name: "SUCI", identity: "type0.rid678.schid0.userid0999999999@nai.5gc.mnc015.mcc234.3gppnetwork.org",
+			want: eapIdentiySet{identityPrefix: identityPrefixSuci, imsi: "234150999999999", supiOrSuci: "suci-0-234-15-678-0-0-0999999999", networkName: "@nai.5gc.mnc015.mcc234.3gppnetwork.org", routingIndicator: "678"}},
+		{name: "invalid SUCI", identity: "type0.rid678.schid9.userid0999999999@nai.5gc.mnc015.mcc234.3gppnetwork.org", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := eapIdentityParse(tt.identity)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("eapIdentityParse(%q) = %+v, want %+v", tt.identity, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToNWNameForN12(t *testing.T) {
+	tests := []struct {
+		networkName string
+		want        string
+		wantErr     bool
+	}{
+		{networkName: "@wlan.mnc001.mcc001.3gppnetwork.org", want: "5G:mnc001.mcc001.3gppnetwork.org"},
+		{networkName: "@WLAN.MNC015.MCC234.3GPPNETWORK.ORG", want: "5G:mnc015.mcc234.3gppnetwork.org"},
+		{networkName: "@nai.5gc.mnc260.mcc310.3gppnetwork.org", want: "5G:mnc260.mcc310.3gppnetwork.org"},
+		{networkName: "@ims.mnc123.mcc310.3gppnetwork.org", want: "5G:mnc123.mcc310.3gppnetwork.org"},
+		{networkName: "@visited.example.net", wantErr: true},
+		{networkName: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := toNWNameForN12(tt.networkName)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("toNWNameForN12(%q) = %q, want error", tt.networkName, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("toNWNameForN12(%q) = %q, %v, want %q", tt.networkName, got, err, tt.want)
+		}
+	}
+}
+
+// Code 2(Response)・Identifier 5・Type 50(EAP-AKA')で、TypeDataがtypeDataLen byteのEAPパケットを生成する。
+func eapResponseForTest(typeDataLen int) []byte {
+	eap := make([]byte, 5+typeDataLen)
+	eap[0], eap[1], eap[4] = 2, 5, 50
+	binary.BigEndian.PutUint16(eap[2:4], uint16(len(eap)))
+	for i := range typeDataLen {
+		eap[5+i] = byte(i)
+	}
+	return eap
+}
+
+func TestEapMessageFragmentation(t *testing.T) {
+	tests := []struct {
+		payloadLen  int
+		wantLengths []int
+	}{
+		{payloadLen: 0},
+		{payloadLen: 8, wantLengths: []int{8}},
+		{payloadLen: 253, wantLengths: []int{253}},
+		{payloadLen: 254, wantLengths: []int{253, 1}},
+		{payloadLen: 600, wantLengths: []int{253, 253, 94}},
+	}
+	for _, tt := range tests {
+		payload := make([]byte, tt.payloadLen)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		packet := radius.New(radius.CodeAccessChallenge, []byte("secret"))
+		rfc2865.State_Set(packet, []byte("state"))
+		eapMessageAdd(packet, payload)
+		var gotLengths []int
+		for _, attr := range packet.Attributes {
+			if attr.Type == 79 {
+				gotLengths = append(gotLengths, len(attr.Attribute))
+			}
+		}
+		if !slices.Equal(gotLengths, tt.wantLengths) {
+			t.Errorf("%v byte payload split into %v, want %v", tt.payloadLen, gotLengths, tt.wantLengths)
+		}
+		concatenated, exist := eapMessageConcat(packet)
+		if exist != (tt.payloadLen > 0) || !bytes.Equal(concatenated, payload) {
+			t.Errorf("%v byte payload reassembled into %v bytes (exist: %v)", tt.payloadLen, len(concatenated), exist)
+		}
+	}
+}
+
+func TestIsEAPMessageIncluded(t *testing.T) {
+	eap := eapResponseForTest(400)
+	tests := []struct {
+		name        string
+		fragments   [][]byte
+		wantDiscard bool
+	}{
+		{name: "single attribute", fragments: [][]byte{eapResponseForTest(20)}},
+		{name: "fragmented", fragments: [][]byte{eap[:253], eap[253:]}},
+		{name: "missing last fragment", fragments: [][]byte{eap[:253]}, wantDiscard: true},
+		{name: "too short", fragments: [][]byte{{2, 5}}, wantDiscard: true},
+		{name: "no EAP-Message", wantDiscard: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := radius.New(radius.CodeAccessRequest, []byte("secret"))
+			for i, fragment := range tt.fragments {
+				packet.Attributes.Add(79, fragment)
+				// 分割されたEAP-Messageの間に他のAttributeがあっても、EAP-Messageだけを順に連結する。
+				if i == 0 {
+					rfc2865.UserName_SetString(packet, "user")
+				}
+			}
+			ps, eapPacket, err := isEAPMessageIncluded(&radius.Request{Packet: packet})
+			if ps.discardFlag != tt.wantDiscard || (err != nil) != tt.wantDiscard {
+				t.Fatalf("discardFlag = %v (%v / %v), want %v", ps.discardFlag, ps.errReason, err, tt.wantDiscard)
+			}
+			if tt.wantDiscard {
+				return
+			}
+			if eapPacket.Type != 50 || int(eapPacket.Length) != len(bytes.Join(tt.fragments, nil)) {
+				t.Errorf("decoded EAP = type %v, length %v", eapPacket.Type, eapPacket.Length)
+			}
+		})
+	}
+}
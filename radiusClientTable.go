@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"layeh.com/radius"
+)
+
+// Radiusクライアント(Wi-Fi AP/コントローラ等のNAS)1件分の設定を格納する構造体。
+// networkは単一IPアドレスの場合も/32(IPv6なら/128)のネットワークとして扱う。
+// nasIdentifierが空でなければ、Access-RequestのNAS-Identifier(32)が一致する場合のみ許容する。
+// radsecNameはRadSec接続時にクライアント証明書(CNまたはSAN DNS名)と照合する名前で、RadSec専用のエントリはnetworkがnilとなる。
+// msgAuthModeはAccess-RequestのMessage-Authenticator検証モード(messageAuthenticator.go参照)。
+type radiusClient struct {
+	network       *net.IPNet
+	nasIdentifier string
+	secret        []byte
+	description   string
+	radsecName    string
+	msgAuthMode   msgAuthMode
+}
+
+// ログ出力用。RadSec専用エントリはアドレスを持たないので、radsecNameで表記する。
+func (c radiusClient) String() string {
+	if c.network == nil {
+		return "radsec:" + c.radsecName + " " + c.description
+	}
+	return c.network.String() + " " + c.description
+}
+
+// 設定ファイルから読み出したRadiusクライアント一覧。configure()で生成し、以後は読み出し専用で使う。
+var radiusClientTable []radiusClient
+
+// 設定ファイルのradiusClients(radiusClientConfig型のスライス)からRadiusクライアント一覧を生成する。
+// radiusClientsが未設定の場合は、従来のsharedSecret/allowedClientAddressから1件だけ生成する（旧設定ファイル互換）。
+func buildRadiusClientTable(conf rad5gcConfig) ([]radiusClient, error) {
+	var table []radiusClient
+	var buildErr error
+	clientConfs := conf.ConfRadiusClients
+	if len(clientConfs) == 0 {
+		clientConfs = []radiusClientConfig{{
+			Address:      conf.ConfAllowedClientAddress,
+			SharedSecret: conf.ConfSharedSecret,
+			Description:  "allowedClientAddress (legacy)",
+		}}
+	}
+	for i, c := range clientConfs {
+		// messageAuthenticatorが未設定のエントリは、トップレベルのmessageAuthenticatorを既定値として使う。
+		modeStr := c.MessageAuthenticator
+		if modeStr == "" {
+			modeStr = conf.ConfMessageAuthenticator
+		}
+		mode, modeErr := parseMsgAuthMode(modeStr)
+		if modeErr != nil {
+			buildErr = fmt.Errorf("radiusClients[%v]: %w", i, modeErr)
+			break
+		}
+		// RadSec専用エントリ(radsecNameのみ設定)はアドレスと共有秘密鍵を持たない。
+		if c.Address == "" && c.RadsecName != "" {
+			table = append(table, radiusClient{
+				nasIdentifier: c.NASIdentifier,
+				description:   c.Description,
+				radsecName:    c.RadsecName,
+				msgAuthMode:   mode,
+			})
+			continue
+		}
+		ipNet, parseErr := parseClientAddress(c.Address)
+		if parseErr != nil {
+			buildErr = fmt.Errorf("radiusClients[%v]: %w", i, parseErr)
+			break
+		}
+		if len(c.SharedSecret) > 258 || len(c.SharedSecret) < 1 {
+			buildErr = fmt.Errorf("radiusClients[%v]: shared secret is too short or long", i)
+			break
+		}
+		table = append(table, radiusClient{
+			network:       ipNet,
+			nasIdentifier: c.NASIdentifier,
+			secret:        []byte(c.SharedSecret),
+			description:   c.Description,
+			radsecName:    c.RadsecName,
+			msgAuthMode:   mode,
+		})
+	}
+	if buildErr == nil {
+		buildErr = radiusClientSecretConflict(table)
+	}
+	return table, buildErr
+}
+
+// 共有秘密鍵はパケット解析前にアドレスだけで決まる(clientTableSecretSource)ため、同じ送信元アドレスで
+// NAS-Identifierによって異なるエントリが選ばれうる設定では、エントリごとに共有秘密鍵を変えられない。
+// 以下の組み合わせで共有秘密鍵が異なる場合はエラーとする。
+//   - 同じアドレス(ネットワーク)のエントリ同士
+//   - nasIdentifierを設定したエントリと、それを含むより広いネットワークのエントリ
+//     (NAS-Identifierが一致しないリクエストは広い方のエントリで許容されるが、秘密鍵は狭い方のものが使われるため)
+func radiusClientSecretConflict(table []radiusClient) error {
+	for i, a := range table {
+		for _, b := range table[i+1:] {
+			if a.network == nil || b.network == nil || string(a.secret) == string(b.secret) {
+				continue
+			}
+			narrow, wide := a, b
+			narrowLen, _ := narrow.network.Mask.Size()
+			wideLen, _ := wide.network.Mask.Size()
+			if narrowLen < wideLen {
+				narrow, wide = b, a
+				narrowLen, wideLen = wideLen, narrowLen
+			}
+			if !wide.network.Contains(narrow.network.IP) {
+				continue
+			}
+			if narrowLen == wideLen || narrow.nasIdentifier != "" {
+				return fmt.Errorf("radiusClients %v and %v: clients sharing an address must use the same shared secret", narrow.network, wide.network)
+			}
+		}
+	}
+	return nil
+}
+
+// 設定値のアドレス文字列を*net.IPNetに変換する。CIDR表記でなければ単一ホストのネットワークとみなす。
+func parseClientAddress(addr string) (*net.IPNet, error) {
+	if strings.Contains(addr, "/") {
+		_, ipNet, cidrErr := net.ParseCIDR(addr)
+		if cidrErr != nil {
+			return nil, errors.New("invalid client CIDR : " + addr)
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, errors.New("invalid client Address : " + addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// net.Addr(UDP/TCPどちらでも)からIPアドレス部分だけを取り出す。
+func remoteAddrToIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, splitErr := net.SplitHostPort(addr.String())
+	if splitErr != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// 送信元アドレスとNAS-Identifierから該当するRadiusクライアントを検索する。
+// 複数エントリに該当する場合はプレフィックス長が最も長い（より限定的な）エントリを優先する。
+// nasIdentifierが設定されたエントリは、引数nasIdが一致しなければ対象外となる。
+func radiusClientLookup(addr net.Addr, nasId string) (radiusClient, bool) {
+	var found radiusClient
+	var ok bool
+	bestLen := -1
+	ip := remoteAddrToIP(addr)
+	if ip == nil {
+		return found, false
+	}
+	for _, c := range radiusClientTable {
+		if c.network == nil || !c.network.Contains(ip) {
+			continue
+		}
+		if c.nasIdentifier != "" && c.nasIdentifier != nasId {
+			continue
+		}
+		prefixLen, _ := c.network.Mask.Size()
+		if prefixLen > bestLen {
+			bestLen = prefixLen
+			found = c
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// 受信したRadiusリクエストの送信元クライアントを特定する。
+// RadSec経由の場合はクライアント証明書で特定済みのエントリがcontextに入っているので、NAS-Identifierのみ照合する。
+// UDP経由の場合はradiusClientLookupで送信元アドレスとNAS-Identifierから検索する。
+// UDP経由で、パケットの認証に使った共有秘密鍵(clientTableSecretSource)が特定したエントリのものと異なる場合は許容しない
+// (radiusClientSecretConflictで設定時に弾いているため、通常は起こらない)。
+func requestClientLookup(r *radius.Request, nasId string) (radiusClient, bool) {
+	if c, ok := r.Context().Value(radsecClientContextKey{}).(radiusClient); ok {
+		if c.nasIdentifier != "" && c.nasIdentifier != nasId {
+			return c, false
+		}
+		return c, true
+	}
+	c, ok := radiusClientLookup(r.RemoteAddr, nasId)
+	if ok && !bytes.Equal(c.secret, r.Secret) {
+		log.Printf("[RADIUS] shared secret of client %v differs from the one used for the packet\n", c)
+		return c, false
+	}
+	return c, ok
+}
+
+// radius.SecretSourceの実装。送信元アドレスからRadiusクライアントを特定して共有秘密鍵を返す。
+// この段階ではパケット未解析のためNAS-Identifierは見ずにアドレスのみで判定し、NAS-Identifierはハンドラ側で再チェックする。
+// 未登録クライアントにはnilを返すので、radiusパッケージ側でEAP処理前に破棄される。
+type clientTableSecretSource struct{}
+
+func (s clientTableSecretSource) RADIUSSecret(ctx context.Context, remoteAddr net.Addr) ([]byte, error) {
+	var secret []byte
+	bestLen := -1
+	ip := remoteAddrToIP(remoteAddr)
+	if ip == nil {
+		return nil, nil
+	}
+	for _, c := range radiusClientTable {
+		if c.network == nil {
+			continue
+		}
+		prefixLen, _ := c.network.Mask.Size()
+		if c.network.Contains(ip) && prefixLen > bestLen {
+			bestLen = prefixLen
+			secret = c.secret
+		}
+	}
+	if secret == nil {
+		log.Printf("[RADIUS] Client IP Address not Allowed : %v\n", ip)
+	}
+	return secret, nil
+}
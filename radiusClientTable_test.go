@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"layeh.com/radius"
+)
+
+func TestBuildRadiusClientTable(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     rad5gcConfig
+		wantLen  int
+		wantMode msgAuthMode
+		wantErr  bool
+	}{
+		{name: "legacy single client", conf: rad5gcConfig{ConfAllowedClientAddress: "192.0.2.1", ConfSharedSecret: "secret"},
+			wantLen: 1, wantMode: msgAuthModeRequire},
+		{name: "default mode from top level", conf: rad5gcConfig{ConfMessageAuthenticator: "legacy", ConfRadiusClients: []radiusClientConfig{
+			{Address: "192.0.2.0/24", SharedSecret: "secret"},
+		}}, wantLen: 1, wantMode: msgAuthModeLegacy},
+		{name: "radsec only entry", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{
+			{RadsecName: "ap01.example.net", MessageAuthenticator: "require-first"},
+		}}, wantLen: 1, wantMode: msgAuthModeRequireFirst},
+		{name: "invalid address", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{{Address: "192.0.2.300", SharedSecret: "secret"}}}, wantErr: true},
+		{name: "invalid CIDR", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{{Address: "192.0.2.0/33", SharedSecret: "secret"}}}, wantErr: true},
+		{name: "empty secret", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{{Address: "192.0.2.1"}}}, wantErr: true},
+		{name: "invalid mode", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{{Address: "192.0.2.1", SharedSecret: "secret", MessageAuthenticator: "off"}}}, wantErr: true},
+		{name: "same address and secret per NAS-Identifier", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{
+			{Address: "192.0.2.1", NASIdentifier: "wlc-a", SharedSecret: "secret"},
+			{Address: "192.0.2.1", NASIdentifier: "wlc-b", SharedSecret: "secret"},
+		}}, wantLen: 2, wantMode: msgAuthModeRequire},
+		{name: "same address with different secrets", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{
+			{Address: "192.0.2.1", NASIdentifier: "wlc-a", SharedSecret: "secret-a"},
+			{Address: "192.0.2.1", NASIdentifier: "wlc-b", SharedSecret: "secret-b"},
+		}}, wantErr: true},
+		{name: "NAS-Identifier entry inside wider entry with different secret", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{
+			{Address: "192.0.2.0/24", SharedSecret: "secret-a"},
+			{Address: "192.0.2.1", NASIdentifier: "wlc-b", SharedSecret: "secret-b"},
+		}}, wantErr: true},
+		// 狭い方のエントリがNAS-Identifierを問わなければ、そのアドレスでは常に狭い方が選ばれるため、秘密鍵が異なってもよい。
+		{name: "narrower entry with different secret", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{
+			{Address: "192.0.2.0/24", NASIdentifier: "wlc-a", SharedSecret: "secret-a"},
+			{Address: "192.0.2.1", SharedSecret: "secret-b"},
+		}}, wantLen: 2, wantMode: msgAuthModeRequire},
+		{name: "disjoint networks with different secrets", conf: rad5gcConfig{ConfRadiusClients: []radiusClientConfig{
+			{Address: "192.0.2.0/25", NASIdentifier: "wlc-a", SharedSecret: "secret-a"},
+			{Address: "192.0.2.128/25", NASIdentifier: "wlc-b", SharedSecret: "secret-b"},
+		}}, wantLen: 2, wantMode: msgAuthModeRequire},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := buildRadiusClientTable(tt.conf)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", table)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(table) != tt.wantLen || table[0].msgAuthMode != tt.wantMode {
+				t.Errorf("table = %v (mode %v), want %v entries (mode %v)", table, table[0].msgAuthMode, tt.wantLen, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestRadiusClientLookup(t *testing.T) {
+	table, buildErr := buildRadiusClientTable(rad5gcConfig{ConfRadiusClients: []radiusClientConfig{
+		{Address: "192.0.2.0/24", SharedSecret: "site-secret", Description: "site"},
+		{Address: "192.0.2.10", NASIdentifier: "wlc-a", SharedSecret: "wlc-secret", Description: "wlc-a"},
+		{Address: "192.0.2.20", SharedSecret: "wlc-secret", Description: "wlc-b"},
+		{Address: "2001:db8::/64", SharedSecret: "v6-secret", Description: "v6"},
+		{RadsecName: "ap01.example.net", Description: "radsec"},
+	}})
+	if buildErr == nil {
+		t.Fatal("expected conflict between site (192.0.2.0/24) and wlc-a (192.0.2.10, NAS-Identifier)")
+	}
+	table, buildErr = buildRadiusClientTable(rad5gcConfig{ConfRadiusClients: []radiusClientConfig{
+		{Address: "192.0.2.0/24", SharedSecret: "site-secret", Description: "site"},
+		{Address: "192.0.2.20", SharedSecret: "wlc-secret", Description: "wlc-b"},
+		{Address: "2001:db8::/64", SharedSecret: "v6-secret", Description: "v6"},
+		{RadsecName: "ap01.example.net", Description: "radsec"},
+	}})
+	if buildErr != nil {
+		t.Fatal(buildErr)
+	}
+	savedTable := radiusClientTable
+	t.Cleanup(func() { radiusClientTable = savedTable })
+	radiusClientTable = table
+
+	tests := []struct {
+		name       string
+		addr       string
+		nasId      string
+		want       string
+		wantSecret string
+	}{
+		{name: "network entry", addr: "192.0.2.5", want: "site", wantSecret: "site-secret"},
+		{name: "longest prefix", addr: "192.0.2.20", want: "wlc-b", wantSecret: "wlc-secret"},
+		{name: "IPv6", addr: "2001:db8::1", want: "v6", wantSecret: "v6-secret"},
+		{name: "unknown address", addr: "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := &net.UDPAddr{IP: net.ParseIP(tt.addr), Port: 1812}
+			c, ok := radiusClientLookup(addr, tt.nasId)
+			if ok != (tt.want != "") || c.description != tt.want {
+				t.Errorf("radiusClientLookup(%v, %q) = %v (%v), want %q", tt.addr, tt.nasId, c, ok, tt.want)
+			}
+			secret, _ := clientTableSecretSource{}.RADIUSSecret(context.Background(), addr)
+			if string(secret) != tt.wantSecret {
+				t.Errorf("RADIUSSecret(%v) = %q, want %q", tt.addr, secret, tt.wantSecret)
+			}
+		})
+	}
+}
+
+func TestRequestClientLookup(t *testing.T) {
+	savedTable := radiusClientTable
+	t.Cleanup(func() { radiusClientTable = savedTable })
+	radiusClientTable = []radiusClient{
+		{network: &net.IPNet{IP: net.IPv4(192, 0, 2, 0).To4(), Mask: net.CIDRMask(24, 32)}, secret: []byte("site-secret"), description: "site"},
+		{network: &net.IPNet{IP: net.IPv4(192, 0, 2, 10).To4(), Mask: net.CIDRMask(32, 32)}, nasIdentifier: "wlc-a", secret: []byte("wlc-secret"), description: "wlc-a"},
+	}
+	radsecClient := radiusClient{nasIdentifier: "ap01", radsecName: "ap01.example.net", description: "radsec"}
+	tests := []struct {
+		name   string
+		addr   string
+		secret string
+		nasId  string
+		radsec bool
+		want   string
+	}{
+		{name: "UDP", addr: "192.0.2.5", secret: "site-secret", want: "site"},
+		{name: "UDP with NAS-Identifier", addr: "192.0.2.10", secret: "wlc-secret", nasId: "wlc-a", want: "wlc-a"},
+		// NAS-Identifierが一致しないと広い方のエントリになるが、パケットは狭い方の秘密鍵で認証されているため許容しない。
+		{name: "secret of other entry", addr: "192.0.2.10", secret: "wlc-secret", nasId: "wlc-b"},
+		{name: "RadSec", addr: "198.51.100.1", secret: "radsec", nasId: "ap01", radsec: true, want: "radsec"},
+		{name: "RadSec NAS-Identifier mismatch", addr: "198.51.100.1", secret: "radsec", nasId: "ap02", radsec: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &radius.Request{
+				Packet:     radius.New(radius.CodeAccessRequest, []byte(tt.secret)),
+				RemoteAddr: &net.UDPAddr{IP: net.ParseIP(tt.addr), Port: 1812},
+			}
+			if tt.radsec {
+				r = r.WithContext(context.WithValue(context.Background(), radsecClientContextKey{}, radsecClient))
+			}
+			c, ok := requestClientLookup(r, tt.nasId)
+			if ok != (tt.want != "") || (ok && c.description != tt.want) {
+				t.Errorf("requestClientLookup = %v (%v), want %q", c, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+)
+
+// RFC 6614 では、RadSecの共有秘密鍵は固定文字列 "radsec" を使う。
+var radsecSharedSecret = []byte("radsec")
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+var radsecEnabled bool
+var radsecListenAddr string
+var radsecCertFile string
+var radsecKeyFile string
+var radsecClientCAFile string
+
+// 以下もconfigure()で読み出して設定する（radsecMaxInflight以外の単位は秒）
+// radsecHandshakeTimeoutは、TCP接続からTLSハンドシェイク完了までの制限時間。
+// radsecIdleTimeoutは、パケットを受信しないまま接続を維持する時間(応答の書き込みの制限時間にも使う)。
+// radsecMaxInflightは、1接続あたりで並行して処理するリクエストの上限。上限に達したら、処理が終わるまで次のパケットを読まない。
+var radsecHandshakeTimeout time.Duration
+var radsecIdleTimeout time.Duration
+var radsecMaxInflight int
+
+// RadSec経由のリクエストで、クライアント証明書から特定したradiusClientをcontextに載せるためのキー。
+type radsecClientContextKey struct{}
+
+// RadSecのサーバ証明書と、クライアント証明書検証用のCAを保持する構造体。
+// TLSハンドシェイクのたびにファイルの更新日時を確認し、更新されていれば読み直すことで再起動なしの証明書更新に対応する。
+type radsecCertStore struct {
+	mu          sync.Mutex
+	certFile    string
+	keyFile     string
+	caFile      string
+	certModTime time.Time
+	keyModTime  time.Time
+	caModTime   time.Time
+	cert        *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// ファイルの更新日時を確認し、前回読み込み時から変わっていれば証明書/鍵/CAを読み直す。
+// 読み直しに失敗した場合は、前回読み込んだ証明書をそのまま使い続ける。
+func (cs *radsecCertStore) reloadIfChanged() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	certInfo, certStatErr := os.Stat(cs.certFile)
+	if certStatErr != nil {
+		return certStatErr
+	}
+	keyInfo, keyStatErr := os.Stat(cs.keyFile)
+	if keyStatErr != nil {
+		return keyStatErr
+	}
+	if cs.cert == nil || !certInfo.ModTime().Equal(cs.certModTime) || !keyInfo.ModTime().Equal(cs.keyModTime) {
+		cert, loadErr := tls.LoadX509KeyPair(cs.certFile, cs.keyFile)
+		if loadErr != nil {
+			return loadErr
+		}
+		cs.cert = &cert
+		cs.certModTime = certInfo.ModTime()
+		cs.keyModTime = keyInfo.ModTime()
+		log.Printf("[RadSec] server certificate loaded : %v\n", cs.certFile)
+	}
+	caInfo, caStatErr := os.Stat(cs.caFile)
+	if caStatErr != nil {
+		return caStatErr
+	}
+	if cs.clientCAs == nil || !caInfo.ModTime().Equal(cs.caModTime) {
+		caPEM, readErr := os.ReadFile(cs.caFile)
+		if readErr != nil {
+			return readErr
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return errors.New("no valid certificate in client CA file")
+		}
+		cs.clientCAs = pool
+		cs.caModTime = caInfo.ModTime()
+		log.Printf("[RadSec] client CA loaded : %v\n", cs.caFile)
+	}
+	return nil
+}
+
+// TLSハンドシェイクごとに呼ばれ、最新の証明書とCAを使ったtls.Configを返す（tls.Config.GetConfigForClient用）。
+// クライアント証明書は必須(mutual TLS)とする。
+func (cs *radsecCertStore) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if reloadErr := cs.reloadIfChanged(); reloadErr != nil {
+		log.Printf("[RadSec] certificate reload failed, keep using current one / %v\n", reloadErr)
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.cert == nil || cs.clientCAs == nil {
+		return nil, errors.New("radsec certificate not loaded")
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*cs.cert},
+		ClientCAs:    cs.clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// クライアント証明書のCNおよびSAN DNS名を、Radiusクライアント一覧のradsecNameと照合する。
+func radsecClientLookup(cert *x509.Certificate) (radiusClient, bool) {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, c := range radiusClientTable {
+		if c.radsecName == "" {
+			continue
+		}
+		for _, name := range names {
+			if name == c.radsecName {
+				return c, true
+			}
+		}
+	}
+	return radiusClient{}, false
+}
+
+// RadSec接続1本分のResponseWriter。同一TCP接続上で複数リクエストを並行処理するため、書き込みは排他する。
+// 相手が受信しないまま書き込みが止まらないよう、書き込みごとにradsecIdleTimeoutの期限を設定する。
+type radsecResponseWriter struct {
+	mu   *sync.Mutex
+	conn net.Conn
+}
+
+func (rw radsecResponseWriter) Write(packet *radius.Packet) error {
+	encoded, encodeErr := packet.Encode()
+	if encodeErr != nil {
+		return encodeErr
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.conn.SetWriteDeadline(time.Now().Add(radsecIdleTimeout))
+	_, writeErr := rw.conn.Write(encoded)
+	return writeErr
+}
+
+// RadSec(RFC 6614) listenerを起動する。受信したRadiusパケットは、UDPと同じハンドラに渡す。
+// Accounting-Requestは、Accounting Serverが有効ならaccountingHandlerに渡す。Status-Serverは認証側のハンドラで応答する。
+func radsecListenAndServe(authHandler radius.Handler) error {
+	listenAddr := radsecListenAddr
+	if listenAddr == "" {
+		listenAddr = ":2083"
+	}
+	certStore := &radsecCertStore{
+		certFile: radsecCertFile,
+		keyFile:  radsecKeyFile,
+		caFile:   radsecClientCAFile,
+	}
+	if loadErr := certStore.reloadIfChanged(); loadErr != nil {
+		return loadErr
+	}
+	listener, listenErr := tls.Listen("tcp", listenAddr, &tls.Config{
+		GetConfigForClient: certStore.configForClient,
+	})
+	if listenErr != nil {
+		return listenErr
+	}
+	log.Printf("[RadSec] RadSec server start on %v\n", listenAddr)
+	for {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			var ne net.Error
+			if errors.As(acceptErr, &ne) && ne.Timeout() {
+				log.Printf("[RadSec] accept error / %v\n", acceptErr)
+				continue
+			}
+			return acceptErr
+		}
+		go radsecServeConn(conn.(*tls.Conn), authHandler)
+	}
+}
+
+// RadSec接続1本分の処理。ハンドシェイク後にクライアント証明書からRadiusクライアントを特定し、
+// 以降はRadiusパケット(先頭4byteのLengthで区切る)を読み出すたびにハンドラを起動する。
+// ハンドシェイクが終わらない接続と、radsecIdleTimeoutの間パケットが届かない接続は切断する。
+// 並行して処理するリクエストはradsecMaxInflightまでとし、上限に達している間は読み出しを止める(TCPの流量制御で相手を待たせる)。
+func radsecServeConn(conn *tls.Conn, authHandler radius.Handler) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr()
+	conn.SetDeadline(time.Now().Add(radsecHandshakeTimeout))
+	if handshakeErr := conn.Handshake(); handshakeErr != nil {
+		log.Printf("[RadSec] TLS handshake failed from %v / %v\n", remoteAddr, handshakeErr)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	peerCerts := conn.ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 {
+		log.Printf("[RadSec] no client certificate from %v\n", remoteAddr)
+		return
+	}
+	client, clientOK := radsecClientLookup(peerCerts[0])
+	if !clientOK {
+		log.Printf("[RadSec] client certificate not mapped to any Radius client : %v (%v)\n", peerCerts[0].Subject, remoteAddr)
+		return
+	}
+	log.Printf("[RadSec] connection established : %v (%v) %v\n", client.radsecName, remoteAddr, client.description)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), radsecClientContextKey{}, client))
+	defer cancel()
+	writer := radsecResponseWriter{mu: &sync.Mutex{}, conn: conn}
+	reader := bufio.NewReader(conn)
+	inflight := make(chan struct{}, radsecMaxInflight)
+	for {
+		conn.SetReadDeadline(time.Now().Add(radsecIdleTimeout))
+		header := make([]byte, 4)
+		if _, readErr := io.ReadFull(reader, header); readErr != nil {
+			var ne net.Error
+			if errors.As(readErr, &ne) && ne.Timeout() {
+				log.Printf("[RadSec] no packet from %v for %v, closing connection\n", remoteAddr, radsecIdleTimeout)
+			} else if readErr != io.EOF {
+				log.Printf("[RadSec] read error from %v / %v\n", remoteAddr, readErr)
+			}
+			log.Printf("[RadSec] connection closed : %v (%v)\n", client.radsecName, remoteAddr)
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		if length < 20 || length > radius.MaxPacketLength {
+			log.Printf("[RadSec] invalid packet length %v from %v, closing connection\n", length, remoteAddr)
+			return
+		}
+		buff := make([]byte, length)
+		copy(buff, header)
+		if _, readErr := io.ReadFull(reader, buff[4:]); readErr != nil {
+			log.Printf("[RadSec] read error from %v / %v\n", remoteAddr, readErr)
+			return
+		}
+		if !radius.IsAuthenticRequest(buff, radsecSharedSecret) {
+			log.Printf("[RadSec] packet validation failed from %v. silently discarded.\n", remoteAddr)
+			continue
+		}
+		packet, parseErr := radius.Parse(buff, radsecSharedSecret)
+		if parseErr != nil {
+			log.Printf("[RadSec] unable to parse packet from %v / %v\n", remoteAddr, parseErr)
+			continue
+		}
+		request := (&radius.Request{
+			LocalAddr:  conn.LocalAddr(),
+			RemoteAddr: remoteAddr,
+			Packet:     packet,
+		}).WithContext(ctx)
+		inflight <- struct{}{}
+		go func() {
+			defer func() { <-inflight }()
+			if request.Code == radius.CodeAccountingRequest {
+				if accountingEnabled {
+					accountingHandler(writer, request)
+				} else {
+					log.Printf("[RadSec] Accounting is disabled. %v from %v is silently discarded.\n", request.Code, remoteAddr)
+				}
+				return
+			}
+			authHandler.ServeRADIUS(writer, request)
+		}()
+	}
+}
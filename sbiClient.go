@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する（sbiHttpVersion以外の単位は秒）
+// sbiHttpVersionが"http2"なら、httpはprior knowledgeによるHTTP/2(h2c)、httpsはALPNによるHTTP/2(h2)で送信する。"http1"ならHTTP/1.1。
+// sbiRequestTimeoutはN12のRequest 1回分(Response bodyの読み取りまで)の期限。
+// sbiKeepAliveIntervalはTCPキープアライブの間隔で、HTTP/2ではこの間隔で受信がなければPINGを送って接続を確認する。
+var sbiHttpVersion string
+var sbiRequestTimeout time.Duration
+var sbiMaxIdleConnsPerHost int
+var sbiIdleConnTimeout time.Duration
+var sbiKeepAliveInterval time.Duration
+
+const (
+	sbiHttpVersion1 = "http1"
+	sbiHttpVersion2 = "http2"
+)
+
+// N12のHTTP Requestで共有するクライアント。configure()でnewSbiClientにより生成し、AUSFとの接続はTransportで使い回す。
+var sbiClient *http.Client
+
+// N12の接続の使い回し状況。GET /stats/sbi で確認できる。
+// newConnsは新規に確立した接続数、reusedConnsは既存の接続を使い回したRequest数(うちidleConnsはアイドル状態から再利用したもの)。
+// http1Requests/http2RequestsはResponseを受信したRequestのプロトコル別の数。
+type sbiConnCounters struct {
+	newConns      atomic.Uint64
+	reusedConns   atomic.Uint64
+	idleConns     atomic.Uint64
+	http1Requests atomic.Uint64
+	http2Requests atomic.Uint64
+}
+
+var sbiConnStats sbiConnCounters
+
+// 接続の使い回し状況をsbiConnStatsに記録するためのトレース。
+var sbiClientTrace = &httptrace.ClientTrace{
+	GotConn: func(info httptrace.GotConnInfo) {
+		if !info.Reused {
+			sbiConnStats.newConns.Add(1)
+			return
+		}
+		sbiConnStats.reusedConns.Add(1)
+		if info.WasIdle {
+			sbiConnStats.idleConns.Add(1)
+		}
+	},
+}
+
+// N12用のクライアントを生成する。https接続は、接続のたびに引数csからtls.Configを生成してハンドシェイクする。
+// HTTP/2では、http(h2c)はALPNがないためprior knowledgeで、https(h2)はALPNでh2を合意して通信する。
+// TS 29.500ではSBIはHTTP/2必須のため、"http2"の場合はHTTP/1.1へのフォールバックは行わない。
+func newSbiClient(cs *sbiTlsCertStore) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: sbiKeepAliveInterval}
+	nextProtos := []string{"http/1.1"}
+	protocols := new(http.Protocols)
+	if sbiHttpVersion == sbiHttpVersion2 {
+		nextProtos = []string{"h2"}
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	} else {
+		protocols.SetHTTP1(true)
+	}
+	transport := &http.Transport{
+		DialContext: dialer.DialContext,
+		DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			config, configErr := cs.configForAddress(address)
+			if configErr != nil {
+				return nil, configErr
+			}
+			config.NextProtos = nextProtos
+			conn, dialErr := dialer.DialContext(ctx, network, address)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			tlsConn := tls.Client(conn, config)
+			if handshakeErr := tlsConn.HandshakeContext(ctx); handshakeErr != nil {
+				conn.Close()
+				return nil, fmt.Errorf("TLS handshake with %v failed / %w", address, handshakeErr)
+			}
+			return tlsConn, nil
+		},
+		Protocols:           protocols,
+		ForceAttemptHTTP2:   sbiHttpVersion == sbiHttpVersion2,
+		MaxIdleConnsPerHost: sbiMaxIdleConnsPerHost,
+		IdleConnTimeout:     sbiIdleConnTimeout,
+		HTTP2: &http.HTTP2Config{
+			SendPingTimeout: sbiKeepAliveInterval,
+			PingTimeout:     5 * time.Second,
+		},
+	}
+	return &http.Client{Transport: transport}
+}
+
+// N12のRequest 1回分のcontextを返す。期限はsbiRequestTimeoutで、接続の使い回し状況を記録するトレースを付与する。
+// 呼び出し元はResponse bodyを読み終えた後にcancelを呼び出すこと。
+func sbiRequestContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), sbiRequestTimeout)
+	return httptrace.WithClientTrace(ctx, sbiClientTrace), cancel
+}
+
+// Responseのプロトコル(HTTP/1.1またはHTTP/2)をsbiConnStatsに記録する。
+func sbiResponseCount(res *http.Response) {
+	if res.ProtoMajor == 2 {
+		sbiConnStats.http2Requests.Add(1)
+	} else {
+		sbiConnStats.http1Requests.Add(1)
+	}
+}
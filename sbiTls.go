@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// ausfSchemeはausfAddress/ausfPool/ausfRoutesでschemeを省略したAUSFに使うscheme("http"または"https")。
+// sbiTlsCaFileが空ならOSの信頼済みCAでAUSFのサーバ証明書を検証する。sbiTlsCertFile/sbiTlsKeyFileを設定するとmutual TLSとなる。
+// sbiTlsServerNameを設定すると、SNIとサーバ証明書のホスト名検証にアドレスのホスト部分ではなくこの名前を使う。
+var ausfScheme string
+var sbiTlsCaFile string
+var sbiTlsCertFile string
+var sbiTlsKeyFile string
+var sbiTlsServerName string
+
+const (
+	sbiSchemeHttp  = "http"
+	sbiSchemeHttps = "https"
+)
+
+// N12(https)のクライアント証明書と、サーバ証明書検証用のCAを保持する構造体。
+// radsecCertStoreと同様に、TLS接続のたびにファイルの更新日時を確認し、更新されていれば読み直す。
+type sbiTlsCertStore struct {
+	mu          sync.Mutex
+	certFile    string
+	keyFile     string
+	caFile      string
+	certModTime time.Time
+	keyModTime  time.Time
+	caModTime   time.Time
+	cert        *tls.Certificate
+	rootCAs     *x509.CertPool
+}
+
+// N12で使うTLS証明書/CA。configure()で生成し、sbiClientのTransport(DialTLSContext)から参照する。
+var sbiCertStore *sbiTlsCertStore
+
+// ファイルの更新日時を確認し、前回読み込み時から変わっていればクライアント証明書/鍵/CAを読み直す。
+// 読み直しに失敗した場合は、前回読み込んだ証明書をそのまま使い続ける。ファイル名が空の項目は読み込まない。
+func (cs *sbiTlsCertStore) reloadIfChanged() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.certFile != "" {
+		certInfo, certStatErr := os.Stat(cs.certFile)
+		if certStatErr != nil {
+			return certStatErr
+		}
+		keyInfo, keyStatErr := os.Stat(cs.keyFile)
+		if keyStatErr != nil {
+			return keyStatErr
+		}
+		if cs.cert == nil || !certInfo.ModTime().Equal(cs.certModTime) || !keyInfo.ModTime().Equal(cs.keyModTime) {
+			cert, loadErr := tls.LoadX509KeyPair(cs.certFile, cs.keyFile)
+			if loadErr != nil {
+				return loadErr
+			}
+			cs.cert = &cert
+			cs.certModTime = certInfo.ModTime()
+			cs.keyModTime = keyInfo.ModTime()
+			log.Printf("[SBI TLS] client certificate loaded : %v\n", cs.certFile)
+		}
+	}
+	if cs.caFile != "" {
+		caInfo, caStatErr := os.Stat(cs.caFile)
+		if caStatErr != nil {
+			return caStatErr
+		}
+		if cs.rootCAs == nil || !caInfo.ModTime().Equal(cs.caModTime) {
+			caPEM, readErr := os.ReadFile(cs.caFile)
+			if readErr != nil {
+				return readErr
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return errors.New("no valid certificate in SBI CA file")
+			}
+			cs.rootCAs = pool
+			cs.caModTime = caInfo.ModTime()
+			log.Printf("[SBI TLS] CA loaded : %v\n", cs.caFile)
+		}
+	}
+	return nil
+}
+
+// 接続先アドレス("[ホスト]:[ポート番号]")向けに、最新の証明書とCAを使ったtls.Configを返す。
+// ServerNameはsbiTlsServerName(未設定ならアドレスのホスト部分)で、SNIとホスト名検証の両方に使われる。
+// ホストがIPアドレスの場合、SNIは送信されずサーバ証明書のSAN IPアドレスで検証される。
+func (cs *sbiTlsCertStore) configForAddress(address string) (*tls.Config, error) {
+	serverName := sbiTlsServerName
+	if serverName == "" {
+		host, _, splitErr := net.SplitHostPort(address)
+		if splitErr != nil {
+			return nil, splitErr
+		}
+		serverName = host
+	}
+	return cs.configForServerName(serverName)
+}
+
+// ServerNameを指定して、最新の証明書とCAを使ったクライアント側のtls.Configを返す。
+// クラスタのピア間通信(clusterTls)では、sbiTlsServerNameではなくピアのアドレスのホスト部分を指定する。
+func (cs *sbiTlsCertStore) configForServerName(serverName string) (*tls.Config, error) {
+	if reloadErr := cs.reloadIfChanged(); reloadErr != nil {
+		log.Printf("[SBI TLS] certificate reload failed, keep using current one / %v\n", reloadErr)
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.certFile != "" && cs.cert == nil {
+		return nil, errors.New("SBI client certificate not loaded")
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    cs.rootCAs,
+	}
+	if cs.cert != nil {
+		config.Certificates = []tls.Certificate{*cs.cert}
+	}
+	return config, nil
+}
+
+// クラスタのピア間通信(clusterTls)のサーバ側で、最新の証明書とCAを使ったtls.Configを返す。
+// クラスタ用のcertStore(clusterTlsCertFile/clusterTlsKeyFile/clusterTlsCaFile)で呼び出し、ピアのクライアント証明書(必須)をそのCAで検証する。
+func (cs *sbiTlsCertStore) configForClusterPeer(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if reloadErr := cs.reloadIfChanged(); reloadErr != nil {
+		log.Printf("[SBI TLS] certificate reload failed, keep using current one / %v\n", reloadErr)
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.cert == nil || cs.rootCAs == nil {
+		return nil, errors.New("cluster certificate not loaded")
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*cs.cert},
+		ClientCAs:    cs.rootCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// schemeの書式をチェックする。空文字列は上位の設定を引き継ぐ意味で許可する。
+func sbiSchemeValidate(scheme string) error {
+	switch scheme {
+	case "", sbiSchemeHttp, sbiSchemeHttps:
+		return nil
+	}
+	return errors.New("invalid scheme (http or https) : " + scheme)
+}
+
+// 設定ファイルのschemeを、優先順(プールのメンバー、ルート、トップレベル)に並べた引数から決定する。全て空なら"http"。
+func sbiSchemeOf(schemes ...string) string {
+	for _, scheme := range schemes {
+		if scheme != "" {
+			return scheme
+		}
+	}
+	return sbiSchemeHttp
+}
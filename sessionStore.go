@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+// eapSessionStoreTypeは、EAP認証セッションの格納先("memory"または"file")。
+// "file"の場合はeapSessionStoreFileに追記型のログとして書き出し、再起動時に読み直して認証を継続できるようにする。
+// eapSessionStoreSyncがtrueなら、書き込みのたびにfsyncする(電源断にも耐えるが、遅くなる)。
+var eapSessionStoreType string
+var eapSessionStoreFile string
+var eapSessionStoreSync bool
+
+const (
+	sessionStoreTypeMemory = "memory"
+	sessionStoreTypeFile   = "file"
+)
+
+// EAP認証セッションの格納先。キーはState(24)のHex文字列。
+// Storeは同じキーのセッションがあれば置き換え、置き換えたかどうかを返す。DeleteはLoadしたセッションを削除し、削除できたかどうかを返す。
+// 複数のハンドラ(goroutine)から同時に呼ばれるため、実装は並行呼び出しに対応すること。
+type sessionStore interface {
+	Store(key string, session eapSession) (bool, error)
+	Load(key string) (eapSession, bool)
+	Delete(key string) (bool, error)
+	Range(f func(key string, session eapSession) bool)
+	Len() int
+	Close() error
+}
+
+// EAP認証セッションの格納先。configure()でnewSessionStoreにより生成する。
+var eapSessions sessionStore
+
+// メモリ上のみで管理する格納先(従来のeapSessionTableと同じ)。再起動すると進行中のセッションは失われる。
+type memorySessionStore struct {
+	sessions sync.Map
+	count    atomic.Int64
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{}
+}
+
+func (ms *memorySessionStore) Store(key string, session eapSession) (bool, error) {
+	_, loaded := ms.sessions.Swap(key, session)
+	if !loaded {
+		ms.count.Add(1)
+	}
+	return loaded, nil
+}
+
+func (ms *memorySessionStore) Load(key string) (eapSession, bool) {
+	value, ok := ms.sessions.Load(key)
+	if !ok {
+		return eapSession{}, false
+	}
+	return value.(eapSession), true
+}
+
+func (ms *memorySessionStore) Delete(key string) (bool, error) {
+	_, deleted := ms.sessions.LoadAndDelete(key)
+	if deleted {
+		ms.count.Add(-1)
+	}
+	return deleted, nil
+}
+
+func (ms *memorySessionStore) Range(f func(key string, session eapSession) bool) {
+	ms.sessions.Range(func(key, value any) bool {
+		return f(key.(string), value.(eapSession))
+	})
+}
+
+func (ms *memorySessionStore) Len() int {
+	return int(ms.count.Load())
+}
+
+func (ms *memorySessionStore) Close() error {
+	return nil
+}
+
+// ファイルに書き出すeapSessionの形式。
+type eapSessionRecord struct {
+	EapId            uint8     `json:"eapId"`
+	Uri              string    `json:"uri,omitempty"`
+	NasAddress       string    `json:"nasAddress"`
+	CallingStationId string    `json:"callingStationId"`
+	AusfAddress      string    `json:"ausfAddress,omitempty"`
+	KeyName          []byte    `json:"keyName,omitempty"`
+	AuthCtxId        string    `json:"authCtxId,omitempty"`
+	IdentityReq      uint8     `json:"identityReq,omitempty"`
+	IdentityRounds   int       `json:"identityRounds,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+	LastActivity     time.Time `json:"lastActivity"`
+	Owner            string    `json:"owner,omitempty"`
+}
+
+func (session eapSession) record() *eapSessionRecord {
+	return &eapSessionRecord{
+		EapId:            session.eapId,
+		Uri:              session.uri,
+		NasAddress:       session.nasAddress,
+		CallingStationId: session.callingStationId,
+		AusfAddress:      session.ausfAddress,
+		KeyName:          session.keyName,
+		AuthCtxId:        session.authCtxId,
+		IdentityReq:      session.identityReq,
+		IdentityRounds:   session.identityRounds,
+		CreatedAt:        session.createdAt,
+		LastActivity:     session.lastActivity,
+		Owner:            session.owner,
+	}
+}
+
+func (rec *eapSessionRecord) session() eapSession {
+	return eapSession{
+		eapId:            rec.EapId,
+		uri:              rec.Uri,
+		nasAddress:       rec.NasAddress,
+		callingStationId: rec.CallingStationId,
+		ausfAddress:      rec.AusfAddress,
+		keyName:          rec.KeyName,
+		authCtxId:        rec.AuthCtxId,
+		identityReq:      rec.IdentityReq,
+		identityRounds:   rec.IdentityRounds,
+		createdAt:        rec.CreatedAt,
+		lastActivity:     rec.LastActivity,
+		owner:            rec.Owner,
+	}
+}
+
+// 追記型ログの1行分。opは"store"または"delete"で、"store"の場合のみsessionを持つ。
+type sessionLogEntry struct {
+	Op      string            `json:"op"`
+	Key     string            `json:"key"`
+	Session *eapSessionRecord `json:"session,omitempty"`
+}
+
+const (
+	sessionLogOpStore  = "store"
+	sessionLogOpDelete = "delete"
+)
+
+// 追記した行数がこれと保持数の4倍の大きい方を超えたら、ログを保持中のセッションだけに詰め直す。
+const sessionLogCompactMinRecords = 1024
+
+// メモリ上のセッションを、追記型のログファイル(1行1JSON)にも書き出す格納先。
+// 参照はメモリ上から行い、ファイルは起動時の読み直しにのみ使う。ログとメモリの順序を揃えるため、書き込みはmuで直列化する。
+type fileSessionStore struct {
+	memory     *memorySessionStore
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	syncWrites bool
+	records    int
+}
+
+// ログファイルを読み直してセッションを復元し、保持中のセッションだけに詰め直してから追記用に開く。
+// 最後の活動からttlを過ぎていたセッションは復元せず、2つ目の戻り値で返す(AUSFの認証コンテキストの解放に使う)。
+// 書き込み途中で停止した場合の壊れた行は、読み飛ばしてログに記録する。
+func openFileSessionStore(path string, syncWrites bool, ttl time.Duration) (*fileSessionStore, []eapSession, error) {
+	fs := &fileSessionStore{memory: newMemorySessionStore(), path: path, syncWrites: syncWrites}
+	replayed := make(map[string]eapSession)
+	if f, openErr := os.Open(path); openErr == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		var line, broken int
+		for scanner.Scan() {
+			line++
+			var entry sessionLogEntry
+			if decodeErr := json.Unmarshal(scanner.Bytes(), &entry); decodeErr != nil || entry.Key == "" {
+				broken++
+				continue
+			}
+			switch {
+			case entry.Op == sessionLogOpStore && entry.Session != nil:
+				replayed[entry.Key] = entry.Session.session()
+			case entry.Op == sessionLogOpDelete:
+				delete(replayed, entry.Key)
+			default:
+				broken++
+			}
+		}
+		scanErr := scanner.Err()
+		f.Close()
+		if scanErr != nil {
+			return nil, nil, fmt.Errorf("reading session log %v failed / %w", path, scanErr)
+		}
+		if broken > 0 {
+			log.Printf("[EAP session store] %v of %v lines in %v are broken and skipped\n", broken, line, path)
+		}
+	} else if !errors.Is(openErr, os.ErrNotExist) {
+		return nil, nil, openErr
+	}
+	var expired []eapSession
+	now := time.Now()
+	for key, session := range replayed {
+		if now.Sub(session.lastActivity) > ttl {
+			expired = append(expired, session)
+			continue
+		}
+		fs.memory.Store(key, session)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if compactErr := fs.compact(); compactErr != nil {
+		return nil, nil, compactErr
+	}
+	log.Printf("[EAP session store] %v sessions restored from %v (%v expired)\n", fs.memory.Len(), path, len(expired))
+	return fs, expired, nil
+}
+
+// ログに1行追記する。muを取得した状態で呼び出すこと。
+func (fs *fileSessionStore) append(entry sessionLogEntry) error {
+	line, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	if _, writeErr := fs.file.Write(append(line, '\n')); writeErr != nil {
+		return writeErr
+	}
+	fs.records++
+	if fs.syncWrites {
+		return fs.file.Sync()
+	}
+	return nil
+}
+
+// 保持中のセッションだけを一時ファイルに書き出し、元のログと置き換えて追記用に開き直す。muを取得した状態で呼び出すこと。
+func (fs *fileSessionStore) compact() error {
+	tmpPath := fs.path + ".tmp"
+	tmp, createErr := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if createErr != nil {
+		return createErr
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	var encodeErr error
+	fs.memory.Range(func(key string, session eapSession) bool {
+		encodeErr = encoder.Encode(sessionLogEntry{Op: sessionLogOpStore, Key: key, Session: session.record()})
+		return encodeErr == nil
+	})
+	if encodeErr == nil {
+		encodeErr = writer.Flush()
+	}
+	if encodeErr == nil {
+		encodeErr = tmp.Sync()
+	}
+	tmp.Close()
+	if encodeErr != nil {
+		os.Remove(tmpPath)
+		return encodeErr
+	}
+	if renameErr := os.Rename(tmpPath, fs.path); renameErr != nil {
+		os.Remove(tmpPath)
+		return renameErr
+	}
+	if fs.file != nil {
+		fs.file.Close()
+	}
+	file, openErr := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if openErr != nil {
+		fs.file = nil
+		return openErr
+	}
+	fs.file = file
+	fs.records = fs.memory.Len()
+	return nil
+}
+
+// メモリ上のセッションを更新してからログに追記する。ログへの書き込みに失敗してもメモリ上のセッションは有効なままとする。
+func (fs *fileSessionStore) Store(key string, session eapSession) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	loaded, _ := fs.memory.Store(key, session)
+	if fs.file == nil {
+		return loaded, errors.New("session log is not open")
+	}
+	if appendErr := fs.append(sessionLogEntry{Op: sessionLogOpStore, Key: key, Session: session.record()}); appendErr != nil {
+		return loaded, appendErr
+	}
+	if fs.records > sessionLogCompactMinRecords && fs.records > 4*fs.memory.Len() {
+		if compactErr := fs.compact(); compactErr != nil {
+			return loaded, fmt.Errorf("session log compaction failed / %w", compactErr)
+		}
+	}
+	return loaded, nil
+}
+
+func (fs *fileSessionStore) Load(key string) (eapSession, bool) {
+	return fs.memory.Load(key)
+}
+
+// メモリ上のセッションを削除し、削除できた場合のみログに追記する。
+func (fs *fileSessionStore) Delete(key string) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	deleted, _ := fs.memory.Delete(key)
+	if !deleted {
+		return false, nil
+	}
+	if fs.file == nil {
+		return true, errors.New("session log is not open")
+	}
+	return true, fs.append(sessionLogEntry{Op: sessionLogOpDelete, Key: key})
+}
+
+func (fs *fileSessionStore) Range(f func(key string, session eapSession) bool) {
+	fs.memory.Range(f)
+}
+
+func (fs *fileSessionStore) Len() int {
+	return fs.memory.Len()
+}
+
+func (fs *fileSessionStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.file == nil {
+		return nil
+	}
+	closeErr := fs.file.Close()
+	fs.file = nil
+	return closeErr
+}
+
+// 設定(eapSessionStoreType)に従ってEAP認証セッションの格納先を生成する。
+// "file"の場合は、再起動前のセッションのうちTTLを過ぎていたものを2つ目の戻り値で返す。
+func newSessionStore(storeType string, path string, syncWrites bool, ttl time.Duration) (sessionStore, []eapSession, error) {
+	switch storeType {
+	case "", sessionStoreTypeMemory:
+		return newMemorySessionStore(), nil, nil
+	case sessionStoreTypeFile:
+		return openFileSessionStore(path, syncWrites, ttl)
+	}
+	return nil, nil, errors.New("invalid eapSessionStore (memory or file) : " + storeType)
+}
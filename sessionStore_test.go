@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ログファイルの行数を返す。
+func sessionLogLinesForTest(t *testing.T, path string) int {
+	t.Helper()
+	data, readErr := os.ReadFile(path)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+// sessionLogEntryを1行分のJSONにする。
+func sessionLogLineForTest(t *testing.T, entry sessionLogEntry) string {
+	t.Helper()
+	line, marshalErr := json.Marshal(entry)
+	if marshalErr != nil {
+		t.Fatal(marshalErr)
+	}
+	return string(line) + "\n"
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	ms := newMemorySessionStore()
+	if loaded, _ := ms.Store("a", eapSession{eapId: 1}); loaded {
+		t.Error("new key reported as replaced")
+	}
+	if loaded, _ := ms.Store("a", eapSession{eapId: 2}); !loaded {
+		t.Error("existing key not reported as replaced")
+	}
+	if session, ok := ms.Load("a"); !ok || session.eapId != 2 || ms.Len() != 1 {
+		t.Errorf("Load = %+v, %v / Len = %v", session, ok, ms.Len())
+	}
+	if deleted, _ := ms.Delete("a"); !deleted {
+		t.Error("existing key not deleted")
+	}
+	if deleted, _ := ms.Delete("a"); deleted || ms.Len() != 0 {
+		t.Errorf("deleted twice / Len = %v", ms.Len())
+	}
+}
+
+func TestOpenFileSessionStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	now := time.Now()
+	var logData string
+	logData += sessionLogLineForTest(t, sessionLogEntry{Op: sessionLogOpStore, Key: "kept", Session: eapSession{eapId: 1, lastActivity: now}.record()})
+	logData += sessionLogLineForTest(t, sessionLogEntry{Op: sessionLogOpStore, Key: "deleted", Session: eapSession{eapId: 2, lastActivity: now}.record()})
+	logData += sessionLogLineForTest(t, sessionLogEntry{Op: sessionLogOpStore, Key: "expired", Session: eapSession{eapId: 3, uri: "http://192.0.2.1/ctx", lastActivity: now.Add(-time.Hour)}.record()})
+	logData += "not json\n"
+	logData += sessionLogLineForTest(t, sessionLogEntry{Op: "unknown", Key: "kept"})
+	logData += sessionLogLineForTest(t, sessionLogEntry{Op: sessionLogOpStore, Key: "kept", Session: eapSession{eapId: 4, lastActivity: now}.record()})
+	logData += sessionLogLineForTest(t, sessionLogEntry{Op: sessionLogOpDelete, Key: "deleted"})
+	// 書き込み途中で停止した最終行。
+	logData += `{"op":"store","key":"truncated","session":{"eapId":5,`
+	if writeErr := os.WriteFile(path, []byte(logData), 0600); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+
+	fs, expired, openErr := openFileSessionStore(path, false, time.Minute)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer fs.Close()
+	if session, ok := fs.Load("kept"); !ok || session.eapId != 4 {
+		t.Errorf("kept = %+v, %v, want the last stored one", session, ok)
+	}
+	for _, key := range []string{"deleted", "expired", "truncated"} {
+		if _, ok := fs.Load(key); ok {
+			t.Errorf("%q restored", key)
+		}
+	}
+	if len(expired) != 1 || expired[0].uri != "http://192.0.2.1/ctx" {
+		t.Errorf("expired = %+v", expired)
+	}
+	// 起動時に保持中のセッションだけに詰め直す。
+	if lines := sessionLogLinesForTest(t, path); lines != 1 || fs.Len() != 1 {
+		t.Errorf("log lines = %v / Len = %v, want 1", lines, fs.Len())
+	}
+	if _, statErr := os.Stat(path + ".tmp"); !errors.Is(statErr, os.ErrNotExist) {
+		t.Errorf("temporary file remains: %v", statErr)
+	}
+}
+
+func TestFileSessionStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	fs, _, openErr := openFileSessionStore(path, false, time.Minute)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	now := time.Now()
+	fs.Store("live", eapSession{eapId: 1, lastActivity: now})
+	// 同じキーの更新を重ねて、追記行数を詰め直しのしきい値まで増やす。
+	for i := range sessionLogCompactMinRecords - 1 {
+		if _, storeErr := fs.Store("updated", eapSession{eapId: uint8(i), lastActivity: now}); storeErr != nil {
+			t.Fatal(storeErr)
+		}
+	}
+	if lines := sessionLogLinesForTest(t, path); lines != sessionLogCompactMinRecords {
+		t.Fatalf("log lines before threshold = %v, want %v", lines, sessionLogCompactMinRecords)
+	}
+	fs.Store("updated", eapSession{eapId: 0xff, lastActivity: now})
+	if lines := sessionLogLinesForTest(t, path); lines != 2 {
+		t.Fatalf("log lines after compaction = %v, want 2", lines)
+	}
+	// 詰め直した後も追記を続けられる。
+	fs.Store("added", eapSession{eapId: 2, lastActivity: now})
+	fs.Delete("live")
+	if closeErr := fs.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+
+	reopened, expired, reopenErr := openFileSessionStore(path, false, time.Minute)
+	if reopenErr != nil {
+		t.Fatal(reopenErr)
+	}
+	defer reopened.Close()
+	want := map[string]uint8{"updated": 0xff, "added": 2}
+	if reopened.Len() != len(want) || len(expired) != 0 {
+		t.Errorf("reopened Len = %v / expired = %v", reopened.Len(), expired)
+	}
+	for key, eapId := range want {
+		if session, ok := reopened.Load(key); !ok || session.eapId != eapId {
+			t.Errorf("%q = %+v, %v", key, session, ok)
+		}
+	}
+}
+
+// 置き換えに失敗した場合は、一時ファイルを残さない。
+func TestFileSessionStoreCompactRenameFailure(t *testing.T) {
+	dir := t.TempDir()
+	// ログファイルのパスがディレクトリなので、一時ファイルで置き換えられない。
+	path := filepath.Join(dir, "sessions.log")
+	if mkdirErr := os.Mkdir(path, 0700); mkdirErr != nil {
+		t.Fatal(mkdirErr)
+	}
+	fs := &fileSessionStore{memory: newMemorySessionStore(), path: path}
+	fs.memory.Store("a", eapSession{eapId: 1})
+	if compactErr := fs.compact(); compactErr == nil {
+		t.Fatal("compaction succeeded")
+	}
+	if _, statErr := os.Stat(path + ".tmp"); !errors.Is(statErr, os.ErrNotExist) {
+		t.Errorf("temporary file remains: %v", statErr)
+	}
+}
+
+func TestNewSessionStore(t *testing.T) {
+	for _, storeType := range []string{"", sessionStoreTypeMemory, sessionStoreTypeFile, "redis"} {
+		store, _, err := newSessionStore(storeType, filepath.Join(t.TempDir(), "sessions.log"), false, time.Minute)
+		if (err != nil) != (storeType == "redis") {
+			t.Errorf("newSessionStore(%q) error = %v", storeType, err)
+		}
+		if store != nil {
+			store.Close()
+			if got := fmt.Sprintf("%T", store); (storeType == sessionStoreTypeFile) != (got == "*main.fileSessionStore") {
+				t.Errorf("newSessionStore(%q) = %v", storeType, got)
+			}
+		}
+	}
+}
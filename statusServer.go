@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+
+	"layeh.com/radius"
+)
+
+// 以下はconfigure()でrad5gcgwconf.yamlファイルから読み出して設定する
+var statusServerCheckAUSF bool
+
+// Status-Server(RFC 5997)受信時の処理。
+// Message-Authenticatorの検証に成功すれば、引数responseCodeの応答（認証ポートはAccess-Accept、AccountingポートはAccounting-Response）を返す。
+// statusServerCheckAUSF = true の場合は、ヘルスチェックで正常なAUSFが1台もないときは応答せず破棄し、APがセカンダリのGWにフェイルオーバーできるようにする。
+func statusServerHandle(w radius.ResponseWriter, r *radius.Request, responseCode radius.Code) {
+	log.Printf("[Status-Server] %v (ID: 0x%X) received from %v\n", r.Packet.Code, r.Packet.Identifier, r.RemoteAddr)
+	// RFC 5997ではStatus-ServerのMessage-Authenticatorは必須なので、クライアントの検証モード(legacyを含む)によらず検証する。
+	// 認証ポートでは呼び出し元で検証モードに従った検証(破棄カウンタの加算)を済ませているため、ここでは有無と値の確認のみとする。
+	if msgAuthCheckPs := messageAuthenticatorVerify(r); msgAuthCheckPs.discardFlag {
+		log.Printf("[Status-Server] Message-Authenticator is mandatory for Status-Server (RFC 5997) / %v / %v. silently discarded.\n", msgAuthCheckPs.errReason, msgAuthCheckPs.errString)
+		return
+	}
+	if statusServerCheckAUSF && !ausfPoolAnyHealthy() {
+		log.Printf("[Status-Server] AUSF is not reachable. %v from %v is silently discarded.\n", r.Packet.Code, r.RemoteAddr)
+		return
+	}
+	response := r.Response(responseCode)
+	if psSign := messageAuthenticatorSign(response); psSign.discardFlag {
+		log.Printf("[Status-Server] %v / %v. silently discarded.\n", psSign.errReason, psSign.errString)
+		return
+	}
+	if writingErr := w.Write(response); writingErr != nil {
+		log.Printf("[Status-Server] Failed to send %v / %v\n", responseCode, writingErr)
+	} else {
+		log.Printf("[Status-Server] %v (ID: 0x%X) send to %v\n", response.Code, response.Identifier, r.RemoteAddr)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// EAP-Response/IdentityがSUCI形式のNAI(TS 23.003 28.7.3)だった場合に、eapIdentiySet.identityPrefixに入れる値。
+const identityPrefixSuci = "suci"
+
+// SUCI形式のNAIから取り出した値。schemeOutputは、null-schemeならMSIN、Profile A/Bなら ECC公開鍵||暗号文||MACTag のHex文字列。
+// MCC/MNCはRealm("nai.5gc.mncXXX.mccYYY.3gppnetwork.org")から取り出し、MNCは先頭の0を除いて2桁に戻す(plmnFromRealmと同じ)。
+type suciIdentity struct {
+	mcc              string
+	mnc              string
+	routingIndicator string
+	schemeId         int
+	hnPubKeyId       int
+	schemeOutput     string
+	networkName      string
+}
+
+// SUCI形式のNAIの書式。
+// null-scheme   : type0.rid678.schid0.userid0999999999@nai.5gc.mnc015.mcc234.3gppnetwork.org
+// Profile A/B   : type0.rid678.schid1.hnkey27.ecckey<Hex>.cip<Hex>.mac<Hex>@nai.5gc.mnc015.mcc234.3gppnetwork.org
+var suciNaiPattern = regexp.MustCompile(`^type(\d)\.rid(\d{1,4})\.schid(\d{1,2})\.(?:userid(\d{5,10})|hnkey(\d{1,3})\.ecckey([0-9A-Fa-f]+)\.cip([0-9A-Fa-f]+)\.mac([0-9A-Fa-f]{16}))(@.+)$`)
+
+// EAP-Response/IdentityのIdentityがSUCI形式のNAIかどうか（"type"で始まるか）を判定する。
+func isSuciNai(identity string) bool {
+	return strings.HasPrefix(identity, "type")
+}
+
+// SUCI形式のNAIを解析する。SUPIタイプはIMSI(type0)のみ対応し、null-scheme(schid0)とProfile A/B(schid1/2)を受け付ける。
+func parseSuciNai(identity string) (suciIdentity, error) {
+	var suci suciIdentity
+	matched := suciNaiPattern.FindStringSubmatch(identity)
+	if matched == nil {
+		return suci, errors.New("invalid SUCI NAI format")
+	}
+	if matched[1] != "0" {
+		return suci, fmt.Errorf("SUPI type %v is not supported", matched[1])
+	}
+	suci.routingIndicator = matched[2]
+	suci.schemeId, _ = strconv.Atoi(matched[3])
+	suci.networkName = matched[9]
+	mcc, mnc, plmnFound := plmnFromRealm(strings.ToLower(suci.networkName))
+	if !plmnFound || !strings.HasPrefix(strings.ToLower(suci.networkName), "@nai.5gc.") {
+		return suci, errors.New("invalid SUCI NAI realm : " + suci.networkName)
+	}
+	suci.mcc, suci.mnc = mcc, mnc
+	switch {
+	case suci.schemeId == 0 && matched[4] != "":
+		suci.schemeOutput = matched[4]
+	case (suci.schemeId == 1 || suci.schemeId == 2) && matched[4] == "":
+		suci.hnPubKeyId, _ = strconv.Atoi(matched[5])
+		suci.schemeOutput = strings.ToLower(matched[6] + matched[7] + matched[8])
+	default:
+		return suci, fmt.Errorf("protection scheme %v does not match SUCI NAI format", suci.schemeId)
+	}
+	return suci, nil
+}
+
+// N12のsupiOrSuciに載せるSUCI文字列(TS 29.503)を返す。
+// 例: suci-0-234-15-678-0-0-0999999999 (null-scheme) / suci-0-234-15-678-1-27-<schemeOutput> (Profile A)
+func (suci suciIdentity) supiOrSuci() string {
+	return fmt.Sprintf("suci-0-%v-%v-%v-%v-%v-%v", suci.mcc, suci.mnc, suci.routingIndicator, suci.schemeId, suci.hnPubKeyId, suci.schemeOutput)
+}
+
+// ルーティング(ausfRouteSelect)でIMSIの代わりに照合する値を返す。
+// null-schemeならIMSI(MCC+MNC+MSIN)、秘匿されている場合はPLMN(MCC+MNC)のみとなる。
+func (suci suciIdentity) imsiForRouting() string {
+	if suci.schemeId == 0 {
+		return suci.mcc + suci.mnc + suci.schemeOutput
+	}
+	return suci.mcc + suci.mnc
+}
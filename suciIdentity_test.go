@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestParseSuciNai(t *testing.T) {
+	const ecc = "b2e92f836055a255837debf850b528997ce0201cb82adfe4be1f587d07d8457d"
+	tests := []struct {
+		name           string
+		identity       string
+		wantSupiOrSuci string
+		wantRouting    string
+		wantRid        string
+		wantErr        bool
+	}{
+		{name: "null-scheme 2-digit MNC", identity: "type0.rid678.schid0.userid0999999999@nai.5gc.mnc015.mcc234.3gppnetwork.org",
+			wantSupiOrSuci: "suci-0-234-15-678-0-0-0999999999", wantRouting: "234150999999999", wantRid: "678"},
+		{name: "null-scheme 3-digit MNC", identity: "type0.rid0.schid0.userid123456789@nai.5gc.mnc260.mcc310.3gppnetwork.org",
+			wantSupiOrSuci: "suci-0-310-260-0-0-0-123456789", wantRouting: "310260123456789", wantRid: "0"},
+		{name: "Profile A", identity: "type0.rid678.schid1.hnkey27.ecckey" + ecc + ".cipCB02352410.mac1F2E3D4C5B6A7980@nai.5gc.mnc015.mcc234.3gppnetwork.org",
+			wantSupiOrSuci: "suci-0-234-15-678-1-27-" + ecc + "cb023524101f2e3d4c5b6a7980", wantRouting: "23415", wantRid: "678"},
+		{name: "Profile B", identity: "type0.rid1.schid2.hnkey1.ecckey02ab.cip01.mac0011223344556677@nai.5gc.mnc001.mcc001.3gppnetwork.org",
+			wantSupiOrSuci: "suci-0-001-01-1-2-1-02ab010011223344556677", wantRouting: "00101", wantRid: "1"},
+		{name: "NAI type", identity: "type1.rid678.schid0.userid0999999999@nai.5gc.mnc015.mcc234.3gppnetwork.org", wantErr: true},
+		{name: "null-scheme with ECC key", identity: "type0.rid678.schid0.hnkey27.ecckey02ab.cip01.mac0011223344556677@nai.5gc.mnc015.mcc234.3gppnetwork.org", wantErr: true},
+		{name: "Profile A with MSIN", identity: "type0.rid678.schid1.userid0999999999@nai.5gc.mnc015.mcc234.3gppnetwork.org", wantErr: true},
+		{name: "short MAC", identity: "type0.rid678.schid1.hnkey27.ecckey02ab.cip01.mac00112233@nai.5gc.mnc015.mcc234.3gppnetwork.org", wantErr: true},
+		{name: "wlan realm", identity: "type0.rid678.schid0.userid0999999999@wlan.mnc015.mcc234.3gppnetwork.org", wantErr: true},
+		{name: "non-3GPP realm", identity: "type0.rid678.schid0.userid0999999999@nai.5gc.example.net", wantErr: true},
+		{name: "routing indicator too long", identity: "type0.rid12345.schid0.userid0999999999@nai.5gc.mnc015.mcc234.3gppnetwork.org", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !isSuciNai(tt.identity) {
+				t.Fatalf("isSuciNai(%q) = false", tt.identity)
+			}
+			suci, err := parseSuciNai(tt.identity)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", suci)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := suci.supiOrSuci(); got != tt.wantSupiOrSuci {
+				t.Errorf("supiOrSuci = %v, want %v", got, tt.wantSupiOrSuci)
+			}
+			if got := suci.imsiForRouting(); got != tt.wantRouting {
+				t.Errorf("imsiForRouting = %v, want %v", got, tt.wantRouting)
+			}
+			if suci.routingIndicator != tt.wantRid {
+				t.Errorf("routingIndicator = %v, want %v", suci.routingIndicator, tt.wantRid)
+			}
+		})
+	}
+}